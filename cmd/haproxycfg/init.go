@@ -27,19 +27,21 @@ import (
 )
 
 var (
-	force = false
+	force   = false
+	bindArg = ""
 )
 
 func InitializeConfigCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
-		Use:   "init <loadbalancer DNS name> <first master IP>",
+		Use:   "init <loadbalancer DNS name> <first master IP> [<master>...]",
 		Short: "Create initial haproxy.cfg overwriting existing one",
 		Run:   initializeConfig,
-		Args:  cobra.ExactArgs(2),
+		Args:  cobra.MinimumNArgs(2),
 	}
 
 	subCmd.PersistentFlags().StringVar(&OutputDir, "dir", OutputDir, "Directory, in which haproxy.cfg should be written")
 	subCmd.PersistentFlags().BoolVar(&force, "force", false, "force overwriting of existing haproxy.cfg")
+	subCmd.PersistentFlags().StringVar(&bindArg, "bind", bindArg, "Address the k8s-api frontend listens on, default is the loadbalancer DNS name")
 
 	return subCmd
 }
@@ -80,10 +82,18 @@ func set_perm(path string) error {
 	return os.Chown(path, 0, gid)
 }
 
-func add_k8s_entry(f *os.File, lb_dns_name string, apiserver1 string) {
+func add_k8s_entry(f *os.File, bind string, apiservers []string) {
+	binds := "    bind " + bind + ":6443\n"
+	// a wildcard address includes localhost already
+	if bind != "0.0.0.0" && bind != "*" {
+		binds = binds + "    bind localhost:6443\n"
+	}
+	servers := ""
+	for i, server := range apiservers {
+		servers = servers + "    server apiserver" + strconv.Itoa(i+1) + " " + server + ":6443 check\n"
+	}
 	_, err := f.WriteString("frontend k8s-api\n" +
-		"    bind " + lb_dns_name + ":6443\n" +
-		"    bind localhost:6443\n" +
+		binds +
 		"    mode tcp\n" +
 		"    option tcplog\n" +
 		"    timeout client 125s\n" +
@@ -95,7 +105,7 @@ func add_k8s_entry(f *os.File, lb_dns_name string, apiserver1 string) {
 		"    timeout server 125s\n" +
 		"    balance roundrobin\n" +
 		"    default-server inter 10s downinter 5s rise 2 fall 2 slowstart 60s maxconn 250 maxqueue 256 weight 100\n" +
-		"    server apiserver1 " + apiserver1 + ":6443 check\n\n")
+		servers + "\n")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Writing to haproxy.cfg failed: %v", err)
 		os.Exit(1)
@@ -104,8 +114,11 @@ func add_k8s_entry(f *os.File, lb_dns_name string, apiserver1 string) {
 
 func initializeConfig(cmd *cobra.Command, args []string) {
 
-	lb_dns_name := args[0]
-	apiserver1 := args[1]
+	bind := args[0]
+	if len(bindArg) > 0 {
+		bind = bindArg
+	}
+	apiservers := args[1:]
 
 	if len(OutputDir) > 0 && OutputDir[len(OutputDir)-1:] != "/" {
 		OutputDir = OutputDir + "/"
@@ -161,7 +174,7 @@ func initializeConfig(cmd *cobra.Command, args []string) {
 			os.Exit(1)
 		}
 
-		add_k8s_entry(f, lb_dns_name, apiserver1)
+		add_k8s_entry(f, bind, apiservers)
 
 		if err := f.Close(); err != nil {
 			fmt.Fprintf(os.Stderr, "Closing \""+OutputDir+"haproxy.cfg\" failed: %v", err)
@@ -225,7 +238,7 @@ func initializeConfig(cmd *cobra.Command, args []string) {
 			}
 
 		}
-		add_k8s_entry(f, lb_dns_name, apiserver1)
+		add_k8s_entry(f, bind, apiservers)
 
 		if err := f.Close(); err != nil {
 			fmt.Fprintf(os.Stderr, "Closing \""+OutputDir+"haproxy.cfg\" failed: %v", err)
@@ -0,0 +1,166 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+var (
+	keepalivedDir = "/etc/keepalived"
+	vrrpInterface = ""
+	vrrpPriority  = 100
+	vrrpRouterID  = 51
+)
+
+func KeepalivedCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "keepalived <virtual IP>",
+		Short: "Create keepalived.conf sharing the virtual IP between haproxy nodes",
+		Run:   keepalivedConfig,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&keepalivedDir, "dir", keepalivedDir, "Directory, in which keepalived.conf should be written")
+	subCmd.PersistentFlags().StringVar(&vrrpInterface, "interface", vrrpInterface, "Network interface for the virtual IP, default is the one of the route to it")
+	subCmd.PersistentFlags().IntVar(&vrrpPriority, "priority", vrrpPriority, "VRRP priority of this node, the node with the highest priority holds the virtual IP")
+	subCmd.PersistentFlags().IntVar(&vrrpRouterID, "router-id", vrrpRouterID, "VRRP router id, must be the same on all haproxy nodes and unique in the network")
+
+	return subCmd
+}
+
+// routeInterface returns the network interface used to reach ip.
+func routeInterface(ip string) (string, error) {
+	success, message := tools.ExecuteCmd("ip", "-o", "route", "get", ip)
+	if !success {
+		return "", fmt.Errorf("%s", message)
+	}
+	fields := strings.Fields(message)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("no interface found for %s", ip)
+}
+
+func keepalivedConfig(cmd *cobra.Command, args []string) {
+
+	vip := args[0]
+
+	ip := strings.SplitN(vip, "/", 2)[0]
+	if net.ParseIP(ip) == nil {
+		fmt.Fprintf(os.Stderr, "Invalid virtual IP '%s'\n", vip)
+		os.Exit(1)
+	}
+	// vrrp_instance is VRRPv2, which cannot carry IPv6 addresses
+	if net.ParseIP(ip).To4() == nil {
+		fmt.Fprintf(os.Stderr, "Virtual IP '%s' is no IPv4 address, only IPv4 is supported\n", vip)
+		os.Exit(1)
+	}
+	if vrrpPriority < 1 || vrrpPriority > 254 {
+		fmt.Fprintf(os.Stderr, "Priority must be between 1 and 254\n")
+		os.Exit(1)
+	}
+	if vrrpRouterID < 1 || vrrpRouterID > 255 {
+		fmt.Fprintf(os.Stderr, "Router id must be between 1 and 255\n")
+		os.Exit(1)
+	}
+	if len(vrrpInterface) == 0 {
+		var err error
+		vrrpInterface, err = routeInterface(ip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot determine network interface: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(keepalivedDir) > 0 && keepalivedDir[len(keepalivedDir)-1:] != "/" {
+		keepalivedDir = keepalivedDir + "/"
+	}
+
+	// All nodes start as backup, the one with the highest priority
+	// becomes master. If haproxy or the API server is not reachable
+	// through it, the priority is lowered, so that another node with
+	// working haproxy takes over.
+	f, err := os.Create(keepalivedDir + "keepalived.conf")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create \""+keepalivedDir+"keepalived.conf\": %v", err)
+		os.Exit(1)
+	}
+	_, err = f.WriteString("# Generated by haproxycfg, do not edit\n" +
+		"global_defs {\n" +
+		"    enable_script_security\n" +
+		"    script_user root\n" +
+		"}\n" +
+		"\n" +
+		"vrrp_script chk_haproxy {\n" +
+		"    script \"/usr/bin/systemctl is-active --quiet haproxy\"\n" +
+		"    interval 2\n" +
+		"    fall 2\n" +
+		"    rise 2\n" +
+		"    weight -50\n" +
+		"}\n" +
+		"\n" +
+		"vrrp_script chk_apiserver {\n" +
+		"    script \"/usr/bin/curl -fsk --max-time 3 https://localhost:6443/healthz\"\n" +
+		"    interval 5\n" +
+		"    fall 3\n" +
+		"    rise 2\n" +
+		"    weight -50\n" +
+		"}\n" +
+		"\n" +
+		"vrrp_instance k8s-api {\n" +
+		"    state BACKUP\n" +
+		"    interface " + vrrpInterface + "\n" +
+		"    virtual_router_id " + strconv.Itoa(vrrpRouterID) + "\n" +
+		"    priority " + strconv.Itoa(vrrpPriority) + "\n" +
+		"    advert_int 1\n" +
+		"    virtual_ipaddress {\n" +
+		"        " + vip + "\n" +
+		"    }\n" +
+		"    track_script {\n" +
+		"        chk_haproxy\n" +
+		"        chk_apiserver\n" +
+		"    }\n" +
+		"}\n")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Wrting to \""+keepalivedDir+"keepalived.conf\" failed: %v", err)
+		os.Exit(1)
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Closing \""+keepalivedDir+"keepalived.conf\" failed: %v", err)
+		os.Exit(1)
+	}
+	os.Chmod(keepalivedDir+"keepalived.conf", 0640)
+	fmt.Printf("keepalived.conf created\n")
+
+	tools.ExecuteCmd("systemctl", "enable", "keepalived")
+	success, message := tools.ExecuteCmd("systemctl", "restart", "keepalived")
+	if !success {
+		fmt.Fprintf(os.Stderr, "Error restarting keepalived: %s\n",
+			message)
+		os.Exit(1)
+	} else {
+		fmt.Print("keepalived enabled and restarted\n")
+	}
+}
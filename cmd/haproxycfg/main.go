@@ -49,6 +49,7 @@ func main() {
 		VersionCmd(),
 		InitializeConfigCmd(),
 		ServerCmd(),
+		KeepalivedCmd(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,475 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The REST gateway maps "POST /api.<Service>/<Function>" with the
+// request as JSON body to the gRPC functions. The calls run through
+// the same interceptors as gRPC calls, so the client certificate is
+// checked against RBAC, the call is audited, etc. Streamed replies are
+// sent as JSON lines or, if requested with "Accept: text/event-stream",
+// as server-sent events.
+
+// gatewayServices are the services available with the REST gateway.
+var gatewayServices = []string{"Kubeadm", "Deploy", "Certificate", "Yomi", "Runtime"}
+
+type gatewayMethod struct {
+	newRequest func() proto.Message
+	// one of unary or stream is set
+	unary  func(ctx context.Context, req proto.Message) (interface{}, error)
+	stream func(req proto.Message, stream grpc.ServerStream) error
+}
+
+var (
+	gatewayKubeadm = &kubeadm_server{}
+	gatewayDeploy  = &deploy_server{}
+	gatewayCert    = &cert_server{}
+	gatewayYomi    = &yomi_server{}
+	gatewayRuntime = &runtime_server{}
+
+	gatewayMethods = map[string]gatewayMethod{
+		"/api.Kubeadm/InitMaster": {
+			newRequest: func() proto.Message { return &pb.InitRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.InitMaster(req.(*pb.InitRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/AddNode": {
+			newRequest: func() proto.Message { return &pb.AddNodeRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.AddNode(req.(*pb.AddNodeRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/RemoveNode": {
+			newRequest: func() proto.Message { return &pb.RemoveNodeRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.RemoveNode(req.(*pb.RemoveNodeRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/RebootNode": {
+			newRequest: func() proto.Message { return &pb.RebootNodeRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.RebootNode(ctx, req.(*pb.RebootNodeRequest))
+			}},
+		"/api.Kubeadm/UpdateNodeMetadata": {
+			newRequest: func() proto.Message { return &pb.NodeMetadataRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.UpdateNodeMetadata(ctx, req.(*pb.NodeMetadataRequest))
+			}},
+		"/api.Kubeadm/CordonNode": {
+			newRequest: func() proto.Message { return &pb.CordonRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.CordonNode(ctx, req.(*pb.CordonRequest))
+			}},
+		"/api.Kubeadm/UncordonNode": {
+			newRequest: func() proto.Message { return &pb.CordonRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.UncordonNode(ctx, req.(*pb.CordonRequest))
+			}},
+		"/api.Kubeadm/DrainNode": {
+			newRequest: func() proto.Message { return &pb.DrainRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.DrainNode(req.(*pb.DrainRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/RollingReboot": {
+			newRequest: func() proto.Message { return &pb.RollingRebootRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.RollingReboot(req.(*pb.RollingRebootRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/ConfigureKubelet": {
+			newRequest: func() proto.Message { return &pb.KubeletConfigRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.ConfigureKubelet(req.(*pb.KubeletConfigRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/PrepullImages": {
+			newRequest: func() proto.Message { return &pb.PrepullRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.PrepullImages(req.(*pb.PrepullRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/UpdateLoadBalancer": {
+			newRequest: func() proto.Message { return &pb.LoadBalancerRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.UpdateLoadBalancer(req.(*pb.LoadBalancerRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/ListNodes": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.ListNodes(ctx, req.(*pb.Empty))
+			}},
+		"/api.Kubeadm/ListMasters": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.ListMasters(ctx, req.(*pb.Empty))
+			}},
+		"/api.Kubeadm/ListMinions": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.ListMinions(ctx, req.(*pb.Empty))
+			}},
+		"/api.Kubeadm/DestroyMaster": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.DestroyMaster(req.(*pb.Empty), &statusStream{s})
+			}},
+		"/api.Kubeadm/UpgradeKubernetes": {
+			newRequest: func() proto.Message { return &pb.UpgradeRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.UpgradeKubernetes(req.(*pb.UpgradeRequest), &statusStream{s})
+			}},
+		"/api.Kubeadm/UpgradePlan": {
+			newRequest: func() proto.Message { return &pb.UpgradeRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.UpgradePlan(ctx, req.(*pb.UpgradeRequest))
+			}},
+		"/api.Kubeadm/UpgradeStatus": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.UpgradeStatus(ctx, req.(*pb.Empty))
+			}},
+		"/api.Kubeadm/FetchKubeconfig": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayKubeadm.FetchKubeconfig(ctx, req.(*pb.Empty))
+			}},
+		"/api.Kubeadm/GetStatus": {
+			newRequest: func() proto.Message { return &pb.Empty{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayKubeadm.GetStatus(req.(*pb.Empty), &statusStream{s})
+			}},
+		"/api.Certificate/CreateCert": {
+			newRequest: func() proto.Message { return &pb.CreateCertRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayCert.CreateCert(ctx, req.(*pb.CreateCertRequest))
+			}},
+		"/api.Deploy/DeployKustomize": {
+			newRequest: func() proto.Message { return &pb.DeployKustomizeRequest{} },
+			unary: func(ctx context.Context, req proto.Message) (interface{}, error) {
+				return gatewayDeploy.DeployKustomize(ctx, req.(*pb.DeployKustomizeRequest))
+			}},
+		"/api.Runtime/Configure": {
+			newRequest: func() proto.Message { return &pb.RuntimeConfigRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayRuntime.Configure(req.(*pb.RuntimeConfigRequest), &statusStream{s})
+			}},
+		"/api.Runtime/SetRegistryCredentials": {
+			newRequest: func() proto.Message { return &pb.RegistryCredentialsRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayRuntime.SetRegistryCredentials(req.(*pb.RegistryCredentialsRequest), &statusStream{s})
+			}},
+		"/api.Yomi/PrepareConfig": {
+			newRequest: func() proto.Message { return &pb.PrepareConfigRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayYomi.PrepareConfig(req.(*pb.PrepareConfigRequest), &statusStream{s})
+			}},
+		"/api.Yomi/Install": {
+			newRequest: func() proto.Message { return &pb.InstallRequest{} },
+			stream: func(req proto.Message, s grpc.ServerStream) error {
+				return gatewayYomi.Install(req.(*pb.InstallRequest), &statusStream{s})
+			}},
+	}
+)
+
+// statusStream implements the server side of all gRPC streams
+// sending StatusReply messages.
+type statusStream struct {
+	grpc.ServerStream
+}
+
+func (s *statusStream) Send(m *pb.StatusReply) error {
+	return s.SendMsg(m)
+}
+
+// gatewayStream is the HTTP request and response of a call. It is
+// used as grpc.ServerStream for streaming functions.
+type gatewayStream struct {
+	ctx     context.Context
+	method  string
+	w       http.ResponseWriter
+	r       *http.Request
+	sse     bool
+	started bool
+	read    bool
+}
+
+func (s *gatewayStream) SetHeader(md metadata.MD) error {
+	if s.started {
+		return status.Error(codes.Internal, "reply already started")
+	}
+	for key, values := range md {
+		for _, value := range values {
+			s.w.Header().Add(key, value)
+		}
+	}
+	return nil
+}
+
+func (s *gatewayStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *gatewayStream) SetTrailer(md metadata.MD) {
+}
+
+func (s *gatewayStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *gatewayStream) RecvMsg(m interface{}) error {
+	if s.read {
+		return io.EOF
+	}
+	s.read = true
+	return decodeRequest(s.r, m.(proto.Message))
+}
+
+func (s *gatewayStream) SendMsg(m interface{}) error {
+	if !s.started {
+		s.started = true
+		if s.sse {
+			s.w.Header().Set("Content-Type", "text/event-stream")
+			s.w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			s.w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		s.w.WriteHeader(http.StatusOK)
+	}
+
+	data, err := marshalReply(m)
+	if err != nil {
+		return err
+	}
+	if s.sse {
+		_, err = fmt.Fprintf(s.w, "data: %s\n\n", data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+// sendError reports the error of a call. If the reply did already
+// start, the error is sent as last message of the stream.
+func (s *gatewayStream) sendError(err error) {
+	st := status.Convert(err)
+	data, _ := json.Marshal(map[string]string{
+		"code":    st.Code().String(),
+		"message": st.Message(),
+	})
+
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/json")
+		s.w.WriteHeader(httpStatus(st.Code()))
+		s.w.Write(data)
+		return
+	}
+	if s.sse {
+		fmt.Fprintf(s.w, "event: error\ndata: %s\n\n", data)
+	} else {
+		fmt.Fprintf(s.w, "{\"error\":%s}\n", data)
+	}
+}
+
+func decodeRequest(r *http.Request, m proto.Message) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil
+	}
+	if err := jsonpb.UnmarshalString(string(body), m); err != nil {
+		return status.Error(codes.InvalidArgument, "invalid request: "+err.Error())
+	}
+	return nil
+}
+
+func marshalReply(m interface{}) (string, error) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return "", status.Errorf(codes.Internal, "cannot marshal %T", m)
+	}
+	marshaler := jsonpb.Marshaler{OrigName: true, EmitDefaults: true}
+	return marshaler.MarshalToString(msg)
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// gatewayTransportStream is the grpc.ServerTransportStream of unary
+// calls, so that the interceptors can set the operation ID.
+type gatewayTransportStream struct {
+	s *gatewayStream
+}
+
+func (t *gatewayTransportStream) Method() string {
+	return t.s.method
+}
+
+func (t *gatewayTransportStream) SetHeader(md metadata.MD) error {
+	return t.s.SetHeader(md)
+}
+
+func (t *gatewayTransportStream) SendHeader(md metadata.MD) error {
+	return t.s.SetHeader(md)
+}
+
+func (t *gatewayTransportStream) SetTrailer(md metadata.MD) error {
+	return nil
+}
+
+// gatewayAddr is the address of the HTTP client.
+type gatewayAddr string
+
+func (a gatewayAddr) Network() string { return "tcp" }
+func (a gatewayAddr) String() string  { return string(a) }
+
+type gateway struct {
+	openapi []byte
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := &gatewayStream{method: r.URL.Path, w: w, r: r,
+		sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream")}
+
+	if r.URL.Path == "/openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(g.openapi)
+		return
+	}
+
+	m, ok := gatewayMethods[r.URL.Path]
+	if !ok {
+		s.sendError(status.Errorf(codes.NotFound, "unknown function '%s'", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// make the client certificate available to the interceptors like
+	// for a gRPC call
+	s.ctx = peer.NewContext(r.Context(), &peer.Peer{
+		Addr:     gatewayAddr(r.RemoteAddr),
+		AuthInfo: credentials.TLSInfo{State: *r.TLS},
+	})
+	if id := r.Header.Get("Approval-Id"); len(id) > 0 {
+		s.ctx = metadata.NewIncomingContext(s.ctx, metadata.Pairs("approval-id", id))
+	}
+
+	var err error
+	if m.unary != nil {
+		req := m.newRequest()
+		if err = decodeRequest(r, req); err == nil {
+			ctx := grpc.NewContextWithServerTransportStream(s.ctx, &gatewayTransportStream{s})
+			var reply interface{}
+			reply, err = AuthUnaryInterceptor(ctx, req,
+				&grpc.UnaryServerInfo{Server: gatewayKubeadm, FullMethod: r.URL.Path},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return m.unary(ctx, req.(proto.Message))
+				})
+			if err == nil {
+				data, merr := marshalReply(reply)
+				if merr != nil {
+					err = merr
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(data))
+				}
+			}
+		}
+	} else {
+		err = AuthStreamInterceptor(nil, s,
+			&grpc.StreamServerInfo{FullMethod: r.URL.Path, IsServerStream: true},
+			func(srv interface{}, stream grpc.ServerStream) error {
+				req := m.newRequest()
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return m.stream(req, stream)
+			})
+	}
+	if err != nil {
+		s.sendError(err)
+	}
+}
+
+// serveGateway starts the REST gateway on address with the same TLS
+// configuration as the gRPC server.
+func serveGateway(address string, tlsConfig *tls.Config) (*http.Server, error) {
+	doc, err := openAPIDocument()
+	if err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:   &gateway{openapi: doc},
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		if err := server.ServeTLS(lis, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Errorf("REST gateway failed: %v", err)
+		}
+	}()
+	log.Infof("Serving REST gateway on https://%s/", lis.Addr())
+
+	return server, nil
+}
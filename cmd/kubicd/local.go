@@ -0,0 +1,121 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// peerCredInfo is the AuthInfo of callers on the local Unix socket.
+type peerCredInfo struct {
+	credentials.CommonAuthInfo
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+func (p peerCredInfo) AuthType() string {
+	return "peercred"
+}
+
+func (p peerCredInfo) String() string {
+	return fmt.Sprintf("unix:pid=%d,uid=%d", p.Pid, p.Uid)
+}
+
+// localCredentials uses TLS for TCP connections and SO_PEERCRED for
+// connections on the local Unix socket.
+type localCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c *localCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return c.TransportCredentials.ServerHandshake(conn)
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get peer credentials: %v", err)
+	}
+
+	return conn, peerCredInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		Pid:            ucred.Pid,
+		Uid:            ucred.Uid,
+		Gid:            ucred.Gid,
+	}, nil
+}
+
+func (c *localCredentials) Clone() credentials.TransportCredentials {
+	return &localCredentials{c.TransportCredentials.Clone()}
+}
+
+// listenSocket creates the local Unix socket. Only the owner and
+// members of group, if given, can connect. Callers are authenticated
+// by their UID and need an entry in the [local] section of rbac.conf.
+func listenSocket(path string, group string) (net.Listener, error) {
+	gid := -1
+	if len(group) > 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// remove the socket of a previous instance
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
@@ -20,39 +20,59 @@ import (
 	"crypto/x509"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/approval"
+	"github.com/thkukuk/kubic-control/pkg/audit"
 	"github.com/thkukuk/kubic-control/pkg/certificate_server"
 	"github.com/thkukuk/kubic-control/pkg/deployment"
 	"github.com/thkukuk/kubic-control/pkg/kubeadm"
+	"github.com/thkukuk/kubic-control/pkg/metrics"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"github.com/thkukuk/kubic-control/pkg/yomi"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 	"gopkg.in/ini.v1"
 )
 
 var (
-	Version      = "unreleased"
-	servername   = "localhost"
-	port         = "7148"
-	crtFile      = "/etc/kubicd/pki/KubicD.crt"
-	keyFile      = "/etc/kubicd/pki/KubicD.key"
-	caFile       = "/etc/kubicd/pki/Kubic-Control-CA.crt"
-	cfg, cfg_err = ini.LooseLoad("/usr/etc/kubicd/kubicd.conf", "/etc/kubicd/kubicd.conf")
+	Version          = "unreleased"
+	servername       = "localhost"
+	port             = "7148"
+	crtFile          = "/etc/kubicd/pki/KubicD.crt"
+	keyFile          = "/etc/kubicd/pki/KubicD.key"
+	caFile           = "/etc/kubicd/pki/Kubic-Control-CA.crt"
+	auditLog         = "/var/log/kubicd/audit.log"
+	metricsAddr      = ""
+	restAddr         = ""
+	socketPath       = "/run/kubicd/kubicd.sock"
+	socketGroup      = ""
+	enableReflection = false
+	gracePeriod      = 10 * time.Minute
+	cfg, cfg_err     = ini.LooseLoad("/usr/etc/kubicd/kubicd.conf", "/etc/kubicd/kubicd.conf")
 )
 
 type kubeadm_server struct{}
 type deploy_server struct{}
 type cert_server struct{}
 type yomi_server struct{}
+type runtime_server struct{}
+type audit_server struct{}
+type approval_server struct{}
 
 // kubeadm API
 func (s *kubeadm_server) InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
@@ -70,6 +90,16 @@ func (s *kubeadm_server) UpgradeKubernetes(in *pb.UpgradeRequest, stream pb.Kube
 	return kubeadm.UpgradeKubernetes(in, stream)
 }
 
+func (s *kubeadm_server) UpgradePlan(ctx context.Context, in *pb.UpgradeRequest) (*pb.UpgradePlanReply, error) {
+	log.Printf("Received: upgrade plan %v", in.KubernetesVersion)
+	return kubeadm.UpgradePlan(in), nil
+}
+
+func (s *kubeadm_server) UpgradeStatus(ctx context.Context, in *pb.Empty) (*pb.UpgradeStatusReply, error) {
+	log.Printf("Received: upgrade status")
+	return kubeadm.UpgradeStatus(), nil
+}
+
 func (s *kubeadm_server) RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) error {
 	log.Printf("Received: remove node  %v", in.NodeNames)
 	return kubeadm.RemoveNode(in, stream)
@@ -82,16 +112,71 @@ func (s *kubeadm_server) AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNod
 
 func (s *kubeadm_server) RebootNode(ctx context.Context, in *pb.RebootNodeRequest) (*pb.StatusReply, error) {
 	log.Printf("Received: reboot node  %v", in.NodeNames)
-	status, message := kubeadm.RebootNode(in.NodeNames)
+	status, message := kubeadm.RebootNode(ctx, in.NodeNames)
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
+
+func (s *kubeadm_server) UpdateNodeMetadata(ctx context.Context, in *pb.NodeMetadataRequest) (*pb.StatusReply, error) {
+	log.Printf("Received: update node metadata %v", in.NodeNames)
+	status, message := kubeadm.UpdateNodeMetadata(ctx, in)
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
+
+func (s *kubeadm_server) CordonNode(ctx context.Context, in *pb.CordonRequest) (*pb.StatusReply, error) {
+	log.Printf("Received: cordon node %v", in.NodeNames)
+	status, message := kubeadm.CordonNode(ctx, in.NodeNames, true)
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
+
+func (s *kubeadm_server) UncordonNode(ctx context.Context, in *pb.CordonRequest) (*pb.StatusReply, error) {
+	log.Printf("Received: uncordon node %v", in.NodeNames)
+	status, message := kubeadm.CordonNode(ctx, in.NodeNames, false)
 	return &pb.StatusReply{Success: status, Message: message}, nil
 }
 
+func (s *kubeadm_server) DrainNode(in *pb.DrainRequest, stream pb.Kubeadm_DrainNodeServer) error {
+	log.Printf("Received: drain node %v", in.NodeNames)
+	return kubeadm.DrainNode(in, stream)
+}
+
+func (s *kubeadm_server) RollingReboot(in *pb.RollingRebootRequest, stream pb.Kubeadm_RollingRebootServer) error {
+	log.Printf("Received: rolling reboot %v %v", in.NodeNames, in.Role)
+	return kubeadm.RollingReboot(in, stream)
+}
+
+func (s *kubeadm_server) ConfigureKubelet(in *pb.KubeletConfigRequest, stream pb.Kubeadm_ConfigureKubeletServer) error {
+	log.Printf("Received: configure kubelet %v %v %v", in.NodeNames, in.Role, in.LabelSelector)
+	return kubeadm.ConfigureKubelet(in, stream)
+}
+
+func (s *kubeadm_server) PrepullImages(in *pb.PrepullRequest, stream pb.Kubeadm_PrepullImagesServer) error {
+	log.Printf("Received: prepull images %v %v %v", in.NodeNames, in.Role, in.LabelSelector)
+	return kubeadm.PrepullImages(in, stream)
+}
+
+func (s *kubeadm_server) UpdateLoadBalancer(in *pb.LoadBalancerRequest, stream pb.Kubeadm_UpdateLoadBalancerServer) error {
+	log.Printf("Received: update load balancer add %v remove %v", in.Add, in.Remove)
+	return kubeadm.UpdateLoadBalancer(in, stream)
+}
+
 func (s *kubeadm_server) ListNodes(ctx context.Context, in *pb.Empty) (*pb.ListReply, error) {
 	log.Printf("Received: list nodes")
 	status, message, nodes := kubeadm.ListNodes()
 	return &pb.ListReply{Success: status, Message: message, Node: nodes}, nil
 }
 
+func (s *kubeadm_server) ListMasters(ctx context.Context, in *pb.Empty) (*pb.ListReply, error) {
+	log.Printf("Received: list masters")
+	status, message, masters := kubeadm.ListMasters()
+	return &pb.ListReply{Success: status, Message: message, Node: masters}, nil
+}
+
+func (s *kubeadm_server) ListMinions(ctx context.Context, in *pb.Empty) (*pb.ListReply, error) {
+	log.Printf("Received: list minions")
+	status, message, minions := kubeadm.ListMinions()
+	return &pb.ListReply{Success: status, Message: message, Node: minions}, nil
+}
+
 func (s *kubeadm_server) FetchKubeconfig(ctx context.Context, in *pb.Empty) (*pb.StatusReply, error) {
 	log.Printf("Received: fetch kubeconfig")
 	status, message := kubeadm.FetchKubeconfig()
@@ -117,6 +202,17 @@ func (s *deploy_server) DeployKustomize(ctx context.Context, in *pb.DeployKustom
 	return &pb.StatusReply{Success: status, Message: message}, nil
 }
 
+// Runtime API
+func (s *runtime_server) Configure(in *pb.RuntimeConfigRequest, stream pb.Runtime_ConfigureServer) error {
+	log.Printf("Received: configure runtime %v %v %v", in.NodeNames, in.Role, in.LabelSelector)
+	return kubeadm.ConfigureRuntime(in, stream)
+}
+
+func (s *runtime_server) SetRegistryCredentials(in *pb.RegistryCredentialsRequest, stream pb.Runtime_SetRegistryCredentialsServer) error {
+	log.Printf("Received: set registry credentials %v %v %v", in.NodeNames, in.Role, in.LabelSelector)
+	return kubeadm.SetRegistryCredentials(in, stream)
+}
+
 // Yomi API
 func (s *yomi_server) PrepareConfig(in *pb.PrepareConfigRequest, stream pb.Yomi_PrepareConfigServer) error {
 	log.Infof("Received: PrepareConfig of %s for Node %s", in.Saltnode, in.Type)
@@ -128,92 +224,263 @@ func (s *yomi_server) Install(in *pb.InstallRequest, stream pb.Yomi_InstallServe
 	return yomi.Install(in, stream)
 }
 
-func rbacCheck(user string, function string) bool {
+// Audit API
+func (s *audit_server) Query(in *pb.AuditQueryRequest, stream pb.Audit_QueryServer) error {
+	log.Infof("Received: audit query")
+	err := audit.Query(in, stream)
+	if err != nil {
+		return status.Error(codes.DataLoss, err.Error())
+	}
+	return nil
+}
 
-	rbac, rbac_err := ini.LooseLoad("/usr/etc/kubicd/rbac.conf", "/etc/kubicd/rbac.conf")
+func (s *audit_server) Operations(ctx context.Context, in *pb.Empty) (*pb.OperationListReply, error) {
+	log.Infof("Received: list running operations")
+	var list []*pb.RunningOperation
+	for _, op := range audit.Running() {
+		list = append(list, &pb.RunningOperation{Id: op.ID, User: op.User,
+			Method: op.Method, Targets: op.Targets,
+			Started: op.Started.Format(time.RFC3339),
+			Success: op.Success, Message: op.Message})
+	}
+	return &pb.OperationListReply{Success: true, Operation: list}, nil
+}
 
-	if rbac_err != nil {
-		log.Error("Error opening rbac config file: %v", rbac_err)
-		return false
+// Approval API
+func (s *approval_server) List(ctx context.Context, in *pb.Empty) (*pb.ApprovalListReply, error) {
+	log.Infof("Received: list pending approvals")
+	var list []*pb.PendingRequest
+	for _, r := range approval.List() {
+		list = append(list, &pb.PendingRequest{Id: r.ID, User: r.User, Method: r.Method,
+			Request: r.Request, Expires: r.Expires.Format(time.RFC3339)})
 	}
+	return &pb.ApprovalListReply{Success: true, Request: list}, nil
+}
+
+func (s *approval_server) Approve(ctx context.Context, in *pb.ApprovalRequest) (*pb.StatusReply, error) {
+	log.Infof("Received: approve request %s", in.Id)
+	status, message := approval.Approve(ctx, in.Id)
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
+
+func (s *approval_server) Reject(ctx context.Context, in *pb.ApprovalRequest) (*pb.StatusReply, error) {
+	log.Infof("Received: reject request %s", in.Id)
+	status, message := approval.Reject(ctx, in.Id)
+	return &pb.StatusReply{Success: status, Message: message}, nil
+}
 
-	api := strings.TrimPrefix(function, "/api.")
+func rbacCheck(user string, groups []string, function string) (bool, []rbac.Scope) {
 
-	if !rbac.Section("").HasKey(api) {
-		log.Errorf("RBAC: no entry for '%s'", api)
-		return false
+	allowed, reason, scopes := rbac.Check(user, groups, function)
+	if !allowed {
+		log.Warnf("User '%s' wants access to function '%s', refused: %s", user, function, reason)
+		return false, nil
 	}
-	value := rbac.Section("").Key(api).String()
-	userList := strings.Split(value, ",")
-	for i := range userList {
-		if user == strings.TrimSpace(userList[i]) {
-			return true
+	log.Debugf("User '%s' calls function '%s': %s", user, function, reason)
+
+	return true, scopes
+}
+
+// statusReply is implemented by all replies reporting success or failure.
+type statusReply interface {
+	GetSuccess() bool
+	GetMessage() string
+}
+
+// authServerStream replaces the context of the stream with one
+// containing the RBAC scopes and audit operation of the caller,
+// records the request and failures for the audit log and waits for
+// the approval of a second user if the call requires it.
+type authServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	op     *audit.Operation
+	user   string
+	method string
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	s.op.SetRequest(m)
+
+	if approval.Required(s.method, m) {
+		err = approval.Wait(s.ctx, s.user, s.method, m, func(message string) error {
+			s.op.Progress(true, message)
+			return s.ServerStream.SendMsg(&pb.StatusReply{Success: true, Message: message})
+		})
+		if err != nil {
+			s.op.Fail(err.Error())
 		}
 	}
+	return err
+}
 
-	log.Warnf("User '%s' wants access to function '%s', refused", user, function)
+func (s *authServerStream) SendMsg(m interface{}) error {
+	if reply, ok := m.(statusReply); ok {
+		if !reply.GetSuccess() {
+			s.op.Fail(reply.GetMessage())
+		}
+		s.op.Progress(reply.GetSuccess(), reply.GetMessage())
+	}
+	return s.ServerStream.SendMsg(m)
+}
 
-	return false
+// infrastructureMethod returns true for the health and reflection
+// services, they are neither checked against RBAC nor audited.
+func infrastructureMethod(method string) bool {
+	return strings.HasPrefix(method, "/grpc.health.v1.") ||
+		strings.HasPrefix(method, "/grpc.reflection.")
 }
 
-func AuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+// certGroups returns the organizations and organizational units of a
+// certificate, they are used as group names for RBAC.
+func certGroups(cert *x509.Certificate) []string {
+	var groups []string
+
+	groups = append(groups, cert.Subject.Organization...)
+	groups = append(groups, cert.Subject.OrganizationalUnit...)
 
+	return groups
+}
+
+// callerIdentity returns the RBAC user and groups and the address of
+// the caller. Callers on TCP are identified by their client
+// certificate, callers on the local Unix socket by their UID.
+func callerIdentity(ctx context.Context) (string, []string, string, error) {
 	p, ok := peer.FromContext(ctx)
 	if !ok {
-		return nil, status.Error(codes.Unauthenticated, "no peer found")
+		return "", nil, "", status.Error(codes.Unauthenticated, "no peer found")
 	}
-	tlsAuth, ok := p.AuthInfo.(credentials.TLSInfo)
-	if !ok {
-		return nil, status.Error(codes.Unauthenticated, "unexpected peer transport credentials")
+
+	switch authInfo := p.AuthInfo.(type) {
+	case credentials.TLSInfo:
+		if len(authInfo.State.VerifiedChains) == 0 || len(authInfo.State.VerifiedChains[0]) == 0 {
+			return "", nil, "", status.Error(codes.Unauthenticated, "could not verify peer certificate")
+		}
+		cert := authInfo.State.VerifiedChains[0][0]
+		return cert.Subject.CommonName, certGroups(cert), p.Addr.String(), nil
+	case peerCredInfo:
+		user, reason := rbac.LocalUser(authInfo.Uid)
+		if len(user) == 0 {
+			log.Warnf("Local caller %s refused: %s", authInfo, reason)
+			return "", nil, "", status.Error(codes.Unauthenticated, "no RBAC user for uid "+strconv.FormatUint(uint64(authInfo.Uid), 10))
+		}
+		log.Debugf("Local caller %s is '%s': %s", authInfo, user, reason)
+		return user, nil, authInfo.String(), nil
+	default:
+		return "", nil, "", status.Error(codes.Unauthenticated, "unexpected peer transport credentials")
+	}
+}
+
+func AuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	if infrastructureMethod(info.FullMethod) {
+		return handler(ctx, req)
 	}
-	if len(tlsAuth.State.VerifiedChains) == 0 || len(tlsAuth.State.VerifiedChains[0]) == 0 {
-		return nil, status.Error(codes.Unauthenticated, "could not verify peer certificate")
+
+	user, groups, caller, err := callerIdentity(ctx)
+	if err != nil {
+		return nil, err
 	}
-	// Check subject common name against configured username
-	ok = rbacCheck(tlsAuth.State.VerifiedChains[0][0].Subject.CommonName, info.FullMethod)
+
+	start := time.Now()
+	op := audit.NewOperation(user, groups, caller, info.FullMethod)
+	op.SetRequest(req)
+	grpc.SetHeader(ctx, metadata.Pairs("operation-id", op.ID()))
+
+	// Check subject common name and groups against configured rules
+	ok, scopes := rbacCheck(user, groups, info.FullMethod)
 	if !ok {
+		op.Deny()
+		metrics.ObserveRPC(info.FullMethod, user, op.Finish(nil), time.Since(start))
 		return nil, status.Error(codes.Unauthenticated, "permission denied")
 	}
 
-	start := time.Now()
+	if !startOperation(info.FullMethod) {
+		op.Fail("kubicd is shutting down")
+		metrics.ObserveRPC(info.FullMethod, user, op.Finish(nil), time.Since(start))
+		return nil, status.Error(codes.Unavailable, "kubicd is shutting down")
+	}
+	defer finishOperation(info.FullMethod)
+	if !readOnlyMethods[info.FullMethod] {
+		op.Track()
+	}
+
+	ctx = audit.NewContext(rbac.NewContext(ctx, user, groups, scopes), op)
+	if approval.Required(info.FullMethod, req) {
+		// waiting for the approval would run into the deadline of the
+		// caller, who has to repeat the call with the approved ID
+		var id string
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("approval-id")) > 0 {
+			id = md.Get("approval-id")[0]
+		}
+		if err = approval.Check(user, info.FullMethod, req, id); err != nil {
+			op.Fail(err.Error())
+			metrics.ObserveRPC(info.FullMethod, user, op.Finish(err), time.Since(start))
+			return nil, err
+		}
+	}
+
 	// Calls the handler
 	h, err := handler(ctx, req)
+	if reply, ok := h.(statusReply); ok && !reply.GetSuccess() {
+		op.Fail(reply.GetMessage())
+	}
+	metrics.ObserveRPC(info.FullMethod, user, op.Finish(err), time.Since(start))
 
 	log.Infof("Function: %s, Caller: %s, Duration: %s, Error: %v",
-		info.FullMethod,
-		tlsAuth.State.VerifiedChains[0][0].Subject.CommonName,
-		time.Since(start), err)
+		info.FullMethod, user, time.Since(start), err)
 
 	return h, err
 }
 
 func AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 
-	p, ok := peer.FromContext(ss.Context())
-	if !ok {
-		return status.Error(codes.Unauthenticated, "no peer found")
-	}
-	tlsAuth, ok := p.AuthInfo.(credentials.TLSInfo)
-	if !ok {
-		return status.Error(codes.Unauthenticated, "unexpected peer transport credentials")
+	if infrastructureMethod(info.FullMethod) {
+		return handler(srv, ss)
 	}
-	if len(tlsAuth.State.VerifiedChains) == 0 || len(tlsAuth.State.VerifiedChains[0]) == 0 {
-		return status.Error(codes.Unauthenticated, "could not verify peer certificate")
+
+	user, groups, caller, err := callerIdentity(ss.Context())
+	if err != nil {
+		return err
 	}
-	// Check subject common name against configured username
-	ok = rbacCheck(tlsAuth.State.VerifiedChains[0][0].Subject.CommonName, info.FullMethod)
+
+	start := time.Now()
+	op := audit.NewOperation(user, groups, caller, info.FullMethod)
+	ss.SetHeader(metadata.Pairs("operation-id", op.ID()))
+
+	// Check subject common name and groups against configured rules
+	ok, scopes := rbacCheck(user, groups, info.FullMethod)
 	if !ok {
+		op.Deny()
+		metrics.ObserveRPC(info.FullMethod, user, op.Finish(nil), time.Since(start))
 		return status.Error(codes.Unauthenticated, "permission denied")
 	}
 
-	start := time.Now()
+	if !startOperation(info.FullMethod) {
+		op.Fail("kubicd is shutting down")
+		metrics.ObserveRPC(info.FullMethod, user, op.Finish(nil), time.Since(start))
+		return status.Error(codes.Unavailable, "kubicd is shutting down")
+	}
+	defer finishOperation(info.FullMethod)
+	if !readOnlyMethods[info.FullMethod] {
+		op.Track()
+	}
+
 	// Calls the handler
-	err := handler(srv, ss)
+	ctx := audit.NewContext(rbac.NewContext(ss.Context(), user, groups, scopes), op)
+	err = handler(srv, &authServerStream{ss, ctx, op, user, info.FullMethod})
+	metrics.ObserveRPC(info.FullMethod, user, op.Finish(err), time.Since(start))
 
 	log.Infof("Function: %s, Caller: %s, Duration: %s, Error: %v",
-		info.FullMethod,
-		tlsAuth.State.VerifiedChains[0][0].Subject.CommonName,
-		time.Since(start), err)
+		info.FullMethod, user, time.Since(start), err)
 
 	return err
 }
@@ -238,6 +505,30 @@ func loadConfigFile() {
 	if cfg.Section("global").HasKey("port") {
 		port = cfg.Section("global").Key("port").String()
 	}
+	if cfg.Section("global").HasKey("auditlog") {
+		auditLog = cfg.Section("global").Key("auditlog").String()
+	}
+	if cfg.Section("global").HasKey("metrics") {
+		metricsAddr = cfg.Section("global").Key("metrics").String()
+	}
+	if cfg.Section("global").HasKey("socket") {
+		socketPath = cfg.Section("global").Key("socket").String()
+	}
+	if cfg.Section("global").HasKey("socket_group") {
+		socketGroup = cfg.Section("global").Key("socket_group").String()
+	}
+	if cfg.Section("global").HasKey("rest") {
+		restAddr = cfg.Section("global").Key("rest").String()
+	}
+	if cfg.Section("global").HasKey("reflection") {
+		enableReflection = cfg.Section("global").Key("reflection").MustBool(enableReflection)
+	}
+	if cfg.Section("global").HasKey("grace_period") {
+		gracePeriod = cfg.Section("global").Key("grace_period").MustDuration(gracePeriod)
+	}
+	if err := approval.LoadConfig(cfg); err != nil {
+		log.Fatalf("Invalid [approval] section in kubicd.conf: %v", err)
+	}
 }
 
 func main() {
@@ -256,6 +547,13 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&crtFile, "crtfile", crtFile, "Certificate with the public key for the daemon")
 	rootCmd.PersistentFlags().StringVar(&keyFile, "keyfile", keyFile, "Private key for the daemon")
 	rootCmd.PersistentFlags().StringVar(&caFile, "cafile", caFile, "Certificate with the public key of the CA for the server certificate")
+	rootCmd.PersistentFlags().StringVar(&auditLog, "auditlog", auditLog, "File to write the audit log of all API calls to")
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics", metricsAddr, "Address to serve Prometheus metrics on, e.g. :9148 for localhost, with TLS on other addresses (disabled if empty)")
+	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", socketPath, "Local Unix socket kubicd is listening on (disabled if empty)")
+	rootCmd.PersistentFlags().StringVar(&socketGroup, "socket-group", socketGroup, "Group whose members may connect to the local socket")
+	rootCmd.PersistentFlags().StringVar(&restAddr, "rest", restAddr, "Address to serve the REST gateway on, e.g. :7149 (disabled if empty)")
+	rootCmd.PersistentFlags().BoolVar(&enableReflection, "reflection", enableReflection, "Enable gRPC server reflection")
+	rootCmd.PersistentFlags().DurationVar(&gracePeriod, "grace-period", gracePeriod, "Time running operations get to finish on shutdown")
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -271,6 +569,10 @@ func kubicd(cmd *cobra.Command, args []string) {
 		log.Fatalf("Could not create '/var/lib/kubic-control' directory: %s", err)
 	}
 
+	if err := audit.Init(auditLog); err != nil {
+		log.Fatalf("Could not open audit log '%s': %s", auditLog, err)
+	}
+
 	// Load the certificates from disk
 	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
 	if err != nil {
@@ -295,11 +597,24 @@ func kubicd(cmd *cobra.Command, args []string) {
 	}
 
 	// Create the TLS credentials
-	creds := credentials.NewTLS(&tls.Config{
+	tlsConfig := &tls.Config{
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		Certificates: []tls.Certificate{certificate},
 		ClientCAs:    certPool,
-	})
+	}
+	creds := &localCredentials{credentials.NewTLS(tlsConfig)}
+
+	// HTTP servers stopped together with the gRPC server
+	var httpServers []*http.Server
+
+	if len(metricsAddr) > 0 {
+		registerMetrics()
+		server, err := metrics.Serve(metricsAddr, tlsConfig)
+		if err != nil {
+			log.Fatalf("Could not serve metrics on '%s': %s", metricsAddr, err)
+		}
+		httpServers = append(httpServers, server)
+	}
 
 	s := grpc.NewServer(grpc.Creds(creds),
 		grpc.StreamInterceptor(AuthStreamInterceptor),
@@ -309,8 +624,46 @@ func kubicd(cmd *cobra.Command, args []string) {
 	pb.RegisterDeployServer(s, &deploy_server{})
 	pb.RegisterCertificateServer(s, &cert_server{})
 	pb.RegisterYomiServer(s, &yomi_server{})
+	pb.RegisterRuntimeServer(s, &runtime_server{})
+	pb.RegisterAuditServer(s, &audit_server{})
+	pb.RegisterApprovalServer(s, &approval_server{})
+
+	healthServer := health.NewServer()
+	for service := range s.GetServiceInfo() {
+		healthServer.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(s, healthServer)
+	if enableReflection {
+		reflection.Register(s)
+	}
+
+	if len(restAddr) > 0 {
+		server, err := serveGateway(restAddr, tlsConfig.Clone())
+		if err != nil {
+			log.Fatalf("Could not serve REST gateway on '%s': %s", restAddr, err)
+		}
+		httpServers = append(httpServers, server)
+	}
+
+	if len(socketPath) > 0 {
+		sockLis, err := listenSocket(socketPath, socketGroup)
+		if err != nil {
+			log.Fatalf("Failed to listen on '%s': %v", socketPath, err)
+		}
+		defer os.Remove(socketPath)
+		go func() {
+			if err := s.Serve(sockLis); err != nil {
+				log.Errorf("Failed to serve on '%s': %v", socketPath, err)
+			}
+		}()
+	}
+
+	stopped := handleShutdown(s, httpServers, healthServer, gracePeriod)
+	sdNotify("READY=1")
 
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	<-stopped
+	log.Info("Kubic Daemon stopped")
 }
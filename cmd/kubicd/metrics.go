@@ -0,0 +1,80 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thkukuk/kubic-control/pkg/deployment"
+	"github.com/thkukuk/kubic-control/pkg/kubeadm"
+	"github.com/thkukuk/kubic-control/pkg/metrics"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// registerMetrics registers the gauges describing the state of the
+// cluster. They are computed when scraped, checking the drift and
+// asking salt is expensive, so the results are cached.
+func registerMetrics() {
+	metrics.NewGaugeFunc("kubicd_join_token_age_seconds",
+		"Age of the cached token to join new nodes in seconds.", 0,
+		func() []metrics.Sample {
+			age, ok := kubeadm.JoinTokenAge()
+			if !ok {
+				return nil
+			}
+			return []metrics.Sample{{Value: age.Seconds()}}
+		})
+
+	metrics.NewGaugeFunc("kubicd_deployment_drifted",
+		"1 if the deployed service differs from its source, -1 if the state is unknown.",
+		5*time.Minute,
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, state := range deployment.Drift() {
+				value := 0.0
+				if state.Err != nil {
+					log.Warnf("Cannot check drift of %s: %v", state.Name, state.Err)
+					value = -1
+				} else if state.Drifted {
+					value = 1
+				}
+				samples = append(samples, metrics.Sample{
+					Labels: []string{state.Config, state.Name}, Value: value})
+			}
+			return samples
+		}, "config", "name")
+
+	metrics.NewGaugeFunc("kubicd_nodes",
+		"Number of nodes in the cluster by role.", time.Minute,
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, role := range []string{"master", "worker", "haproxy"} {
+				success, _, nodelist := tools.GetListOfNodes(role)
+				if !success {
+					continue
+				}
+				count := 0
+				for _, node := range nodelist {
+					if len(node) > 0 {
+						count++
+					}
+				}
+				samples = append(samples, metrics.Sample{
+					Labels: []string{role}, Value: float64(count)})
+			}
+			return samples
+		}, "role")
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/thkukuk/kubic-control/api"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type object map[string]interface{}
+
+// openAPIDocument generates the OpenAPI document of the REST gateway
+// from the descriptor of api.proto compiled into kubicd.
+func openAPIDocument() ([]byte, error) {
+	fd := proto.MessageV2(&pb.StatusReply{}).ProtoReflect().Descriptor().ParentFile()
+
+	paths := object{}
+	for _, name := range gatewayServices {
+		sd := fd.Services().ByName(protoreflect.Name(name))
+		if sd == nil {
+			continue
+		}
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+			path := "/" + string(sd.FullName()) + "/" + string(md.Name())
+			if _, ok := gatewayMethods[path]; !ok {
+				continue
+			}
+
+			reply := schemaRef(md.Output())
+			content := object{"application/json": object{"schema": reply}}
+			if md.IsStreamingServer() {
+				content = object{
+					"application/x-ndjson": object{"schema": reply},
+					"text/event-stream":    object{"schema": reply},
+				}
+			}
+
+			paths[path] = object{
+				"post": object{
+					"operationId": name + "_" + string(md.Name()),
+					"tags":        []string{name},
+					"requestBody": object{
+						"content": object{
+							"application/json": object{"schema": schemaRef(md.Input())},
+						},
+					},
+					"responses": object{
+						"200": object{"description": "Reply", "content": content},
+						"default": object{
+							"description": "Error",
+							"content": object{
+								"application/json": object{"schema": object{"$ref": "#/components/schemas/Error"}},
+							},
+						},
+					},
+				},
+			}
+		}
+	}
+
+	schemas := object{
+		"Error": object{
+			"type": "object",
+			"properties": object{
+				"code":    object{"type": "string"},
+				"message": object{"type": "string"},
+			},
+		},
+	}
+	for i := 0; i < fd.Messages().Len(); i++ {
+		md := fd.Messages().Get(i)
+		schemas[string(md.Name())] = messageSchema(md)
+	}
+
+	doc := object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "Kubic Control API",
+			"version": Version,
+			"description": "REST gateway of kubicd. All requests need a client " +
+				"certificate signed by the Kubic Control CA. Streamed replies are " +
+				"sent as JSON lines or, with \"Accept: text/event-stream\", as " +
+				"server-sent events; an error after the reply started is sent as " +
+				"last message.",
+		},
+		"paths":      paths,
+		"components": object{"schemas": schemas},
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func schemaRef(md protoreflect.MessageDescriptor) object {
+	return object{"$ref": "#/components/schemas/" + string(md.Name())}
+}
+
+func messageSchema(md protoreflect.MessageDescriptor) object {
+	properties := object{}
+	for i := 0; i < md.Fields().Len(); i++ {
+		field := md.Fields().Get(i)
+		schema := fieldSchema(field)
+		if field.IsList() {
+			schema = object{"type": "array", "items": schema}
+		}
+		properties[string(field.Name())] = schema
+	}
+	return object{"type": "object", "properties": properties}
+}
+
+func fieldSchema(field protoreflect.FieldDescriptor) object {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return object{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return object{"type": "integer", "format": "int32"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// 64bit integers are encoded as strings in JSON
+		return object{"type": "string", "format": "int64"}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return object{"type": "number"}
+	case protoreflect.BytesKind:
+		return object{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		return object{"type": "string"}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return schemaRef(field.Message())
+	default:
+		return object{"type": "string"}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+// Functions which don't modify the cluster, they are still accepted
+// while kubicd is shutting down.
+var readOnlyMethods = map[string]bool{
+	"/api.Kubeadm/ListNodes":       true,
+	"/api.Kubeadm/ListMasters":     true,
+	"/api.Kubeadm/ListMinions":     true,
+	"/api.Kubeadm/UpgradePlan":     true,
+	"/api.Kubeadm/UpgradeStatus":   true,
+	"/api.Kubeadm/FetchKubeconfig": true,
+	"/api.Kubeadm/GetStatus":       true,
+	"/api.Audit/Query":             true,
+	"/api.Audit/Operations":        true,
+	"/api.Approval/List":           true,
+}
+
+var (
+	shutdownMutex sync.Mutex
+	shuttingDown  = false
+	// running mutating calls
+	operations sync.WaitGroup
+)
+
+// startOperation registers a new call. Mutating calls are refused
+// once the shutdown has started. If true is returned, finishOperation
+// has to be called at the end of the call.
+func startOperation(method string) bool {
+	if readOnlyMethods[method] {
+		return true
+	}
+
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if shuttingDown {
+		return false
+	}
+	operations.Add(1)
+	return true
+}
+
+func finishOperation(method string) {
+	if !readOnlyMethods[method] {
+		operations.Done()
+	}
+}
+
+// handleShutdown waits for SIGTERM or SIGINT. Afterwards no new
+// mutating calls are accepted and running ones get gracePeriod time
+// to finish before the gRPC server and the HTTP servers (REST gateway
+// and metrics) are stopped. The returned channel is closed when all
+// servers are stopped.
+func handleShutdown(s *grpc.Server, httpServers []*http.Server, healthServer *health.Server, gracePeriod time.Duration) chan struct{} {
+	finished := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		defer close(finished)
+
+		sig := <-sigs
+		log.Infof("Received %v, shutting down", sig)
+		sdNotify("STOPPING=1\nSTATUS=Waiting for running operations")
+
+		shutdownMutex.Lock()
+		shuttingDown = true
+		shutdownMutex.Unlock()
+		healthServer.Shutdown()
+
+		done := make(chan struct{})
+		go func() {
+			operations.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			log.Info("All operations finished")
+		case <-time.After(gracePeriod):
+			log.Warnf("Operations still running after %s, aborting them", gracePeriod)
+		case sig = <-sigs:
+			log.Warnf("Received %v again, aborting running operations", sig)
+		}
+
+		// Give read-only calls a moment before closing all connections
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, server := range httpServers {
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				if err := server.Shutdown(ctx); err != nil {
+					server.Close()
+				}
+			}(server)
+		}
+		stopped := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.Stop()
+		}
+		wg.Wait()
+	}()
+
+	return finished
+}
+
+// sdNotify sends state to systemd if kubicd was started as
+// Type=notify service.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("Cannot notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("Cannot notify systemd: %v", err)
+	}
+}
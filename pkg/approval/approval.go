@@ -0,0 +1,412 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package approval
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/ini.v1"
+)
+
+// Request is a call waiting for the approval of a second user.
+type Request struct {
+	ID      string
+	User    string
+	Method  string
+	Request string
+	Expires time.Time
+
+	// receives the decision, nil if approved
+	decision chan error
+	// unary calls don't wait, the caller repeats the call with the ID
+	// of the request and the same parameters
+	retry  bool
+	digest string
+
+	// nodes the call works on and their role, only known if
+	// resolved is true
+	targets  []string
+	role     string
+	resolved bool
+}
+
+var (
+	// Expire is the time a request waits for approval
+	Expire = 5 * time.Minute
+
+	// functions which need an approval, the value is the condition:
+	// "always" or "wildcard" if only calls with more than one node
+	// need an approval
+	policy = map[string]string{}
+
+	mutex   sync.Mutex
+	pending = map[string]*Request{}
+	// decided requests of unary calls, until the call is repeated
+	decided = map[string]*Request{}
+
+	// checks the RBAC rules, replaced by tests
+	rbacCheck = rbac.Check
+)
+
+// LoadConfig reads the [approval] section of kubicd.conf:
+//
+//	[approval]
+//	expire = 5m
+//	functions = Kubeadm/DestroyMaster, Kubeadm/RemoveNode:wildcard
+func LoadConfig(cfg *ini.File) error {
+	section := cfg.Section("approval")
+
+	if section.HasKey("expire") {
+		d, err := time.ParseDuration(section.Key("expire").String())
+		if err != nil {
+			return err
+		}
+		Expire = d
+	}
+
+	for _, entry := range section.Key("functions").Strings(",") {
+		condition := "always"
+		if i := strings.Index(entry, ":"); i >= 0 {
+			condition = entry[i+1:]
+			entry = entry[:i]
+		}
+		if condition != "always" && condition != "wildcard" {
+			return fmt.Errorf("unknown approval condition '%s' for '%s'", condition, entry)
+		}
+		policy[strings.TrimPrefix(entry, "/api.")] = condition
+	}
+	return nil
+}
+
+// nodeNamesRequest is implemented by all requests with a list of nodes.
+type nodeNamesRequest interface {
+	GetNodeNames() string
+}
+
+// Required returns true if the call of method with req needs the
+// approval of a second user.
+func Required(method string, req interface{}) bool {
+	condition, ok := policy[strings.TrimPrefix(method, "/api.")]
+	if !ok {
+		return false
+	}
+	if condition == "wildcard" {
+		in, ok := req.(nodeNamesRequest)
+		if !ok {
+			return true
+		}
+		return strings.ContainsAny(in.GetNodeNames(), "*?[,")
+	}
+	return true
+}
+
+// selectorRequest is implemented by requests selecting nodes by role.
+type selectorRequest interface {
+	GetRole() string
+}
+
+// labelSelectorRequest is implemented by requests selecting nodes by
+// labels.
+type labelSelectorRequest interface {
+	GetLabelSelector() string
+}
+
+// nodeTypeRequest is implemented by requests adding new nodes.
+type nodeTypeRequest interface {
+	GetType() string
+}
+
+// requestTargets returns the nodes req works on and the role they
+// will have. If they can only be determined by asking salt or
+// kubernetes (globs, roles, label selectors or no node names at all),
+// false is returned.
+func requestTargets(req interface{}) ([]string, string, bool) {
+	in, ok := req.(nodeNamesRequest)
+	if !ok || len(in.GetNodeNames()) == 0 || strings.ContainsAny(in.GetNodeNames(), "*?[") {
+		return nil, "", false
+	}
+	if in, ok := req.(selectorRequest); ok && len(in.GetRole()) > 0 {
+		return nil, "", false
+	}
+	if in, ok := req.(labelSelectorRequest); ok && len(in.GetLabelSelector()) > 0 {
+		return nil, "", false
+	}
+
+	var targets []string
+	for _, node := range strings.Split(in.GetNodeNames(), ",") {
+		if node = strings.TrimSpace(node); len(node) > 0 {
+			targets = append(targets, node)
+		}
+	}
+	role := ""
+	if in, ok := req.(nodeTypeRequest); ok {
+		role = in.GetType()
+		if len(role) == 0 {
+			role = "worker"
+		}
+	}
+	return targets, role, len(targets) > 0
+}
+
+// newRequest returns a request with a new ID for the call.
+func newRequest(user string, method string, req interface{}) *Request {
+	id := make([]byte, 4)
+	rand.Read(id)
+	data, _ := audit.MarshalRequest(req)
+	targets, role, resolved := requestTargets(req)
+
+	return &Request{
+		ID:       hex.EncodeToString(id),
+		User:     user,
+		Method:   strings.TrimPrefix(method, "/api."),
+		Request:  string(data),
+		Expires:  time.Now().Add(Expire),
+		decision: make(chan error, 1),
+		targets:  targets,
+		role:     role,
+		resolved: resolved,
+	}
+}
+
+// requestDigest returns a hash of the complete request including
+// secrets, to verify that a repeated call has the same parameters.
+func requestDigest(req interface{}) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// expire removes the expired requests, mutex has to be held.
+func expire() {
+	now := time.Now()
+	for id, r := range pending {
+		if r.retry && now.After(r.Expires) {
+			log.Infof("Approval: request %s expired", id)
+			delete(pending, id)
+		}
+	}
+	for id, r := range decided {
+		if now.After(r.Expires) {
+			delete(decided, id)
+		}
+	}
+}
+
+// Check is the approval of unary calls, which cannot wait for the
+// decision of a second user without running into the deadline of the
+// caller. Without id the call is registered as pending request and
+// rejected with FailedPrecondition and the ID of the request. The
+// caller repeats the call with this id and the same parameters after
+// the request was approved.
+func Check(user string, method string, req interface{}, id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	expire()
+
+	if len(id) == 0 {
+		r := newRequest(user, method, req)
+		r.retry = true
+		r.digest = requestDigest(req)
+		pending[r.ID] = r
+		log.Infof("Approval: %s requested by %s needs approval, id %s", r.Method, user, r.ID)
+		return status.Errorf(codes.FailedPrecondition,
+			"This call needs the approval of a second user: kubicctl approve %s, afterwards repeat the call with --approval-id %s (expires at %s)",
+			r.ID, r.ID, r.Expires.Format(time.RFC3339))
+	}
+
+	r, ok := decided[id]
+	if !ok {
+		r, ok = pending[id]
+	}
+	if !ok || !r.retry {
+		return status.Errorf(codes.NotFound, "no request with id '%s', it may have expired", id)
+	}
+	if r.User != user || r.Method != strings.TrimPrefix(method, "/api.") || r.digest != requestDigest(req) {
+		return status.Errorf(codes.PermissionDenied, "request %s was for another call", id)
+	}
+	if _, ok := pending[id]; ok {
+		return status.Errorf(codes.FailedPrecondition, "request %s was not approved yet (expires at %s)",
+			id, r.Expires.Format(time.RFC3339))
+	}
+
+	// an approved request is only good for one call
+	delete(decided, id)
+	return <-r.decision
+}
+
+// Wait registers the call as pending request, informs the caller
+// with notify and blocks until a second user approves or rejects the
+// request, the request expires or the caller goes away.
+func Wait(ctx context.Context, user string, method string, req interface{}, notify func(string) error) error {
+	r := newRequest(user, method, req)
+
+	mutex.Lock()
+	pending[r.ID] = r
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(pending, r.ID)
+		mutex.Unlock()
+	}()
+
+	log.Infof("Approval: %s requested by %s needs approval, id %s", r.Method, user, r.ID)
+	if err := notify("This call needs the approval of a second user: kubicctl approve " + r.ID +
+		" (expires at " + r.Expires.Format(time.RFC3339) + ")"); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(Expire)
+	defer timer.Stop()
+
+	select {
+	case err := <-r.decision:
+		if err == nil {
+			return notify("Request " + r.ID + " approved")
+		}
+		return err
+	case <-timer.C:
+		log.Infof("Approval: request %s expired", r.ID)
+		return status.Errorf(codes.DeadlineExceeded, "request %s was not approved in time", r.ID)
+	case <-ctx.Done():
+		log.Infof("Approval: request %s canceled by caller", r.ID)
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// List returns all pending requests.
+func List() []*Request {
+	mutex.Lock()
+	defer mutex.Unlock()
+	expire()
+
+	var list []*Request
+	for _, r := range pending {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Expires.Before(list[j].Expires)
+	})
+	return list
+}
+
+// lookup returns the pending request with id.
+func lookup(id string) (*Request, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	expire()
+
+	r, ok := pending[id]
+	return r, ok
+}
+
+// authorized checks that the caller of ctx is allowed to call the
+// function of r on all its target nodes himself. If the targets of
+// the request are not known, access without scope is required.
+func authorized(ctx context.Context, r *Request) (bool, string) {
+	user, groups, _ := rbac.CallerFromContext(ctx)
+
+	allowed, _, scopes := rbacCheck(user, groups, r.Method)
+	if !allowed {
+		return false, "You are not allowed to call '" + r.Method + "' yourself"
+	}
+	if len(scopes) == 0 {
+		return true, ""
+	}
+	if !r.resolved {
+		return false, "Request " + r.ID + " does not name its nodes, you need access to '" + r.Method + "' on all nodes"
+	}
+	return rbac.CheckTargets(rbac.NewContext(ctx, user, groups, scopes), r.targets, r.role)
+}
+
+// Approve lets the request with id continue. The approver has to be
+// a different user, who is allowed to call the function on the same
+// nodes himself.
+func Approve(ctx context.Context, id string) (bool, string) {
+	user, _, _ := rbac.CallerFromContext(ctx)
+
+	r, ok := lookup(id)
+	if !ok {
+		return false, "No pending request with id '" + id + "'"
+	}
+	if r.User == user {
+		return false, "Request " + id + " has to be approved by a second user"
+	}
+	// checking the scopes may ask salt, don't block other requests
+	if allowed, message := authorized(ctx, r); !allowed {
+		return false, message
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if pending[id] != r {
+		return false, "No pending request with id '" + id + "'"
+	}
+
+	log.Infof("Approval: request %s approved by %s", id, user)
+	r.decision <- nil
+	decide(r)
+	return true, ""
+}
+
+// Reject aborts the request with id. Only the user who made the
+// request or a user who could approve it may reject it.
+func Reject(ctx context.Context, id string) (bool, string) {
+	user, _, _ := rbac.CallerFromContext(ctx)
+
+	r, ok := lookup(id)
+	if !ok {
+		return false, "No pending request with id '" + id + "'"
+	}
+	if r.User != user {
+		if allowed, message := authorized(ctx, r); !allowed {
+			return false, message
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if pending[id] != r {
+		return false, "No pending request with id '" + id + "'"
+	}
+
+	log.Infof("Approval: request %s rejected by %s", id, user)
+	r.decision <- status.Errorf(codes.PermissionDenied, "request %s was rejected by %s", id, user)
+	decide(r)
+	return true, ""
+}
+
+// decide removes the request from the pending ones, the decision of
+// unary calls is kept until the call is repeated. mutex has to be held.
+func decide(r *Request) {
+	delete(pending, r.ID)
+	if r.retry {
+		r.Expires = time.Now().Add(Expire)
+		decided[r.ID] = r
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package approval
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grant replaces the RBAC rules for the test: users in grants may
+// call every function, restricted to the scopes if there are any.
+func grant(t *testing.T, grants map[string][]rbac.Scope) {
+	saved := rbacCheck
+	rbacCheck = func(user string, groups []string, function string) (bool, string, []rbac.Scope) {
+		scopes, ok := grants[user]
+		return ok, "", scopes
+	}
+	t.Cleanup(func() { rbacCheck = saved })
+}
+
+// request registers a unary call of alice and returns its ID.
+func request(t *testing.T, method string, req interface{}) string {
+	if err := Check("alice", method, req, ""); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("call returned %v, expected FailedPrecondition", err)
+	}
+	list := List()
+	if len(list) != 1 {
+		t.Fatalf("got %d pending requests, expected 1", len(list))
+	}
+	return list[0].ID
+}
+
+func TestPendingRequestRedactsPasswords(t *testing.T) {
+	req := &pb.RegistryCredentialsRequest{
+		Credentials: []*pb.RegistryCredential{
+			{Registry: "registry.example.com", Username: "alice", Password: "s3cret"},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var listed []*Request
+	Wait(ctx, "alice", "/api.Runtime/SetRegistryCredentials", req, func(string) error {
+		// the request is pending while the caller is informed
+		listed = List()
+		cancel()
+		return nil
+	})
+
+	if len(listed) != 1 {
+		t.Fatalf("got %d pending requests, expected 1", len(listed))
+	}
+	if strings.Contains(listed[0].Request, "s3cret") {
+		t.Errorf("password in pending request: %s", listed[0].Request)
+	}
+	if !strings.Contains(listed[0].Request, "REDACTED") {
+		t.Errorf("password not redacted in pending request: %s", listed[0].Request)
+	}
+	if len(List()) != 0 {
+		t.Errorf("canceled request still pending")
+	}
+}
+
+func TestCheckUnaryCall(t *testing.T) {
+	req := &pb.RebootNodeRequest{NodeNames: "worker1"}
+	method := "/api.Kubeadm/RebootNode"
+
+	err := Check("alice", method, req, "")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("first call returned %v, expected FailedPrecondition", err)
+	}
+	list := List()
+	if len(list) != 1 || !strings.Contains(err.Error(), list[0].ID) {
+		t.Fatalf("request ID not in %v", err)
+	}
+	id := list[0].ID
+
+	if err := Check("alice", method, req, id); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("call before approval returned %v, expected FailedPrecondition", err)
+	}
+	if err := Check("alice", method, &pb.RebootNodeRequest{NodeNames: "worker2"}, id); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("call with other parameters returned %v, expected PermissionDenied", err)
+	}
+	if err := Check("bob", method, req, id); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("call of other user returned %v, expected PermissionDenied", err)
+	}
+
+	// approved by a second user
+	mutex.Lock()
+	r := pending[id]
+	r.decision <- nil
+	decide(r)
+	mutex.Unlock()
+
+	if len(List()) != 0 {
+		t.Errorf("approved request still pending")
+	}
+	if err := Check("alice", method, req, id); err != nil {
+		t.Errorf("call after approval returned %v", err)
+	}
+	if err := Check("alice", method, req, id); status.Code(err) != codes.NotFound {
+		t.Errorf("second call with the approved ID returned %v, expected NotFound", err)
+	}
+}
+
+func TestCheckRejectedUnaryCall(t *testing.T) {
+	req := &pb.RebootNodeRequest{NodeNames: "worker1"}
+	method := "/api.Kubeadm/RebootNode"
+
+	grant(t, map[string][]rbac.Scope{"bob": nil})
+
+	Check("alice", method, req, "")
+	id := List()[0].ID
+	if ok, message := Reject(rbac.NewContext(context.Background(), "bob", nil, nil), id); !ok {
+		t.Fatalf("Reject failed: %s", message)
+	}
+	if err := Check("alice", method, req, id); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("call after rejection returned %v, expected PermissionDenied", err)
+	}
+}
+
+func TestApproveScoped(t *testing.T) {
+	grant(t, map[string][]rbac.Scope{
+		"admin": nil,
+		"web":   {{Node: "web-*"}},
+	})
+	ctx := func(user string) context.Context {
+		return rbac.NewContext(context.Background(), user, nil, nil)
+	}
+
+	tests := []struct {
+		req      interface{}
+		approver string
+		allowed  bool
+	}{
+		// targets inside of the scope
+		{&pb.RemoveNodeRequest{NodeNames: "web-1,web-2"}, "web", true},
+		// one target outside of the scope
+		{&pb.RemoveNodeRequest{NodeNames: "web-1,db-1"}, "web", false},
+		// targets are not known without salt
+		{&pb.RemoveNodeRequest{NodeNames: "*"}, "web", false},
+		{&pb.RemoveNodeRequest{NodeNames: "web-*"}, "web", false},
+		{&pb.Empty{}, "web", false},
+		{&pb.RemoveNodeRequest{NodeNames: "*"}, "admin", true},
+		{&pb.Empty{}, "admin", true},
+		// no access at all
+		{&pb.RemoveNodeRequest{NodeNames: "web-1"}, "mallory", false},
+	}
+	for _, test := range tests {
+		id := request(t, "/api.Kubeadm/RemoveNode", test.req)
+		ok, message := Approve(ctx(test.approver), id)
+		if ok != test.allowed {
+			t.Errorf("%s approving %v: got %v (%s), expected %v", test.approver, test.req, ok, message, test.allowed)
+		}
+		// a request which was not approved is still pending
+		Reject(ctx("alice"), id)
+	}
+}
+
+func TestReject(t *testing.T) {
+	grant(t, map[string][]rbac.Scope{
+		"admin": nil,
+		"web":   {{Node: "web-*"}},
+	})
+	ctx := func(user string) context.Context {
+		return rbac.NewContext(context.Background(), user, nil, nil)
+	}
+	req := &pb.RemoveNodeRequest{NodeNames: "*"}
+	method := "/api.Kubeadm/RemoveNode"
+
+	id := request(t, method, req)
+	if ok, _ := Reject(ctx("mallory"), id); ok {
+		t.Errorf("user without access rejected the request")
+	}
+	if ok, _ := Reject(ctx("web"), id); ok {
+		t.Errorf("user with scoped access rejected a wildcard request")
+	}
+	if ok, message := Reject(ctx("admin"), id); !ok {
+		t.Errorf("approver could not reject the request: %s", message)
+	}
+
+	id = request(t, method, req)
+	if ok, message := Reject(ctx("alice"), id); !ok {
+		t.Errorf("requester could not reject the request: %s", message)
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Record is one line of the audit log. Every record contains the hash
+// of the previous one, so removing or modifying a record breaks the
+// chain.
+type Record struct {
+	Time     string          `json:"time"`
+	ID       string          `json:"id"`
+	Type     string          `json:"type,omitempty"`
+	User     string          `json:"user"`
+	Groups   []string        `json:"groups,omitempty"`
+	Peer     string          `json:"peer"`
+	Method   string          `json:"method"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Targets  []string        `json:"targets,omitempty"`
+	Outcome  string          `json:"outcome"`
+	Message  string          `json:"message,omitempty"`
+	Duration string          `json:"duration"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+}
+
+// Operation collects the data of one API call until it is finished
+// and written to the audit log.
+type Operation struct {
+	mu     sync.Mutex
+	start  time.Time
+	record Record
+
+	// last message streamed to the caller
+	success bool
+	message string
+}
+
+// RunningOperation describes a call which is not finished yet.
+type RunningOperation struct {
+	ID      string
+	User    string
+	Method  string
+	Targets []string
+	Started time.Time
+	Success bool
+	Message string
+}
+
+type operationKey struct{}
+
+// anchorType is the type of the first record of a new log file, e.g.
+// after log rotation. It continues the chain of the previous file.
+const anchorType = "anchor"
+
+var (
+	LogFile = "/var/log/kubicd/audit.log"
+
+	logMutex sync.Mutex
+	lastHash = ""
+
+	runningMutex sync.Mutex
+	running      = map[string]*Operation{}
+)
+
+// Init creates the directory for the audit log and reads the hash of
+// the last record, so that new records continue the chain. A log which
+// cannot be parsed or whose chain is broken is an error.
+func Init(logFile string) error {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	LogFile = logFile
+	if err := os.MkdirAll(filepath.Dir(LogFile), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.Open(LogFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	hash, err := readLog(f, false, nil)
+	if err != nil {
+		return err
+	}
+	lastHash = hash
+	return nil
+}
+
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// NewOperation starts the audit record for a new API call.
+func NewOperation(user string, groups []string, peer string, method string) *Operation {
+	return &Operation{
+		start: time.Now(),
+		record: Record{
+			ID:     newID(),
+			User:   user,
+			Groups: groups,
+			Peer:   peer,
+			Method: method,
+		},
+	}
+}
+
+// ID returns the operation ID of the call.
+func (op *Operation) ID() string {
+	return op.record.ID
+}
+
+// Track lists the operation in Running until it is finished.
+func (op *Operation) Track() {
+	runningMutex.Lock()
+	defer runningMutex.Unlock()
+	running[op.record.ID] = op
+}
+
+// Progress stores the last message sent to the caller.
+func (op *Operation) Progress(success bool, message string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.success, op.message = success, message
+}
+
+// Running returns the tracked operations which are not finished yet,
+// the oldest first.
+func Running() []RunningOperation {
+	runningMutex.Lock()
+	ops := make([]*Operation, 0, len(running))
+	for _, op := range running {
+		ops = append(ops, op)
+	}
+	runningMutex.Unlock()
+
+	list := make([]RunningOperation, 0, len(ops))
+	for _, op := range ops {
+		op.mu.Lock()
+		list = append(list, RunningOperation{ID: op.record.ID,
+			User: op.record.User, Method: op.record.Method,
+			Targets: append([]string(nil), op.record.Targets...),
+			Started: op.start, Success: op.success, Message: op.message})
+		op.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// secretFields are request fields whose values never show up in the
+// audit log or elsewhere.
+var secretFields = map[string]bool{
+	"password": true,
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if secretFields[key] {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+// MarshalRequest returns the request as JSON with the values of
+// secret fields like passwords replaced.
+func MarshalRequest(req interface{}) ([]byte, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redact(v))
+}
+
+// SetRequest stores the request parameters of the call.
+func (op *Operation) SetRequest(req interface{}) {
+	data, err := MarshalRequest(req)
+	if err != nil {
+		log.Errorf("Audit: cannot marshal request: %v", err)
+		return
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.record.Request = data
+}
+
+// AddTargets stores the nodes the call works on.
+func (op *Operation) AddTargets(targets []string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.record.Targets = append(op.record.Targets, targets...)
+}
+
+// Fail marks the operation as failed. Only the first message is kept.
+func (op *Operation) Fail(message string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if len(op.record.Outcome) == 0 {
+		op.record.Outcome = "failed"
+		op.record.Message = message
+	}
+}
+
+// Deny marks the operation as refused by RBAC.
+func (op *Operation) Deny() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.record.Outcome = "denied"
+}
+
+// Finish writes the record of the operation to the audit log and
+// returns the outcome.
+func (op *Operation) Finish(err error) string {
+	runningMutex.Lock()
+	delete(running, op.record.ID)
+	runningMutex.Unlock()
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if err != nil {
+		op.record.Outcome = "error"
+		op.record.Message = err.Error()
+	} else if len(op.record.Outcome) == 0 {
+		op.record.Outcome = "success"
+	}
+	op.record.Time = op.start.UTC().Format(time.RFC3339Nano)
+	op.record.Duration = time.Since(op.start).String()
+
+	if err := write(&op.record); err != nil {
+		log.Errorf("Audit: cannot write record %s: %v", op.record.ID, err)
+	}
+	return op.record.Outcome
+}
+
+// NewContext returns a copy of ctx carrying the operation.
+func NewContext(ctx context.Context, op *Operation) context.Context {
+	return context.WithValue(ctx, operationKey{}, op)
+}
+
+// AddTargets stores the nodes the call of ctx works on.
+func AddTargets(ctx context.Context, targets []string) {
+	if op, ok := ctx.Value(operationKey{}).(*Operation); ok {
+		op.AddTargets(targets)
+	}
+}
+
+func hashRecord(r *Record) (string, error) {
+	tmp := *r
+	tmp.Hash = ""
+	data, err := json.Marshal(&tmp)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// appendRecord chains r to the last record and writes it to f,
+// logMutex has to be held.
+func appendRecord(f *os.File, r *Record) error {
+	r.PrevHash = lastHash
+	hash, err := hashRecord(r)
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	lastHash = hash
+	return nil
+}
+
+func write(r *Record) error {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	f, err := os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// a new or rotated log starts with an anchor continuing the chain
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		anchor := Record{Time: time.Now().UTC().Format(time.RFC3339Nano),
+			ID: newID(), Type: anchorType, Message: "start of audit log"}
+		if err := appendRecord(f, &anchor); err != nil {
+			return err
+		}
+	}
+
+	if err := appendRecord(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,268 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+func TestMarshalRequestRedactsPasswords(t *testing.T) {
+	req := &pb.RegistryCredentialsRequest{
+		NodeNames: "worker*",
+		Credentials: []*pb.RegistryCredential{
+			{Registry: "registry.example.com", Username: "alice", Password: "s3cret-one"},
+			{Registry: "quay.example.com", Username: "bob", Password: "s3cret-two"},
+		},
+	}
+
+	data, err := MarshalRequest(req)
+	if err != nil {
+		t.Fatalf("MarshalRequest failed: %v", err)
+	}
+	for _, password := range []string{"s3cret-one", "s3cret-two"} {
+		if strings.Contains(string(data), password) {
+			t.Errorf("password %q in output: %s", password, data)
+		}
+	}
+
+	var v struct {
+		NodeNames   string `json:"node_names"`
+		Credentials []struct {
+			Registry string `json:"registry"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"credentials"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("output is no valid JSON: %v", err)
+	}
+	if v.NodeNames != "worker*" {
+		t.Errorf("node_names is %q, expected worker*", v.NodeNames)
+	}
+	if len(v.Credentials) != 2 {
+		t.Fatalf("got %d credentials, expected 2: %s", len(v.Credentials), data)
+	}
+	for i, c := range v.Credentials {
+		if c.Password != "REDACTED" {
+			t.Errorf("password of credential %d is %q, expected REDACTED", i, c.Password)
+		}
+		if c.Username != req.Credentials[i].Username || c.Registry != req.Credentials[i].Registry {
+			t.Errorf("credential %d changed: %+v", i, c)
+		}
+	}
+}
+
+func TestSetRequestRedactsPasswords(t *testing.T) {
+	op := &Operation{}
+	op.SetRequest(&pb.RegistryCredentialsRequest{
+		Credentials: []*pb.RegistryCredential{
+			{Registry: "registry.example.com", Username: "alice", Password: "s3cret"},
+		},
+	})
+	if strings.Contains(string(op.record.Request), "s3cret") {
+		t.Errorf("password in audit record: %s", op.record.Request)
+	}
+}
+
+func TestRunningOperations(t *testing.T) {
+	if err := Init(filepath.Join(t.TempDir(), "audit.log")); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	op := NewOperation("alice", nil, "127.0.0.1:1234", "/api.Kubeadm/RollingReboot")
+	op.Track()
+	op.AddTargets([]string{"worker1"})
+	op.Progress(true, "worker1: draining")
+
+	list := Running()
+	if len(list) != 1 {
+		t.Fatalf("got %d running operations, expected 1", len(list))
+	}
+	r := list[0]
+	if r.ID != op.ID() || r.User != "alice" || r.Method != "/api.Kubeadm/RollingReboot" ||
+		len(r.Targets) != 1 || r.Targets[0] != "worker1" ||
+		!r.Success || r.Message != "worker1: draining" {
+		t.Errorf("unexpected running operation: %+v", r)
+	}
+
+	op.Finish(nil)
+	if list := Running(); len(list) != 0 {
+		t.Errorf("finished operation still running: %+v", list)
+	}
+}
+
+// recordStream collects the records sent by Query.
+type recordStream struct {
+	pb.Audit_QueryServer
+	records []*pb.AuditRecord
+}
+
+func (s *recordStream) Send(r *pb.AuditRecord) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+// writeRecords writes one record per method to the audit log.
+func writeRecords(methods ...string) {
+	for _, method := range methods {
+		NewOperation("alice", nil, "127.0.0.1:1234", method).Finish(nil)
+	}
+}
+
+func query() ([]*pb.AuditRecord, error) {
+	stream := &recordStream{}
+	err := Query(&pb.AuditQueryRequest{}, stream)
+	return stream.records, err
+}
+
+func readLines(t *testing.T, file string) []string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("cannot read audit log: %v", err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func writeLines(t *testing.T, file string, lines []string) {
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatalf("cannot write audit log: %v", err)
+	}
+}
+
+func TestChainContinuesAcrossInit(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	if err := Init(logFile); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	writeRecords("/api.Kubeadm/AddNode", "/api.Kubeadm/RemoveNode")
+
+	// restart of kubicd
+	lastHash = ""
+	if err := Init(logFile); err != nil {
+		t.Fatalf("Init of existing log failed: %v", err)
+	}
+	writeRecords("/api.Kubeadm/RebootNode")
+
+	records, err := query()
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, expected 3", len(records))
+	}
+	if records[2].Method != "/api.Kubeadm/RebootNode" {
+		t.Errorf("last record is %s", records[2].Method)
+	}
+}
+
+func TestChainContinuesAcrossRotation(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	if err := Init(logFile); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	writeRecords("/api.Kubeadm/AddNode")
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing written since the rotation
+	if records, err := query(); err != nil || len(records) != 0 {
+		t.Errorf("Query of rotated log returned %d records, %v", len(records), err)
+	}
+
+	writeRecords("/api.Kubeadm/RemoveNode")
+	records, err := query()
+	if err != nil {
+		t.Fatalf("Query after rotation failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Method != "/api.Kubeadm/RemoveNode" {
+		t.Errorf("unexpected records after rotation: %v", records)
+	}
+
+	lines := readLines(t, logFile)
+	var anchor Record
+	if err := json.Unmarshal([]byte(lines[0]), &anchor); err != nil {
+		t.Fatal(err)
+	}
+	old := readLines(t, logFile+".1")
+	var last Record
+	if err := json.Unmarshal([]byte(old[len(old)-1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if anchor.Type != anchorType || anchor.PrevHash != last.Hash {
+		t.Errorf("first record %+v does not continue the chain of %s", anchor, last.Hash)
+	}
+
+	lastHash = ""
+	if err := Init(logFile); err != nil {
+		t.Errorf("Init of rotated log failed: %v", err)
+	}
+}
+
+func TestTamperingDetected(t *testing.T) {
+	tests := []struct {
+		name string
+		// changes the lines of the log, the first line is the anchor
+		change func([]string) []string
+		// Init fails, too
+		initFails bool
+	}{
+		{"modified record", func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], `"outcome":"success"`, `"outcome":"failed"`, 1)
+			return lines
+		}, true},
+		{"removed record", func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}, true},
+		{"removed anchor", func(lines []string) []string {
+			return lines[1:]
+		}, true},
+		{"removed last record", func(lines []string) []string {
+			return lines[:len(lines)-1]
+		}, false},
+		{"truncated last record", func(lines []string) []string {
+			last := lines[len(lines)-1]
+			lines[len(lines)-1] = last[:len(last)/2]
+			return lines
+		}, true},
+	}
+
+	for _, test := range tests {
+		logFile := filepath.Join(t.TempDir(), "audit.log")
+		if err := Init(logFile); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		writeRecords("/api.Kubeadm/AddNode", "/api.Kubeadm/RemoveNode", "/api.Kubeadm/RebootNode")
+		if _, err := query(); err != nil {
+			t.Fatalf("%s: Query of the original log failed: %v", test.name, err)
+		}
+
+		writeLines(t, logFile, test.change(readLines(t, logFile)))
+		if _, err := query(); err == nil {
+			t.Errorf("%s: not detected by Query", test.name)
+		}
+		lastHash = ""
+		if err := Init(logFile); (err != nil) != test.initFails {
+			t.Errorf("%s: Init returned %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+)
+
+// readLog reads the records of the audit log and verifies the hash
+// chain. The first record may be an anchor, its previous hash is
+// taken as start of the chain. A last line without newline is a
+// record still being written; if partial is true, reading stops
+// before it, else it is an error. fn is called for every record
+// except anchors. The hash of the last record is returned.
+func readLog(f io.Reader, partial bool, fn func(*Record) error) (string, error) {
+	prevHash := ""
+	line := 0
+	reader := bufio.NewReader(f)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 && !partial {
+				return "", errors.New("audit log corrupted in line " + strconv.Itoa(line+1) + ": incomplete record")
+			}
+			return prevHash, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		line++
+
+		var r Record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return "", errors.New("audit log corrupted in line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		hash, err := hashRecord(&r)
+		if err != nil {
+			return "", err
+		}
+		if line == 1 && r.Type == anchorType {
+			prevHash = r.PrevHash
+		}
+		if r.PrevHash != prevHash || r.Hash != hash {
+			return "", errors.New("audit log tampered with in line " + strconv.Itoa(line) + " (record " + r.ID + ")")
+		}
+		prevHash = r.Hash
+
+		if r.Type == anchorType || fn == nil {
+			continue
+		}
+		if err := fn(&r); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Query sends all records of the audit log matching the request. The
+// hash chain is verified while reading, if it is broken or records at
+// the end are missing an error is returned.
+func Query(in *pb.AuditQueryRequest, stream pb.Audit_QueryServer) error {
+	var since time.Time
+	if len(in.Since) > 0 {
+		var err error
+		since, err = time.Parse(time.RFC3339, in.Since)
+		if err != nil {
+			return errors.New("invalid time '" + in.Since + "': " + err.Error())
+		}
+	}
+	method := strings.TrimPrefix(in.Method, "/api.")
+
+	// only read the records written so far, new ones may be appended
+	// while reading
+	logMutex.Lock()
+	last := lastHash
+	f, err := os.Open(LogFile)
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			size = fi.Size()
+		} else {
+			f.Close()
+		}
+	}
+	logMutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	hash, err := readLog(io.LimitReader(f, size), true, func(r *Record) error {
+		if len(in.User) > 0 && in.User != r.User {
+			return nil
+		}
+		if len(method) > 0 {
+			if matched, _ := path.Match(method, strings.TrimPrefix(r.Method, "/api.")); !matched {
+				return nil
+			}
+		}
+		if !since.IsZero() {
+			t, err := time.Parse(time.RFC3339Nano, r.Time)
+			if err != nil || t.Before(since) {
+				return nil
+			}
+		}
+
+		return stream.Send(&pb.AuditRecord{Time: r.Time, Id: r.ID,
+			User: r.User, Peer: r.Peer, Method: r.Method,
+			Request: string(r.Request), Targets: r.Targets,
+			Outcome: r.Outcome, Message: r.Message,
+			Duration: r.Duration, Hash: r.Hash})
+	})
+	if err != nil {
+		return err
+	}
+	if size > 0 && hash != last {
+		return errors.New("audit log truncated, the last records are missing")
+	}
+	return nil
+}
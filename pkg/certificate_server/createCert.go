@@ -24,6 +24,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/metrics"
 )
 
 var PKI_dir = "/etc/kubicd/pki"
@@ -38,7 +39,9 @@ func ExecuteCmd(command string, arg ...string) (bool, string) {
 
 	//log.Info(cmd)
 
-	if err := cmd.Run(); err != nil {
+	err := cmd.Run()
+	metrics.ObserveCommand(command, err == nil)
+	if err != nil {
 		errorstr := strings.TrimSpace(stderr.String())
 		log.Error("Error invoking " + command + ": " + fmt.Sprint(err) + "\n" + errorstr)
 		return false, "Error invoking " + command + ": " + err.Error() + " \n(" + errorstr + ")"
@@ -49,10 +52,17 @@ func ExecuteCmd(command string, arg ...string) (bool, string) {
 	return true, out.String()
 }
 
-func CreateUser(pki_dir string, cn string) (bool, string) {
-	return ExecuteCmd("certstrap", "--depot-path", pki_dir,
+func CreateUser(pki_dir string, cn string, o string, ou string) (bool, string) {
+	args := []string{"--depot-path", pki_dir,
 		"request-cert", "--common-name", cn,
-		"--domain", "KubicD", "--passphrase", "")
+		"--domain", "KubicD", "--passphrase", ""}
+	if len(o) > 0 {
+		args = append(args, "--organization", o)
+	}
+	if len(ou) > 0 {
+		args = append(args, "--organizational-unit", ou)
+	}
+	return ExecuteCmd("certstrap", args...)
 }
 
 func SignUser(pki_dir string, cn string) (bool, string) {
@@ -64,7 +74,7 @@ func CreateCert(in *pb.CreateCertRequest) (bool, string, string, string) {
 
 	user := in.Name
 
-	success, message := CreateUser(PKI_dir, user)
+	success, message := CreateUser(PKI_dir, user, in.Organization, in.OrganizationalUnit)
 	if success != true {
 		return success, message, "", ""
 	}
@@ -0,0 +1,86 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deployment
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+)
+
+// DriftState tells if a deployed service differs from its source,
+// which means that UpdateAll would update it.
+type DriftState struct {
+	// k8s-yaml, k8s-kustomize or k8s-helm
+	Config  string
+	Name    string
+	Drifted bool
+	// the state could not be determined
+	Err error
+}
+
+// Drift checks all services tracked in k8s-yaml.conf,
+// k8s-kustomize.conf and k8s-helm.conf without updating them.
+func Drift() []DriftState {
+	var states []DriftState
+
+	cfg, err := ini.LooseLoad(StateDir + "/k8s-yaml.conf")
+	if err == nil {
+		for _, key := range cfg.Section("").KeyStrings() {
+			hash, err := tools.Sha256sum_f(key)
+			states = append(states, DriftState{Config: "k8s-yaml", Name: key,
+				Drifted: hash != cfg.Section("").Key(key).String(), Err: err})
+		}
+	}
+
+	cfg, err = ini.LooseLoad(StateDir + "/k8s-kustomize.conf")
+	if err == nil {
+		for _, key := range cfg.Section("").KeyStrings() {
+			state := DriftState{Config: "k8s-kustomize", Name: key}
+			success, message := tools.ExecuteCmd("kustomize", "build",
+				StateDir+"/kustomize/"+key+"/overlay")
+			if success {
+				hash, _ := tools.Sha256sum_b(message)
+				state.Drifted = hash != cfg.Section("").Key(key).String()
+			} else {
+				state.Err = errors.New(message)
+			}
+			states = append(states, state)
+		}
+	}
+
+	cfg, err = ini.LooseLoad(helmConfig)
+	if err == nil {
+		for _, chartName := range cfg.Section("").KeyStrings() {
+			if strings.HasSuffix(chartName, ".releaseName") ||
+				strings.HasSuffix(chartName, ".valuesPath") ||
+				strings.HasSuffix(chartName, ".namespace") {
+				continue
+			}
+			releaseName := cfg.Section("").Key(chartName + ".releaseName").String()
+			valuesPath := cfg.Section("").Key(chartName + ".valuesPath").String()
+			namespace := cfg.Section("").Key(chartName + ".namespace").String()
+			hash := cfg.Section("").Key(chartName).String()
+
+			drifted, err := checkHelmUpdate(chartName, releaseName, valuesPath, namespace, hash)
+			states = append(states, DriftState{Config: "k8s-helm", Name: chartName,
+				Drifted: drifted, Err: err})
+		}
+	}
+
+	return states
+}
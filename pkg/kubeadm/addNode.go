@@ -21,6 +21,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
@@ -29,13 +31,101 @@ var (
 	token_create_time time.Time
 )
 
-func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
-	// XXX Check if node isn't already part of the kubernetes cluster
+// JoinTokenAge returns the age of the cached join command, false if
+// no token was created yet.
+func JoinTokenAge() (time.Duration, bool) {
+	if token_create_time.IsZero() {
+		return 0, false
+	}
+	return time.Since(token_create_time), true
+}
 
+func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 	haproxy_salt := ""
 	nodeNames := in.NodeNames
 	nodeType := in.Type
-	master_salt := Read_Cfg("control-plane.conf", "master")
+
+	// if nodeType is not set, assume worker
+	if len(nodeType) == 0 {
+		nodeType = "worker"
+	}
+
+	if err := checkMetadata(in.Labels, in.Taints); err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Ping all nodes to get an exact list of node names
+	var success bool
+	var message string
+	var nodelist []string
+
+	// Differentiate between 'name1,name2' and 'name[1,2]'
+	if strings.Index(nodeNames, ",") >= 0 && strings.Index(nodeNames, "[") == -1 {
+		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt",
+			"-L", nodeNames, "test.ping")
+	} else {
+		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt",
+			nodeNames, "test.ping")
+	}
+	if success != true {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+	// we have a list of minions, only use the one where the line ends with "True"
+	list := strings.Split(message, "\n")
+	for _, entry := range list {
+		if strings.HasSuffix(entry, ": True") {
+			list := strings.Split(entry, ":")
+			nodelist = append(nodelist, list[0])
+		}
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+
+	// Make sure the caller is allowed to add all these nodes before
+	// we change anything
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, nodeType); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	master_salt, err := findFirstMaster(true)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Check the nodes before we change anything on them
+	if nodeType != "haproxy" {
+		if in.IgnorePreflight {
+			stream.Send(&pb.StatusReply{Success: true, Message: "Skipping pre-flight checks"})
+		} else {
+			stream.Send(&pb.StatusReply{Success: true, Message: "Running pre-flight checks ..."})
+			failures := preflight(nodelist)
+			if len(failures) > 0 {
+				for _, node := range nodelist {
+					for _, failure := range failures[node] {
+						if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + failure}); err != nil {
+							return err
+						}
+					}
+				}
+				if err := stream.Send(&pb.StatusReply{Success: false, Message: "Pre-flight checks failed, use --ignore-preflight to add the node(s) anyway"}); err != nil {
+					return err
+				}
+				return nil
+			}
+		}
+	}
 
 	// If the join command is older than 23 hours, generate a new one. Else re-use the old one.
 	if time.Since(token_create_time).Hours() > 23 {
@@ -60,11 +150,6 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 
 	joincmd := joincmd_g
 
-	// if nodeType is not set, assume worker
-	if len(nodeType) == 0 {
-		nodeType = "worker"
-	}
-
 	if strings.EqualFold(nodeType, "master") {
 		joincmd = joincmd + " --control-plane"
 
@@ -79,34 +164,26 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 		// the key is the third line in the output
 		cert_key := strings.Split(strings.Replace(lines, ":", "", -1), "\n")
 		joincmd = joincmd + " --certificate-key " + strings.TrimSuffix(string(cert_key[2]), "\n")
-		haproxy_salt = Read_Cfg("control-plane.conf", "loadbalancer_salt")
+		haproxy_salt = strings.Join(loadBalancers(), ",")
 	}
 
-	// Ping all nodes to get an exact list of node names
-	var success bool
-	var message string
-	var nodelist []string
-
-	// Differentiate between 'name1,name2' and 'name[1,2]'
-	if strings.Index(nodeNames, ",") >= 0 && strings.Index(nodeNames, "[") == -1 {
-		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt",
-			"-L", nodeNames, "test.ping")
-	} else {
-		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt",
-			nodeNames, "test.ping")
-	}
-	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
-			return err
+	// Clusters using their own registry may not be able to reach
+	// the default one, pull the images before joining
+	var images []string
+	if image_repository := Read_Cfg("control-plane.conf", "image_repository"); len(image_repository) > 0 && nodeType != "haproxy" {
+		success, version := clusterVersion()
+		if success != true {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: version}); err != nil {
+				return err
+			}
+			return nil
 		}
-		return nil
-	}
-	// we have a list of minions, only use the one where the line ends with "True"
-	list := strings.Split(message, "\n")
-	for _, entry := range list {
-		if strings.HasSuffix(entry, ": True") {
-			list := strings.Split(entry, ":")
-			nodelist = append(nodelist, list[0])
+		images, err = controlPlaneImages(master_salt, version, image_repository, strings.EqualFold(nodeType, "master"))
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot get list of images: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
 		}
 	}
 
@@ -154,6 +231,17 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				return
 			}
 
+			if len(images) > 0 {
+				stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": pulling images..."})
+				if err := pullImages(nodelist[i], images); err != nil {
+					if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + err.Error()}); err != nil {
+						log.Errorf("Send message failed: %s", err)
+					}
+					failed++
+					return
+				}
+			}
+
 			stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": joining cluster..."})
 
 			success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", nodelist[i], "cmd.run", "\""+joincmd+"\"")
@@ -172,6 +260,18 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 				failed++
 				return
 			}
+			// Apply labels, taints and node-role of the request and
+			// the ones recorded when the node was part of the
+			// cluster before
+			if nodeType != "haproxy" {
+				if err := updateNodeMetadata(nodelist[i], in.NodeRole, in.Labels, in.Taints); err != nil {
+					if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": cannot set labels and taints: " + err.Error()}); err != nil {
+						log.Errorf("Send message failed: %s", err)
+					}
+					failed++
+					return
+				}
+			}
 			// Configure transactinal-update
 			success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", nodelist[i], "cmd.run", "if [ -f /etc/transactional-update.conf ]; then grep -q ^REBOOT_METHOD= /etc/transactional-update.conf && sed -i -e 's|REBOOT_METHOD=.*|REBOOT_METHOD=kured|g' /etc/transactional-update.conf || echo REBOOT_METHOD=kured >> /etc/transactional-update.conf ; else echo REBOOT_METHOD=kured > /etc/transactional-update.conf ; fi")
 			if success != true {
@@ -185,7 +285,7 @@ func AddNode(in *pb.AddNodeRequest, stream pb.Kubeadm_AddNodeServer) error {
 			if len(haproxy_salt) > 0 {
 				stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": adding node to haproxy loadbalancer..."})
 
-				success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", haproxy_salt, "cmd.run", "haproxycfg server add "+nodelist[i])
+				success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "-L", haproxy_salt, "cmd.run", "haproxycfg server add "+nodelist[i])
 				if success != true {
 					if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 						log.Errorf("Send message failed: %s", err)
@@ -0,0 +1,457 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// KubeletConfiguration written by kubeadm on every node
+const kubeletConfigFile = "/var/lib/kubelet/config.yaml"
+
+// The kubelet settings changed on a subset of the nodes, a section per
+// salt minion. kubeadm upgrade rewrites the configuration from the
+// ConfigMap, afterwards they are applied again.
+const kubeletOverridesFile = "/var/lib/kubic-control/kubelet-config.conf"
+
+var (
+	kubeletOverridesMutex sync.Mutex
+
+	// key=value to set and key- to remove an entry of a map setting
+	// like evictionHard or systemReserved
+	kubeletMapRegexp = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]*)(=[^=,\s]+|-)$`)
+)
+
+// kubeletMapSettings maps the fields of the request to the keys of the
+// KubeletConfiguration.
+func kubeletMapSettings(in *pb.KubeletConfigRequest) map[string][]string {
+	return map[string][]string{
+		"evictionHard":            in.EvictionHard,
+		"evictionSoft":            in.EvictionSoft,
+		"evictionSoftGracePeriod": in.EvictionSoftGracePeriod,
+		"systemReserved":          in.SystemReserved,
+		"kubeReserved":            in.KubeReserved,
+	}
+}
+
+func checkKubeletSettings(in *pb.KubeletConfigRequest) error {
+	changes := 0
+	for key, entries := range kubeletMapSettings(in) {
+		for _, entry := range entries {
+			if !kubeletMapRegexp.MatchString(entry) {
+				return errors.New("Invalid " + key + " entry '" + entry + "', expected key=value or key-")
+			}
+			changes++
+		}
+	}
+	if in.MaxPods < 0 {
+		return errors.New("Invalid max pods: " + strconv.Itoa(int(in.MaxPods)))
+	} else if in.MaxPods > 0 {
+		changes++
+	}
+	if changes == 0 {
+		return errors.New("No kubelet setting to change given")
+	}
+	return nil
+}
+
+// setKey replaces the value of the key or appends it.
+func setKey(ms yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i := range ms {
+		if ms[i].Key == key {
+			ms[i].Value = value
+			return ms
+		}
+	}
+	return append(ms, yaml.MapItem{Key: key, Value: value})
+}
+
+func deleteKey(ms yaml.MapSlice, key string) yaml.MapSlice {
+	for i := range ms {
+		if ms[i].Key == key {
+			return append(ms[:i], ms[i+1:]...)
+		}
+	}
+	return ms
+}
+
+// applyKubeletSettings changes the settings of the request in the
+// KubeletConfiguration, all other settings and their order are kept.
+func applyKubeletSettings(data string, in *pb.KubeletConfigRequest) ([]byte, error) {
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(data), &config); err != nil {
+		return nil, errors.New("Cannot parse kubelet configuration: " + err.Error())
+	}
+
+	for key, entries := range kubeletMapSettings(in) {
+		if len(entries) == 0 {
+			continue
+		}
+		var values yaml.MapSlice
+		for _, item := range config {
+			if item.Key == key {
+				values, _ = item.Value.(yaml.MapSlice)
+			}
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry, "-") && !strings.Contains(entry, "=") {
+				values = deleteKey(values, strings.TrimSuffix(entry, "-"))
+			} else {
+				kv := strings.SplitN(entry, "=", 2)
+				values = setKey(values, kv[0], kv[1])
+			}
+		}
+		if len(values) == 0 {
+			config = deleteKey(config, key)
+		} else {
+			config = setKey(config, key, values)
+		}
+	}
+	if in.MaxPods > 0 {
+		config = setKey(config, "maxPods", int(in.MaxPods))
+	}
+
+	return yaml.Marshal(config)
+}
+
+// kubeletEntryKey returns the key of a key=value or key- entry.
+func kubeletEntryKey(entry string) string {
+	if i := strings.Index(entry, "="); i >= 0 {
+		return entry[:i]
+	}
+	return strings.TrimSuffix(entry, "-")
+}
+
+// withoutKeys returns the entries whose key is not changed by changes.
+func withoutKeys(entries []string, changes []string) []string {
+	var kept []string
+	for _, entry := range entries {
+		found := false
+		for _, change := range changes {
+			if kubeletEntryKey(entry) == kubeletEntryKey(change) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// loadKubeletOverrides returns the recorded settings of the node as
+// request, nil if there are none.
+func loadKubeletOverrides(cfg *ini.File, node string) *pb.KubeletConfigRequest {
+	section, err := cfg.GetSection(node)
+	if err != nil {
+		return nil
+	}
+	o := &pb.KubeletConfigRequest{
+		EvictionHard:            section.Key("evictionHard").Strings(","),
+		EvictionSoft:            section.Key("evictionSoft").Strings(","),
+		EvictionSoftGracePeriod: section.Key("evictionSoftGracePeriod").Strings(","),
+		MaxPods:                 int32(section.Key("maxPods").MustInt(0)),
+		SystemReserved:          section.Key("systemReserved").Strings(","),
+		KubeReserved:            section.Key("kubeReserved").Strings(",")}
+	return o
+}
+
+// saveKubeletOverrides stores the settings of the node, the section is
+// removed if there are none.
+func saveKubeletOverrides(cfg *ini.File, node string, o *pb.KubeletConfigRequest) {
+	empty := o.MaxPods == 0
+	for _, entries := range kubeletMapSettings(o) {
+		empty = empty && len(entries) == 0
+	}
+	if empty {
+		cfg.DeleteSection(node)
+		return
+	}
+	section := cfg.Section(node)
+	for key, entries := range kubeletMapSettings(o) {
+		section.Key(key).SetValue(strings.Join(entries, ","))
+	}
+	section.Key("maxPods").SetValue(strconv.Itoa(int(o.MaxPods)))
+}
+
+// mergeKubeletOverrides returns the recorded settings o changed by in.
+// If keep is false, the settings of in are removed instead, they are
+// part of the ConfigMap now.
+func mergeKubeletOverrides(o *pb.KubeletConfigRequest, in *pb.KubeletConfigRequest, keep bool) *pb.KubeletConfigRequest {
+	merge := func(entries []string, changes []string) []string {
+		entries = withoutKeys(entries, changes)
+		if keep {
+			entries = append(entries, changes...)
+		}
+		return entries
+	}
+	result := &pb.KubeletConfigRequest{MaxPods: o.MaxPods,
+		EvictionHard:            merge(o.EvictionHard, in.EvictionHard),
+		EvictionSoft:            merge(o.EvictionSoft, in.EvictionSoft),
+		EvictionSoftGracePeriod: merge(o.EvictionSoftGracePeriod, in.EvictionSoftGracePeriod),
+		SystemReserved:          merge(o.SystemReserved, in.SystemReserved),
+		KubeReserved:            merge(o.KubeReserved, in.KubeReserved)}
+	if in.MaxPods > 0 {
+		result.MaxPods = 0
+		if keep {
+			result.MaxPods = in.MaxPods
+		}
+	}
+	return result
+}
+
+// recordKubeletOverrides records the settings changed on the nodes. If
+// all nodes were changed, the settings are removed from the recorded
+// ones of every node instead.
+func recordKubeletOverrides(nodes []string, in *pb.KubeletConfigRequest, allNodes bool) error {
+	kubeletOverridesMutex.Lock()
+	defer kubeletOverridesMutex.Unlock()
+
+	cfg, err := ini.LooseLoad(kubeletOverridesFile)
+	if err != nil {
+		return err
+	}
+	if allNodes {
+		nodes = cfg.SectionStrings()
+	}
+	for _, node := range nodes {
+		if node == ini.DefaultSection {
+			continue
+		}
+		o := loadKubeletOverrides(cfg, node)
+		if o == nil {
+			o = &pb.KubeletConfigRequest{}
+		}
+		saveKubeletOverrides(cfg, node, mergeKubeletOverrides(o, in, !allNodes))
+	}
+	return cfg.SaveTo(kubeletOverridesFile)
+}
+
+// reapplyKubeletOverrides writes the recorded settings of the node
+// into its KubeletConfiguration again, kubeadm upgrade replaced it with
+// the one of the ConfigMap. The kubelet has to be restarted afterwards.
+func reapplyKubeletOverrides(node string) error {
+	kubeletOverridesMutex.Lock()
+	cfg, err := ini.LooseLoad(kubeletOverridesFile)
+	kubeletOverridesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	o := loadKubeletOverrides(cfg, node)
+	if o == nil {
+		return nil
+	}
+	data, err := tools.ReadFileSalt(node, kubeletConfigFile)
+	if err != nil {
+		return err
+	}
+	config, err := applyKubeletSettings(data, o)
+	if err != nil {
+		return err
+	}
+	if success, message := tools.WriteFileSalt(node, kubeletConfigFile, config, "0644"); success != true {
+		return errors.New(message)
+	}
+	return nil
+}
+
+// kubeletConfigMap returns the name of the ConfigMap kubeadm uses for
+// the kubelet configuration of new and upgraded nodes.
+func kubeletConfigMap() (string, error) {
+	success, message := clusterVersion()
+	if success != true {
+		return "", errors.New(message)
+	}
+	version := parseVersion(message)
+	if version == nil {
+		return "", errors.New("Cannot parse cluster version " + message)
+	}
+	// versioned names were dropped with kubernetes 1.24
+	if version[0] == 1 && version[1] < 24 {
+		return "kubelet-config-" + strconv.Itoa(version[0]) + "." + strconv.Itoa(version[1]), nil
+	}
+	return "kubelet-config", nil
+}
+
+// updateKubeletConfigMap changes the settings in the cluster wide
+// kubelet configuration, so that new nodes get them, too.
+func updateKubeletConfigMap(in *pb.KubeletConfigRequest) error {
+	name, err := kubeletConfigMap()
+	if err != nil {
+		return err
+	}
+	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"-n", "kube-system", "get", "configmap", name, "-o", "jsonpath={.data.kubelet}")
+	if success != true {
+		return errors.New(message)
+	}
+	config, err := applyKubeletSettings(message, in)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]map[string]string{"data": {"kubelet": string(config)}})
+	if err != nil {
+		return err
+	}
+	success, message = tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"-n", "kube-system", "patch", "configmap", name, "--type", "merge", "-p", string(patch))
+	if success != true {
+		return errors.New(message)
+	}
+	return nil
+}
+
+// configureKubelet changes the kubelet configuration of one node,
+// restarts the kubelet and waits until the node is Ready again. If the
+// kubelet does not come back, the old configuration is restored.
+func configureKubelet(stream pb.Kubeadm_ConfigureKubeletServer, node string, in *pb.KubeletConfigRequest, timeout time.Duration) error {
+	hostname, err := tools.GetNodeName(node)
+	if err != nil {
+		return err
+	}
+	old, err := tools.ReadFileSalt(node, kubeletConfigFile)
+	if err != nil {
+		return err
+	}
+	config, err := applyKubeletSettings(old, in)
+	if err != nil {
+		return err
+	}
+
+	restart := func(data []byte) error {
+		if success, message := tools.WriteFileSalt(node, kubeletConfigFile, data, "0644"); success != true {
+			return errors.New(message)
+		}
+		return restartServices(stream.Context(), node, hostname, []string{"kubelet"}, timeout)
+	}
+
+	stream.Send(&pb.StatusReply{Success: true, Message: node + ": restarting kubelet..."})
+	if err := restart(config); err != nil {
+		stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + err.Error() + ", restoring old configuration..."})
+		if err2 := restart([]byte(old)); err2 != nil {
+			log.Errorf("Restoring kubelet configuration of %s failed: %v", node, err2)
+		}
+		return err
+	}
+	return nil
+}
+
+// ConfigureKubelet changes the KubeletConfiguration of the selected
+// nodes and restarts the kubelet on one node after the other. If all
+// nodes are selected, the kubelet-config ConfigMap is changed, too.
+func ConfigureKubelet(in *pb.KubeletConfigRequest, stream pb.Kubeadm_ConfigureKubeletServer) error {
+	if err := checkKubeletSettings(in); err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	timeout := 5 * time.Minute
+	if len(in.Timeout) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(in.Timeout)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid timeout: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	nodelist, err := targetNodes(in.NodeNames, in.Role, in.LabelSelector)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(nodelist) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "No Nodes found"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	allNodes := len(in.NodeNames) == 0 && len(in.Role) == 0 && len(in.LabelSelector) == 0
+	if allNodes {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Update kubelet-config ConfigMap..."}); err != nil {
+			return err
+		}
+		if err := updateKubeletConfigMap(in); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot update kubelet-config ConfigMap: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+		// the ConfigMap overrides the settings of single nodes now
+		if err := recordKubeletOverrides(nil, in, true); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot record kubelet settings: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	for i, node := range nodelist {
+		if err := configureKubelet(stream, node, in, timeout); err != nil {
+			message := "Configuration of kubelet stopped, failed: " + node + " (" + err.Error() + ")"
+			if i+1 < len(nodelist) {
+				message = message + ", not configured: " + strings.Join(nodelist[i+1:], ", ")
+			}
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if !allNodes {
+			if err := recordKubeletOverrides([]string{node}, in, false); err != nil {
+				if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": cannot record kubelet settings: " + err.Error()}); err != nil {
+					return err
+				}
+			}
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: node + ": kubelet configured and Ready"}); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Kubelet configuration changed on " + strings.Join(nodelist, ", ")}); err != nil {
+		return err
+	}
+	return nil
+}
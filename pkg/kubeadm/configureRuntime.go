@@ -0,0 +1,309 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+)
+
+// Drop-ins written by kubicd, they override the configuration shipped
+// with the image.
+const (
+	crioDropIn       = "/etc/crio/crio.conf.d/90-kubicd.conf"
+	registriesDropIn = "/etc/containers/registries.conf.d/90-kubicd.conf"
+)
+
+// The hash of the runtime configuration applied to every node, a
+// section per salt minion.
+const runtimeStateFile = "/var/lib/kubic-control/runtime-config.conf"
+
+var runtimeStateMutex sync.Mutex
+
+// registryConfig collects the registries.conf settings of one
+// registry.
+type registryConfig struct {
+	insecure bool
+	mirrors  []string
+}
+
+// tomlString quotes a string for TOML.
+func tomlString(s string) string {
+	return strconv.Quote(s)
+}
+
+// renderRuntimeConfig returns the content of the CRI-O and the
+// registries drop-in for the spec. An empty spec would reset all
+// settings and needs the reset flag, then the drop-ins are removed and
+// both are empty.
+func renderRuntimeConfig(in *pb.RuntimeConfigRequest) (string, string, error) {
+	empty := len(in.StorageDriver) == 0 && in.PidsLimit == 0 && len(in.PauseImage) == 0 &&
+		len(in.RegistryMirrors) == 0 && len(in.InsecureRegistries) == 0
+	if empty && !in.Reset_ {
+		return "", "", errors.New("No runtime setting given, use reset to remove all settings")
+	}
+	if !empty && in.Reset_ {
+		return "", "", errors.New("Reset cannot be combined with runtime settings")
+	}
+	if in.Reset_ {
+		return "", "", nil
+	}
+
+	var crio strings.Builder
+	crio.WriteString("# Generated by kubicd, do not edit\n")
+	if len(in.StorageDriver) > 0 {
+		crio.WriteString("[crio]\nstorage_driver = " + tomlString(in.StorageDriver) + "\n")
+	}
+	if in.PidsLimit < 0 && in.PidsLimit != -1 {
+		return "", "", errors.New("Invalid pids limit: " + strconv.FormatInt(in.PidsLimit, 10))
+	}
+	if in.PidsLimit != 0 {
+		crio.WriteString("[crio.runtime]\npids_limit = " + strconv.FormatInt(in.PidsLimit, 10) + "\n")
+	}
+	if len(in.PauseImage) > 0 {
+		crio.WriteString("[crio.image]\npause_image = " + tomlString(in.PauseImage) + "\n")
+	}
+
+	registries := make(map[string]*registryConfig)
+	get := func(location string) *registryConfig {
+		if _, ok := registries[location]; !ok {
+			registries[location] = &registryConfig{}
+		}
+		return registries[location]
+	}
+	for _, entry := range in.RegistryMirrors {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return "", "", errors.New("Invalid registry mirror '" + entry + "', expected registry=mirror[,mirror...]")
+		}
+		r := get(kv[0])
+		r.mirrors = append(r.mirrors, strings.Split(kv[1], ",")...)
+	}
+	for _, registry := range in.InsecureRegistries {
+		if len(registry) == 0 || strings.ContainsAny(registry, "= ") {
+			return "", "", errors.New("Invalid insecure registry '" + registry + "'")
+		}
+		get(registry).insecure = true
+	}
+
+	var locations []string
+	for location := range registries {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+
+	var reg strings.Builder
+	reg.WriteString("# Generated by kubicd, do not edit\n")
+	for _, location := range locations {
+		r := registries[location]
+		reg.WriteString("\n[[registry]]\nlocation = " + tomlString(location) + "\n")
+		if r.insecure {
+			reg.WriteString("insecure = true\n")
+		}
+		for _, mirror := range r.mirrors {
+			reg.WriteString("\n[[registry.mirror]]\nlocation = " + tomlString(strings.TrimSpace(mirror)) + "\n")
+			if contains(in.InsecureRegistries, strings.TrimSpace(mirror)) {
+				reg.WriteString("insecure = true\n")
+			}
+		}
+	}
+	return crio.String(), reg.String(), nil
+}
+
+// recordRuntimeHash stores the hash of the configuration applied to
+// the node, an empty hash removes the entry of a reset node.
+func recordRuntimeHash(node string, hash string) error {
+	runtimeStateMutex.Lock()
+	defer runtimeStateMutex.Unlock()
+
+	cfg, err := ini.LooseLoad(runtimeStateFile)
+	if err != nil {
+		return err
+	}
+	if len(hash) == 0 {
+		cfg.DeleteSection(node)
+		return cfg.SaveTo(runtimeStateFile)
+	}
+	section := cfg.Section(node)
+	section.Key("hash").SetValue(hash)
+	section.Key("applied").SetValue(time.Now().UTC().Format(time.RFC3339))
+	return cfg.SaveTo(runtimeStateFile)
+}
+
+// runtimeFile is a drop-in on a node, data is nil if it does not
+// exist.
+type runtimeFile struct {
+	path string
+	data *string
+}
+
+// readRuntimeFiles returns the current drop-ins of the node.
+func readRuntimeFiles(node string) ([]runtimeFile, error) {
+	var files []runtimeFile
+	for _, path := range []string{crioDropIn, registriesDropIn} {
+		found, err := exists(path, node)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			files = append(files, runtimeFile{path, nil})
+			continue
+		}
+		data, err := tools.ReadFileSalt(node, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, runtimeFile{path, &data})
+	}
+	return files, nil
+}
+
+// configureRuntime writes or removes the drop-ins on the node, restarts
+// CRI-O and kubelet and waits until the node is Ready again. If CRI-O
+// or the node does not come back, the old drop-ins are restored.
+func configureRuntime(stream pb.Runtime_ConfigureServer, node string, files []runtimeFile, timeout time.Duration) error {
+	hostname, err := tools.GetNodeName(node)
+	if err != nil {
+		return err
+	}
+	old, err := readRuntimeFiles(node)
+	if err != nil {
+		return err
+	}
+	if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "cmd.run",
+		"mkdir -p /etc/crio/crio.conf.d /etc/containers/registries.conf.d"); success != true {
+		return errors.New(message)
+	}
+
+	restart := func(files []runtimeFile) error {
+		for _, f := range files {
+			if f.data == nil {
+				if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "cmd.run",
+					"rm -f "+f.path); success != true {
+					return errors.New(message)
+				}
+			} else if success, message := tools.WriteFileSalt(node, f.path, []byte(*f.data), "0644"); success != true {
+				return errors.New(message)
+			}
+		}
+		// kubelet is restarted after crio, so that it reports the
+		// state of the node at once
+		return restartServices(stream.Context(), node, hostname, []string{"crio", "kubelet"}, timeout)
+	}
+
+	stream.Send(&pb.StatusReply{Success: true, Message: node + ": restarting crio and kubelet..."})
+	if err := restart(files); err != nil {
+		stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + err.Error() + ", restoring old configuration..."})
+		if err2 := restart(old); err2 != nil {
+			log.Errorf("Restoring crio configuration of %s failed: %v", node, err2)
+		}
+		return err
+	}
+	return nil
+}
+
+// ConfigureRuntime renders the CRI-O and registries.conf drop-ins from
+// the spec and applies them to the selected nodes, restarting CRI-O on
+// one node after the other.
+func ConfigureRuntime(in *pb.RuntimeConfigRequest, stream pb.Runtime_ConfigureServer) error {
+	crio, registries, err := renderRuntimeConfig(in)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	files := []runtimeFile{{crioDropIn, &crio}, {registriesDropIn, &registries}}
+	hash := ""
+	if in.Reset_ {
+		files = []runtimeFile{{crioDropIn, nil}, {registriesDropIn, nil}}
+	} else {
+		hash, _ = tools.Sha256sum_b(crio + registries)
+	}
+
+	timeout := 5 * time.Minute
+	if len(in.Timeout) > 0 {
+		timeout, err = time.ParseDuration(in.Timeout)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid timeout: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	nodelist, err := targetNodes(in.NodeNames, in.Role, in.LabelSelector)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(nodelist) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "No Nodes found"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for i, node := range nodelist {
+		if err := configureRuntime(stream, node, files, timeout); err != nil {
+			message := "Configuration of crio stopped, failed: " + node + " (" + err.Error() + ")"
+			if i+1 < len(nodelist) {
+				message = message + ", not configured: " + strings.Join(nodelist[i+1:], ", ")
+			}
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := recordRuntimeHash(node, hash); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: node + ": cannot record configuration hash: " + err.Error()}); err != nil {
+				return err
+			}
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: node + ": crio configured and Ready"}); err != nil {
+			return err
+		}
+	}
+
+	message := "Runtime configuration removed from " + strings.Join(nodelist, ", ")
+	if len(hash) > 0 {
+		message = "Runtime configuration " + hash[:12] + " applied to " + strings.Join(nodelist, ", ")
+	}
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
+		return err
+	}
+	return nil
+}
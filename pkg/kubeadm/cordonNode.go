@@ -0,0 +1,65 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"strings"
+
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// CordonNode marks the nodes unschedulable, or schedulable again if
+// cordon is false.
+func CordonNode(ctx context.Context, nodeNames string, cordon bool) (bool, string) {
+	nodelist, err := selectNodes(nodeNames)
+	if err != nil {
+		return false, err.Error()
+	}
+	if len(nodelist) == 0 {
+		return true, "No Nodes found"
+	}
+
+	audit.AddTargets(ctx, nodelist)
+	if allowed, message := rbac.CheckTargets(ctx, nodelist, ""); !allowed {
+		return false, message
+	}
+
+	command := "uncordon"
+	if cordon {
+		command = "cordon"
+	}
+
+	var failed []string
+	for _, node := range nodelist {
+		// salt host names are not identical with kubernetes node name.
+		hostname, err := tools.GetNodeName(node)
+		if err != nil {
+			failed = append(failed, node+": "+err.Error())
+			continue
+		}
+		success, message := tools.ExecuteCmd("kubectl",
+			"--kubeconfig=/etc/kubernetes/admin.conf", command, hostname)
+		if success != true {
+			failed = append(failed, node+": "+message)
+		}
+	}
+	if len(failed) > 0 {
+		return false, strings.Join(failed, "\n")
+	}
+	return true, ""
+}
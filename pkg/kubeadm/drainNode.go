@@ -0,0 +1,78 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// DrainNode drains the nodes one after the other and stops at the
+// first failure.
+func DrainNode(in *pb.DrainRequest, stream pb.Kubeadm_DrainNodeServer) error {
+	send := func(success bool, message string) error {
+		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+			return err
+		}
+		return nil
+	}
+
+	nodelist, err := selectNodes(in.NodeNames)
+	if err != nil {
+		return send(false, err.Error())
+	}
+	if len(nodelist) == 0 {
+		return send(true, "No Nodes found")
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		return send(false, message)
+	}
+
+	options := tools.DrainOptions{
+		Timeout:       in.Timeout,
+		GracePeriod:   in.GracePeriod,
+		PodSelector:   in.PodSelector,
+		KeepLocalData: in.KeepLocalData,
+		NoForce:       in.NoForce,
+	}
+
+	for _, node := range nodelist {
+		// salt host names are not identical with kubernetes node name.
+		hostname, err := tools.GetNodeName(node)
+		if err != nil {
+			return send(false, node+": "+err.Error())
+		}
+
+		if err := send(true, node+": draining..."); err != nil {
+			return err
+		}
+		success, message := tools.DrainNodeWithOptions(hostname, options, func(progress string) {
+			send(true, node+": "+progress)
+		})
+		if success != true {
+			return send(false, node+": "+message)
+		}
+		if err := send(true, node+": drained"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
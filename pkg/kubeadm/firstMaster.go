@@ -0,0 +1,86 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// firstMasterName returns the salt name of the first master, or
+// "localhost" if it is the machine kubicd is running on.
+func firstMasterName() string {
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	if len(firstMaster) == 0 {
+		return "localhost"
+	}
+	return firstMaster
+}
+
+// masterAvailable returns true if the master responds to salt and the
+// kubernetes node is Ready.
+func masterAvailable(master string) bool {
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", master, "test.ping")
+	if success != true || !strings.HasSuffix(strings.TrimSpace(message), ": True") {
+		return false
+	}
+	hostname, err := tools.GetNodeName(master)
+	if err != nil {
+		return false
+	}
+	ready, err := kubectlGetNode(hostname, "{.status.conditions[?(@.type==\"Ready\")].status}")
+	return err == nil && ready == "True"
+}
+
+// findFirstMaster returns the salt name of the first master, which
+// runs "kubeadm upgrade apply" and creates join tokens. An empty name
+// means the machine kubicd is running on. If the master recorded in
+// control-plane.conf was removed or is not available anymore, another
+// available master takes over; with record set it is stored as new
+// first master.
+func findFirstMaster(record bool) (string, error) {
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+	if len(firstMaster) == 0 {
+		return "", nil
+	}
+
+	success, message, masters := tools.GetListOfNodes("master")
+	if success != true {
+		return "", errors.New(message)
+	}
+	for i := range masters {
+		masters[i] = strings.TrimSpace(masters[i])
+	}
+	if contains(masters, firstMaster) && masterAvailable(firstMaster) {
+		return firstMaster, nil
+	}
+
+	for _, master := range masters {
+		if len(master) == 0 || master == firstMaster || !masterAvailable(master) {
+			continue
+		}
+		if record {
+			log.Warnf("First master %s is not available, %s takes over", firstMaster, master)
+			if err := update_cfg("control-plane.conf", "master", master); err != nil {
+				return "", err
+			}
+		}
+		return master, nil
+	}
+	return "", errors.New("First master " + firstMaster + " is not available and no other master can take over")
+}
@@ -28,8 +28,15 @@ func GetStatus(in *pb.Empty, stream pb.Kubeadm_GetStatusServer, kubicdVersion st
 		log.Errorf("Send message failed: %s", err)
 		return err
 	}
-	_, message := tools.GetKubeadmVersion("") // XXX needs better handling, per master via salt.
-	if err := stream.Send(&pb.StatusReply{Success: true,
+	// the master taking over if the first one is not available
+	firstMaster, err := findFirstMaster(false)
+	success, message := false, ""
+	if err != nil {
+		message = err.Error()
+	} else {
+		success, message = tools.GetKubeadmVersion(firstMaster)
+	}
+	if err := stream.Send(&pb.StatusReply{Success: success,
 		Message: "kubeadm version: " + message}); err != nil {
 		log.Errorf("Send message failed: %s", err)
 		return err
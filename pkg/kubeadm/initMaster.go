@@ -18,6 +18,7 @@ import (
 	"errors"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -64,7 +65,7 @@ func exists(path string, salt string) (bool, error) {
 		if success != true {
 			return false, errors.New(message)
 		}
-		if strings.HasSuffix(message, ": True") {
+		if strings.HasSuffix(strings.TrimSpace(message), ": True") {
 			return true, nil
 		} else {
 			return false, nil
@@ -143,6 +144,40 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		return nil
 	}
 
+	var haproxies []string
+	for _, lb := range strings.Split(in.Haproxy, ",") {
+		if lb = strings.TrimSpace(lb); len(lb) > 0 {
+			haproxies = append(haproxies, lb)
+		}
+	}
+	routerID := 0
+	if len(in.Vip) > 0 {
+		if err := checkVIP(in.Vip); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+		var err error
+		if routerID, err = vrrpRouterID(in.Vip, in.RouterId); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if len(in.MultiMaster) == 0 || len(haproxies) == 0 {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "A virtual IP requires --multi-master and --haproxy"}); err != nil {
+				return err
+			}
+			return nil
+		}
+	} else if in.RouterId != 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "A VRRP router id requires --vip"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
 	success, message := executeCmdSalt(arg_salt, "systemctl", "enable", "--now", "crio")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
@@ -164,11 +199,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
 			return err
 		}
-		if len(in.Haproxy) > 0 {
-			message = "Configure haproxy on node " + in.Haproxy
-			if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
-				return err
-			}
+		if len(haproxies) > 0 {
 			hostname, err := os.Hostname()
 			if err != nil {
 				if err2 := stream.Send(&pb.StatusReply{Success: false,
@@ -178,13 +209,37 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 				}
 				return nil
 			}
-			success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", in.Haproxy, "cmd.run",
-				"\"haproxycfg init --force "+in.MultiMaster+" "+hostname+"\"")
-			if success != true {
-				if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			// only one haproxy can bind to the address of the DNS name
+			bind := ""
+			if len(haproxies) > 1 || len(in.Vip) > 0 {
+				bind = "--bind 0.0.0.0 "
+			}
+			for i, lb := range haproxies {
+				message = "Configure haproxy on node " + lb
+				if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
 					return err
 				}
-				return nil
+				success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "cmd.run",
+					"\"haproxycfg init --force "+bind+in.MultiMaster+" "+hostname+"\"")
+				if success != true {
+					if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+						return err
+					}
+					return nil
+				}
+				if len(in.Vip) > 0 {
+					message = "Configure keepalived for " + in.Vip + " with VRRP router id " + strconv.Itoa(routerID) + " on node " + lb
+					if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
+						return err
+					}
+					success, message = configureKeepalived(lb, in.Vip, routerID, keepalivedPriority(i))
+					if success != true {
+						if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+							return err
+						}
+						return nil
+					}
+				}
 			}
 		}
 	} else {
@@ -201,12 +256,13 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		kubeadm_args = append(kubeadm_args, "--pod-network-cidr=10.244.0.0/16")
 	}
 
-	if len(in.Stage) > 0 {
+	image_repository := in.ImageRepository
+	if len(image_repository) == 0 && len(in.Stage) > 0 {
 		if strings.EqualFold(in.Stage, "devel") {
 			if runtime.GOARCH == "amd64" {
-				kubeadm_args = append(kubeadm_args, "--image-repository=registry.opensuse.org/devel/kubic/containers/container/kubic")
+				image_repository = "registry.opensuse.org/devel/kubic/containers/container/kubic"
 			} else if runtime.GOARCH == "arm64" {
-				kubeadm_args = append(kubeadm_args, "--image-repository=registry.opensuse.org/devel/kubic/containers/container_arm/kubic")
+				image_repository = "registry.opensuse.org/devel/kubic/containers/container_arm/kubic"
 			} else {
 				message = "Unknown architecture '" + runtime.GOARCH + "', no devel project known, using standard one"
 				if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
@@ -214,9 +270,17 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 				}
 			}
 		} else if !strings.EqualFold(in.Stage, "official") {
-			/* Ugly hack, we will use the argument as pointer to a registry */
-			kubeadm_args = append(kubeadm_args, "--image-repository="+in.Stage)
+			// Stage used to be the only way to specify a registry,
+			// still accept it for compatibility
+			image_repository = in.Stage
+		}
+	}
+
+	if len(image_repository) > 0 && !imageReference.MatchString(image_repository) {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid image repository '" + image_repository + "'"}); err != nil {
+			return err
 		}
+		return nil
 	}
 
 	kubernetes_version := ""
@@ -234,6 +298,7 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 	}
 	update_cfg("control-plane.conf", "version", kubernetes_version)
 	update_cfg("control-plane.conf", "master", arg_salt)
+	update_cfg("control-plane.conf", "image_repository", image_repository)
 
 	if len(in.MultiMaster) > 0 {
 		os.MkdirAll("/var/lib/kubic-control/multi-master", os.ModePerm)
@@ -248,7 +313,18 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		}
 		defer f.Close()
 
-		_, err = f.WriteString("apiVersion: kubeadm.k8s.io/v1beta2\nkind: ClusterConfiguration\nkubernetesVersion: " + kubernetes_version + "\ncontrolPlaneEndpoint: \"" + in.MultiMaster + ":6443\"\n")
+		// with a virtual IP, the API is reachable with it and the DNS name
+		endpoint := in.MultiMaster
+		var certSANs []string
+		if len(in.Vip) > 0 {
+			endpoint = vipAddress(in.Vip)
+			certSANs = append(certSANs, in.MultiMaster)
+		}
+		if len(in.ApiserverCertExtraSans) > 0 {
+			certSANs = append(certSANs, in.ApiserverCertExtraSans)
+		}
+
+		_, err = f.WriteString("apiVersion: kubeadm.k8s.io/v1beta2\nkind: ClusterConfiguration\nkubernetesVersion: " + kubernetes_version + "\ncontrolPlaneEndpoint: \"" + endpoint + ":6443\"\n")
 		if err != nil {
 			ResetMaster()
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
@@ -257,7 +333,18 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 			return nil
 		}
 
-		if len(in.ApiserverCertExtraSans) > 0 || len(in.AdvAddr) > 0 {
+		if len(image_repository) > 0 {
+			_, err = f.WriteString("imageRepository: " + image_repository + "\n")
+			if err != nil {
+				ResetMaster()
+				if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+					return err
+				}
+				return nil
+			}
+		}
+
+		if len(certSANs) > 0 || len(in.AdvAddr) > 0 {
 			_, err = f.WriteString("apiServer:\n")
 			if err != nil {
 				ResetMaster()
@@ -267,8 +354,8 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 				return nil
 			}
 
-			if len(in.ApiserverCertExtraSans) > 0 {
-				_, err = f.WriteString("  certSANs:\n    - " + in.ApiserverCertExtraSans + "\n")
+			if len(certSANs) > 0 {
+				_, err = f.WriteString("  certSANs:\n    - " + strings.Join(certSANs, "\n    - ") + "\n")
 				if err != nil {
 					ResetMaster()
 					if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
@@ -293,8 +380,13 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 
 		update_cfg("control-plane.conf", "MultiMaster", "True")
 		update_cfg("control-plane.conf", "loadbalancer_dns", in.MultiMaster)
-		if len(in.Haproxy) > 0 {
-			update_cfg("control-plane.conf", "loadbalancer_salt", in.Haproxy)
+		update_cfg("control-plane.conf", "control_plane_endpoint", endpoint)
+		if len(haproxies) > 0 {
+			update_cfg("control-plane.conf", "loadbalancer_salt", strings.Join(haproxies, ","))
+		}
+		if len(in.Vip) > 0 {
+			update_cfg("control-plane.conf", "vip", in.Vip)
+			update_cfg("control-plane.conf", "router_id", strconv.Itoa(routerID))
 		}
 
 		kubeadm_args = append(kubeadm_args,
@@ -307,6 +399,10 @@ func InitMaster(in *pb.InitRequest, stream pb.Kubeadm_InitMasterServer) error {
 		// --kubernetes-version if we don't use a config file.
 		kubeadm_args = append(kubeadm_args, "--kubernetes-version="+kubernetes_version)
 
+		if len(image_repository) > 0 {
+			kubeadm_args = append(kubeadm_args, "--image-repository="+image_repository)
+		}
+
 		if len(in.AdvAddr) > 0 {
 			kubeadm_args = append(kubeadm_args, "--apiserver-advertise-address="+in.AdvAddr)
 		}
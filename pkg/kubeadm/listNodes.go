@@ -22,3 +22,14 @@ func ListNodes() (bool, string, []string) {
 	// Get list of all worker nodes:
 	return tools.GetListOfNodes("worker")
 }
+
+func ListMasters() (bool, string, []string) {
+	// Get list of all master nodes:
+	return tools.GetListOfNodes("master")
+}
+
+func ListMinions() (bool, string, []string) {
+	// Get list of all minions known to the salt master, with or
+	// without role in the cluster
+	return tools.GetListOfMinions()
+}
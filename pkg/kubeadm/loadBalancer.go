@@ -0,0 +1,464 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// How long haproxy gets until the API is reachable through it, the
+// backend checks need some time until a server is considered up.
+const loadBalancerTimeout = 2 * time.Minute
+
+// loadBalancers returns the salt names of the haproxy minions in front
+// of the API servers.
+func loadBalancers() []string {
+	var result []string
+	for _, lb := range strings.Split(Read_Cfg("control-plane.conf", "loadbalancer_salt"), ",") {
+		lb = strings.TrimSpace(lb)
+		if len(lb) > 0 {
+			result = append(result, lb)
+		}
+	}
+	return result
+}
+
+// vipAddress returns the virtual IP without prefix length.
+func vipAddress(vip string) string {
+	return strings.SplitN(vip, "/", 2)[0]
+}
+
+// checkVIP verifies that vip is a valid IPv4 address with optional
+// prefix length. keepalived.conf is written for VRRPv2, which cannot
+// carry IPv6 addresses.
+func checkVIP(vip string) error {
+	ip := net.ParseIP(vipAddress(vip))
+	if ip == nil {
+		return errors.New("Invalid virtual IP '" + vip + "'")
+	}
+	if ip.To4() == nil {
+		return errors.New("Virtual IP '" + vip + "' is no IPv4 address, only IPv4 is supported")
+	}
+	return nil
+}
+
+// vrrpRouterID returns the VRRP router id of the virtual IP. Without
+// an id given, one between 1 and 255 is derived from the address, so
+// that clusters with different virtual IPs in the same network segment
+// do not share the router id.
+func vrrpRouterID(vip string, id int32) (int, error) {
+	if id == 0 {
+		h := fnv.New32a()
+		h.Write([]byte(vipAddress(vip)))
+		return int(h.Sum32()%255) + 1, nil
+	}
+	if id < 1 || id > 255 {
+		return 0, errors.New("Invalid VRRP router id " + strconv.Itoa(int(id)) + ", must be between 1 and 255")
+	}
+	return int(id), nil
+}
+
+// keepalivedPriority returns the VRRP priority of the i-th haproxy
+// minion, the first one holds the virtual IP as long as it is healthy.
+func keepalivedPriority(i int) int {
+	priority := 150 - 10*i
+	if priority < 1 {
+		priority = 1
+	}
+	return priority
+}
+
+// configureKeepalived writes keepalived.conf on the haproxy minion and
+// restarts keepalived.
+func configureKeepalived(lb string, vip string, routerID int, priority int) (bool, string) {
+	return tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "cmd.run",
+		"\"haproxycfg keepalived --router-id "+strconv.Itoa(routerID)+" --priority "+strconv.Itoa(priority)+" "+vip+"\"")
+}
+
+// loadBalancerService is a service on the haproxy minions changed by
+// UpdateLoadBalancer.
+type loadBalancerService struct {
+	name   string
+	config string
+}
+
+// loadBalancerServices returns the services UpdateLoadBalancer changes,
+// keepalived only with a virtual IP.
+func loadBalancerServices(vip string) []loadBalancerService {
+	services := []loadBalancerService{{"haproxy", "/etc/haproxy/haproxy.cfg"}}
+	if len(vip) > 0 {
+		services = append(services, loadBalancerService{"keepalived", "/etc/keepalived/keepalived.conf"})
+	}
+	return services
+}
+
+// backupLoadBalancer keeps a copy of the configuration of the services
+// on the minion, so that restoreLoadBalancer can undo the changes.
+func backupLoadBalancer(lb string, services []loadBalancerService) error {
+	var script []string
+	for _, service := range services {
+		script = append(script, "rm -f "+service.config+".kubicd-backup && if [ -e "+service.config+" ]; then cp -p "+
+			service.config+" "+service.config+".kubicd-backup; fi")
+	}
+	return runRetcode(lb, "sh -c '"+strings.Join(script, " && ")+"'")
+}
+
+// restoreLoadBalancer restores the configuration saved by
+// backupLoadBalancer and restarts the services, services without
+// configuration before are stopped again.
+func restoreLoadBalancer(lb string, services []loadBalancerService) error {
+	var script []string
+	for _, service := range services {
+		script = append(script, "if [ -e "+service.config+".kubicd-backup ]; then mv -f "+service.config+".kubicd-backup "+
+			service.config+" && systemctl restart "+service.name+"; else rm -f "+service.config+
+			" && systemctl disable --now "+service.name+"; fi")
+	}
+	return runRetcode(lb, "sh -c '"+strings.Join(script, " && ")+"'")
+}
+
+// removeLoadBalancerBackup removes the copies of backupLoadBalancer.
+func removeLoadBalancerBackup(lb string, services []loadBalancerService) {
+	var files []string
+	for _, service := range services {
+		files = append(files, service.config+".kubicd-backup")
+	}
+	tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "cmd.run", "rm -f "+strings.Join(files, " "))
+}
+
+// configureLoadBalancer writes haproxy.cfg for the masters and, with
+// a virtual IP, keepalived.conf on the minion and waits until the API
+// is reachable through it.
+func configureLoadBalancer(stream pb.Kubeadm_UpdateLoadBalancerServer, lb string, dns string, servers []string, vip string, routerID int, priority int) error {
+	// The DNS name may still point to another haproxy, listen on all
+	// addresses so that every minion can serve the API
+	stream.Send(&pb.StatusReply{Success: true, Message: lb + ": writing haproxy.cfg for " + strings.Join(servers, ", ") + "..."})
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "cmd.run",
+		"\"haproxycfg init --force --bind 0.0.0.0 "+dns+" "+strings.Join(servers, " ")+"\"")
+	if success != true {
+		return errors.New(message)
+	}
+	if err := checkLoadBalancer(stream.Context(), lb); err != nil {
+		return err
+	}
+	if len(vip) > 0 {
+		stream.Send(&pb.StatusReply{Success: true, Message: lb + ": configuring keepalived for " + vip + "..."})
+		if success, message := configureKeepalived(lb, vip, routerID, priority); success != true {
+			return errors.New(message)
+		}
+	}
+	return nil
+}
+
+// restoreLoadBalancers undoes the changes on the minions and starts
+// keepalived again on the removed ones. It returns a message listing
+// the restored minions or the ones which could not be restored.
+func restoreLoadBalancers(stream pb.Kubeadm_UpdateLoadBalancerServer, services []loadBalancerService, changed []string, stopped []string) string {
+	if len(changed) == 0 && len(stopped) == 0 {
+		return "no minion was changed"
+	}
+	var restored, notRestored []string
+	for _, lb := range changed {
+		if err := restoreLoadBalancer(lb, services); err != nil {
+			stream.Send(&pb.StatusReply{Success: false, Message: lb + ": restoring configuration failed: " + err.Error()})
+			notRestored = append(notRestored, lb)
+			continue
+		}
+		restored = append(restored, lb)
+		stream.Send(&pb.StatusReply{Success: true, Message: lb + ": previous configuration restored"})
+	}
+	for _, lb := range stopped {
+		if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "service.enable", "keepalived"); success != true {
+			stream.Send(&pb.StatusReply{Success: false, Message: lb + ": enabling keepalived failed: " + message})
+			notRestored = append(notRestored, lb)
+			continue
+		}
+		if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "service.start", "keepalived"); success != true {
+			stream.Send(&pb.StatusReply{Success: false, Message: lb + ": starting keepalived failed: " + message})
+			notRestored = append(notRestored, lb)
+			continue
+		}
+		restored = append(restored, lb)
+		stream.Send(&pb.StatusReply{Success: true, Message: lb + ": keepalived started again"})
+	}
+	if len(notRestored) == 0 {
+		return "previous configuration restored on " + strings.Join(restored, ", ")
+	}
+	return "changed but not restored: " + strings.Join(notRestored, ", ") + ", check them manually"
+}
+
+// apiServers returns the names of all masters as used in the haproxy
+// backend.
+func apiServers() ([]string, error) {
+	var servers []string
+
+	// a first master without salt is the machine kubicd runs on
+	if len(Read_Cfg("control-plane.conf", "master")) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.New("Could not get hostname: " + err.Error())
+		}
+		servers = append(servers, hostname)
+	}
+	success, message, masters := tools.GetListOfNodes("master")
+	if success != true {
+		return nil, errors.New(message)
+	}
+	for _, master := range masters {
+		master = strings.TrimSpace(master)
+		if len(master) > 0 && !contains(servers, master) {
+			servers = append(servers, master)
+		}
+	}
+	return servers, nil
+}
+
+// checkLoadBalancer waits until the API server answers through the
+// haproxy on the minion.
+func checkLoadBalancer(ctx context.Context, lb string) error {
+	deadline := time.Now().Add(loadBalancerTimeout)
+	for {
+		err := runRetcode(lb, "curl -fsk --max-time 10 https://localhost:6443/healthz")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("API server not reachable through haproxy: " + err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// waitForVIP waits until the API server answers on the virtual IP.
+func waitForVIP(ctx context.Context, vip string) error {
+	deadline := time.Now().Add(loadBalancerTimeout)
+	for {
+		success, message := tools.ExecuteCmd("curl", "-fsk", "--max-time", "10", "https://"+vipAddress(vip)+":6443/healthz")
+		if success {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("API server not reachable on virtual IP " + vip + ": " + message)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// UpdateLoadBalancer adds haproxy minions in front of the API servers
+// or removes them. The haproxy.cfg of all remaining minions is written
+// again with the current masters and the API is checked through every
+// one of them before control-plane.conf is changed. If one minion
+// fails, the previous configuration of all changed minions is restored.
+func UpdateLoadBalancer(in *pb.LoadBalancerRequest, stream pb.Kubeadm_UpdateLoadBalancerServer) error {
+	dns := Read_Cfg("control-plane.conf", "loadbalancer_dns")
+	if !strings.EqualFold(Read_Cfg("control-plane.conf", "MultiMaster"), "True") || len(dns) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cluster was not initialized with a load balancer (--multi-master)"}); err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(in.Add) == 0 && len(in.Remove) == 0 && len(in.Vip) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "No haproxy minions to add or remove"}); err != nil {
+			return err
+		}
+		return nil
+	}
+	vip := in.Vip
+	if len(vip) == 0 {
+		vip = Read_Cfg("control-plane.conf", "vip")
+	} else if err := checkVIP(vip); err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	// keep the router id recorded at init, all minions of the
+	// virtual IP need the same one
+	routerID := 0
+	if len(vip) > 0 {
+		id := in.RouterId
+		if id == 0 {
+			if stored, err := strconv.Atoi(Read_Cfg("control-plane.conf", "router_id")); err == nil {
+				id = int32(stored)
+			}
+		}
+		var err error
+		if routerID, err = vrrpRouterID(vip, id); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	} else if in.RouterId != 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "A VRRP router id requires a virtual IP"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	current := loadBalancers()
+	var remove []string
+	for _, lb := range in.Remove {
+		lb = strings.TrimSpace(lb)
+		if len(lb) == 0 {
+			continue
+		}
+		if !contains(current, lb) {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: lb + " is no haproxy minion of the cluster"}); err != nil {
+				return err
+			}
+			return nil
+		}
+		remove = append(remove, lb)
+	}
+	// The minions keep the priority of their position in the current
+	// list, new ones get lower ones, so that the minion holding the
+	// virtual IP keeps it
+	var balancers []string
+	priorities := make(map[string]int)
+	for i, lb := range current {
+		if !contains(remove, lb) {
+			balancers = append(balancers, lb)
+			priorities[lb] = keepalivedPriority(i)
+		}
+	}
+	next := len(current)
+	for _, lb := range in.Add {
+		lb = strings.TrimSpace(lb)
+		if len(lb) > 0 && !contains(balancers, lb) {
+			balancers = append(balancers, lb)
+			priorities[lb] = keepalivedPriority(next)
+			next++
+		}
+	}
+	if len(balancers) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot remove the last haproxy minion"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	audit.AddTargets(stream.Context(), balancers)
+	if allowed, message := rbac.CheckTargets(stream.Context(), balancers, "haproxy"); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	servers, err := apiServers()
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// All minions are changed first and control-plane.conf only if
+	// every one of them works, else all of them are restored
+	services := loadBalancerServices(vip)
+	var changed []string
+	failed := ""
+	for _, lb := range balancers {
+		if err := backupLoadBalancer(lb, services); err != nil {
+			stream.Send(&pb.StatusReply{Success: false, Message: lb + ": saving configuration failed: " + err.Error()})
+			failed = lb
+			break
+		}
+		changed = append(changed, lb)
+		if err := configureLoadBalancer(stream, lb, dns, servers, vip, routerID, priorities[lb]); err != nil {
+			stream.Send(&pb.StatusReply{Success: false, Message: lb + ": " + err.Error()})
+			failed = lb
+			break
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: lb + ": API server reachable"}); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		message := "Update of load balancers failed on " + failed + ", " +
+			restoreLoadBalancers(stream, services, changed, nil)
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	var stopped []string
+	for _, lb := range current {
+		if contains(balancers, lb) {
+			continue
+		}
+		// a removed minion must not hold the virtual IP anymore
+		if len(vip) > 0 {
+			tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "service.stop", "keepalived")
+			tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", lb, "service.disable", "keepalived")
+			stopped = append(stopped, lb)
+			stream.Send(&pb.StatusReply{Success: true, Message: lb + ": no longer used as load balancer, keepalived stopped, haproxy is still running"})
+		} else {
+			stream.Send(&pb.StatusReply{Success: true, Message: lb + ": no longer used as load balancer, haproxy is still running"})
+		}
+	}
+
+	if len(vip) > 0 {
+		if err := waitForVIP(stream.Context(), vip); err != nil {
+			message := "Update of load balancers failed, " + err.Error() + ", " + restoreLoadBalancers(stream, services, changed, stopped)
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+				return err
+			}
+			return nil
+		}
+		update_cfg("control-plane.conf", "vip", vip)
+		update_cfg("control-plane.conf", "router_id", strconv.Itoa(routerID))
+	}
+	for _, lb := range changed {
+		removeLoadBalancerBackup(lb, services)
+	}
+	update_cfg("control-plane.conf", "loadbalancer_salt", strings.Join(balancers, ","))
+
+	message := "Load balancers: " + strings.Join(balancers, ", ") + ", make sure " + dns + " resolves to them"
+	if len(vip) > 0 {
+		message = "Load balancers: " + strings.Join(balancers, ", ") + " sharing virtual IP " + vip +
+			" with VRRP router id " + strconv.Itoa(routerID)
+		// the endpoint of clusters set up without virtual IP is the
+		// DNS name
+		if Read_Cfg("control-plane.conf", "control_plane_endpoint") != vipAddress(vip) {
+			message = message + ", make sure " + dns + " resolves to it"
+		}
+	}
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
+		return err
+	}
+	return nil
+}
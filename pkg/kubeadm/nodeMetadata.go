@@ -0,0 +1,300 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+)
+
+// The desired labels, taints and node-role of every node, a section
+// per salt minion. They are kept if a node is removed, so that they
+// are applied again if the node is added again.
+const nodeMetadataFile = "/var/lib/kubic-control/node-metadata.conf"
+
+var (
+	nodeMetadataMutex sync.Mutex
+
+	labelRegexp = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_./]*)(=[-A-Za-z0-9_.]*|-)$`)
+	// the key is matched lazily, so that the "-" of "key-" is the
+	// removal and not part of the key
+	taintRegexp = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_./]*?)(=[-A-Za-z0-9_.]*)?(:(NoSchedule|PreferNoSchedule|NoExecute))?(-)?$`)
+	// node-role labels in the output of "kubectl get node -o jsonpath={.metadata.labels}"
+	nodeRoleRegexp = regexp.MustCompile(`"node-role.kubernetes.io/([^"]+)"`)
+)
+
+type nodeMetadata struct {
+	Role   string
+	Labels map[string]string
+	// key=value:Effect
+	Taints []string
+}
+
+func loadNodeMetadata(cfg *ini.File, node string) *nodeMetadata {
+	md := &nodeMetadata{Labels: make(map[string]string)}
+	section, err := cfg.GetSection(node)
+	if err != nil {
+		return md
+	}
+
+	md.Role = section.Key("role").String()
+	for _, label := range section.Key("labels").Strings(",") {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) == 2 {
+			md.Labels[kv[0]] = kv[1]
+		}
+	}
+	md.Taints = section.Key("taints").Strings(",")
+	return md
+}
+
+func (md *nodeMetadata) save(cfg *ini.File, node string) {
+	var labels []string
+	for key, value := range md.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+
+	section := cfg.Section(node)
+	section.Key("role").SetValue(md.Role)
+	section.Key("labels").SetValue(strings.Join(labels, ","))
+	section.Key("taints").SetValue(strings.Join(md.Taints, ","))
+}
+
+func (md *nodeMetadata) empty() bool {
+	return len(md.Role) == 0 && len(md.Labels) == 0 && len(md.Taints) == 0
+}
+
+// checkMetadata verifies the syntax of labels and taints like kubectl
+// expects it: "key=value" to set and "key-" to remove a label,
+// "key=value:Effect" to set and "key:Effect-" or "key-" to remove a
+// taint.
+func checkMetadata(labels []string, taints []string) error {
+	for _, label := range labels {
+		if !labelRegexp.MatchString(label) {
+			return errors.New("Invalid label '" + label + "', expected key=value or key-")
+		}
+	}
+	for _, taint := range taints {
+		m := taintRegexp.FindStringSubmatch(taint)
+		if m == nil || (len(m[5]) == 0 && len(m[4]) == 0) {
+			return errors.New("Invalid taint '" + taint + "', expected key=value:Effect, key:Effect- or key-")
+		}
+	}
+	return nil
+}
+
+// taintKey returns key and effect of a taint.
+func taintKey(taint string) (string, string) {
+	m := taintRegexp.FindStringSubmatch(taint)
+	if m == nil {
+		return taint, ""
+	}
+	return m[1], m[4]
+}
+
+// merge applies the changes to the desired metadata.
+func (md *nodeMetadata) merge(role string, labels []string, taints []string) {
+	if len(role) > 0 {
+		if role == "-" {
+			md.Role = ""
+		} else {
+			md.Role = role
+		}
+	}
+	for _, label := range labels {
+		if strings.HasSuffix(label, "-") {
+			delete(md.Labels, strings.TrimSuffix(label, "-"))
+			continue
+		}
+		kv := strings.SplitN(label, "=", 2)
+		md.Labels[kv[0]] = kv[1]
+	}
+	for _, taint := range taints {
+		key, effect := taintKey(taint)
+		var kept []string
+		for _, current := range md.Taints {
+			currentKey, currentEffect := taintKey(current)
+			if currentKey != key || (len(effect) > 0 && currentEffect != effect) {
+				kept = append(kept, current)
+			}
+		}
+		if !strings.HasSuffix(taint, "-") {
+			kept = append(kept, taint)
+		}
+		md.Taints = kept
+	}
+}
+
+// presentTaints returns the taint removals of taints matching a taint
+// of the node. kubectl fails on removing a taint which does not exist.
+func presentTaints(hostname string, taints []string) ([]string, error) {
+	var removals []string
+	for _, taint := range taints {
+		if strings.HasSuffix(taint, "-") {
+			removals = append(removals, taint)
+		}
+	}
+	if len(removals) == 0 {
+		return nil, nil
+	}
+
+	output, err := kubectlGetNode(hostname, "{.spec.taints}")
+	if err != nil {
+		return nil, err
+	}
+	var current []struct {
+		Key    string `json:"key"`
+		Effect string `json:"effect"`
+	}
+	if len(output) > 0 {
+		if err := json.Unmarshal([]byte(output), &current); err != nil {
+			return nil, errors.New("Cannot parse taints of " + hostname + ": " + err.Error())
+		}
+	}
+
+	var present []string
+	for _, removal := range removals {
+		key, effect := taintKey(removal)
+		for _, t := range current {
+			if t.Key == key && (len(effect) == 0 || t.Effect == effect) {
+				present = append(present, removal)
+				break
+			}
+		}
+	}
+	return present, nil
+}
+
+// applyNodeMetadata sets the desired metadata of the node in
+// kubernetes. Labels and taints removed with "-" are removed, too.
+func applyNodeMetadata(node string, md *nodeMetadata, labels []string, taints []string) error {
+	hostname, err := tools.GetNodeName(node)
+	if err != nil {
+		return err
+	}
+
+	var labelArgs []string
+	for key, value := range md.Labels {
+		labelArgs = append(labelArgs, key+"="+value)
+	}
+	for _, label := range labels {
+		if strings.HasSuffix(label, "-") {
+			labelArgs = append(labelArgs, label)
+		}
+	}
+	// only one node-role label is managed by kubicd, the ones of
+	// kubeadm for the control plane are kept
+	current, _ := kubectlGetNode(hostname, "{.metadata.labels}")
+	for _, entry := range nodeRoleRegexp.FindAllStringSubmatch(current, -1) {
+		if entry[1] != md.Role && entry[1] != "master" && entry[1] != "control-plane" {
+			labelArgs = append(labelArgs, "node-role.kubernetes.io/"+entry[1]+"-")
+		}
+	}
+	if len(md.Role) > 0 {
+		labelArgs = append(labelArgs, "node-role.kubernetes.io/"+md.Role+"=")
+	}
+	if len(labelArgs) > 0 {
+		args := append([]string{"--kubeconfig=/etc/kubernetes/admin.conf", "label", "node", hostname, "--overwrite"}, labelArgs...)
+		if success, message := tools.ExecuteCmd("kubectl", args...); success != true {
+			return errors.New(message)
+		}
+	}
+
+	taintArgs := append([]string{}, md.Taints...)
+	removals, err := presentTaints(hostname, taints)
+	if err != nil {
+		return err
+	}
+	taintArgs = append(taintArgs, removals...)
+	if len(taintArgs) > 0 {
+		args := append([]string{"--kubeconfig=/etc/kubernetes/admin.conf", "taint", "node", hostname, "--overwrite"}, taintArgs...)
+		if success, message := tools.ExecuteCmd("kubectl", args...); success != true {
+			return errors.New(message)
+		}
+	}
+	return nil
+}
+
+// updateNodeMetadata merges the changes into the stored metadata of
+// the node, saves and applies it.
+func updateNodeMetadata(node string, role string, labels []string, taints []string) error {
+	nodeMetadataMutex.Lock()
+	cfg, err := ini.LooseLoad(nodeMetadataFile)
+	if err != nil {
+		nodeMetadataMutex.Unlock()
+		return err
+	}
+	md := loadNodeMetadata(cfg, node)
+	md.merge(role, labels, taints)
+	if md.empty() {
+		cfg.DeleteSection(node)
+	} else {
+		md.save(cfg, node)
+	}
+	err = cfg.SaveTo(nodeMetadataFile)
+	nodeMetadataMutex.Unlock()
+	if err != nil {
+		return errors.New("Cannot write node-metadata.conf: " + err.Error())
+	}
+
+	if md.empty() && len(labels) == 0 && len(taints) == 0 && len(role) == 0 {
+		return nil
+	}
+	return applyNodeMetadata(node, md, labels, taints)
+}
+
+// UpdateNodeMetadata changes labels, taints and node-role of the
+// nodes. Without changes, the stored metadata is applied again.
+func UpdateNodeMetadata(ctx context.Context, in *pb.NodeMetadataRequest) (bool, string) {
+	if err := checkMetadata(in.Labels, in.Taints); err != nil {
+		return false, err.Error()
+	}
+
+	nodelist, err := selectNodes(in.NodeNames)
+	if err != nil {
+		return false, err.Error()
+	}
+	if len(nodelist) == 0 {
+		return true, "No Nodes found"
+	}
+
+	audit.AddTargets(ctx, nodelist)
+	if allowed, message := rbac.CheckTargets(ctx, nodelist, ""); !allowed {
+		return false, message
+	}
+
+	var failed []string
+	for _, node := range nodelist {
+		if err := updateNodeMetadata(node, in.NodeRole, in.Labels, in.Taints); err != nil {
+			failed = append(failed, node+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return false, strings.Join(failed, "\n")
+	}
+	return true, ""
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// kernel modules and sysctls kubernetes needs on every node
+var (
+	preflightModules = []string{"br_netfilter", "overlay"}
+	preflightSysctls = []string{"net.ipv4.ip_forward", "net.bridge.bridge-nf-call-iptables"}
+)
+
+// preflightEnv is the state of the cluster the nodes are checked
+// against.
+type preflightEnv struct {
+	// major.minor of the running control plane
+	version string
+	// host and port of the API server
+	endpoint string
+}
+
+type preflightCheck struct {
+	name  string
+	check func(node string, env *preflightEnv) error
+}
+
+var preflightChecks = []preflightCheck{
+	{"kubelet.conf", checkKubeletConf},
+	{"packages", checkPackages},
+	{"swap", checkSwap},
+	{"kernel modules", checkModules},
+	{"sysctls", checkSysctls},
+	{"time sync", checkTimeSync},
+	{"API endpoint", checkEndpoint},
+}
+
+// saltRun runs the shell command on the node and returns the output
+// without the minion name.
+func saltRun(node string, command string) (string, error) {
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", node, "cmd.run", command)
+	if success != true {
+		return "", errors.New(message)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(message, node+":")), nil
+}
+
+// majorMinor returns "1.18" for "v1.18.3".
+func majorMinor(version string) string {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+func checkKubeletConf(node string, env *preflightEnv) error {
+	found, err := exists("/etc/kubernetes/kubelet.conf", node)
+	if err != nil {
+		return err
+	}
+	if found {
+		return errors.New("/etc/kubernetes/kubelet.conf exists, node is already part of a cluster")
+	}
+	return nil
+}
+
+func checkPackages(node string, env *preflightEnv) error {
+	if len(env.version) == 0 {
+		return nil
+	}
+	versions, err := packageVersions([]string{node})
+	if err != nil {
+		return err
+	}
+	for _, pkg := range []string{"kubernetes-kubeadm", "kubernetes-kubelet"} {
+		version := versions[node][pkg]
+		if len(version) == 0 {
+			return errors.New(pkg + " is not installed")
+		}
+		if majorMinor(version) != env.version {
+			return errors.New(pkg + " " + version + " doesn't match the control plane version " + env.version)
+		}
+	}
+	return nil
+}
+
+func checkSwap(node string, env *preflightEnv) error {
+	swap, err := saltRun(node, "swapon --show=NAME --noheadings")
+	if err != nil {
+		return err
+	}
+	if len(swap) > 0 {
+		return errors.New("swap is enabled: " + strings.Join(strings.Fields(swap), ", "))
+	}
+	return nil
+}
+
+func checkModules(node string, env *preflightEnv) error {
+	missing, err := saltRun(node, "for m in "+strings.Join(preflightModules, " ")+"; do [ -d /sys/module/$m ] || echo $m; done")
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New("kernel modules not loaded: " + strings.Join(strings.Fields(missing), ", "))
+	}
+	return nil
+}
+
+func checkSysctls(node string, env *preflightEnv) error {
+	var wrong []string
+	for _, sysctl := range preflightSysctls {
+		value, err := saltRun(node, "sysctl -n "+sysctl)
+		if err != nil || value != "1" {
+			wrong = append(wrong, sysctl)
+		}
+	}
+	if len(wrong) > 0 {
+		return errors.New("sysctls not set to 1: " + strings.Join(wrong, ", "))
+	}
+	return nil
+}
+
+func checkTimeSync(node string, env *preflightEnv) error {
+	synced, err := saltRun(node, "timedatectl show -p NTPSynchronized --value")
+	if err != nil {
+		return err
+	}
+	if synced != "yes" {
+		return errors.New("time is not synchronized")
+	}
+	return nil
+}
+
+func checkEndpoint(node string, env *preflightEnv) error {
+	if len(env.endpoint) == 0 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(env.endpoint)
+	if err != nil {
+		// no port, e.g. "[::1]"
+		host, port = strings.Trim(env.endpoint, "[]"), "443"
+	}
+	// the exit status of cmd.run is not reliable, check the output
+	output, err := saltRun(node, "timeout 5 bash -c '</dev/tcp/"+host+"/"+port+"' && echo ok")
+	if err != nil || output != "ok" {
+		return errors.New("API endpoint " + env.endpoint + " is not reachable")
+	}
+	return nil
+}
+
+// newPreflightEnv reads the version of the control plane and the API
+// endpoint. Checks depending on missing values are skipped.
+func newPreflightEnv() *preflightEnv {
+	env := &preflightEnv{}
+
+	if success, version := clusterVersion(); success {
+		env.version = majorMinor(version)
+	}
+	success, server := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"config", "view", "-o", "jsonpath={.clusters[0].cluster.server}")
+	if success {
+		if u, err := url.Parse(strings.TrimSpace(server)); err == nil {
+			env.endpoint = u.Host
+		}
+	}
+	return env
+}
+
+// preflight checks all nodes before anything is changed on them and
+// returns the failures per node.
+func preflight(nodelist []string) map[string][]string {
+	env := newPreflightEnv()
+	failures := make(map[string][]string)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	// the hostname is the name of the kubernetes node and needs to
+	// be unique
+	hostnames := make(map[string]string)
+	for _, node := range nodelist {
+		hostname, err := tools.GetNodeName(node)
+		if err != nil {
+			failures[node] = append(failures[node], "hostname: "+err.Error())
+			continue
+		}
+		if other, ok := hostnames[hostname]; ok {
+			failures[node] = append(failures[node], "hostname: "+hostname+" is also used by "+other)
+			continue
+		}
+		hostnames[hostname] = node
+		if _, err := kubectlGetNode(hostname, "{.metadata.name}"); err == nil {
+			failures[node] = append(failures[node], "hostname: node "+hostname+" already exists in the cluster")
+		}
+	}
+
+	for _, node := range nodelist {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			for _, c := range preflightChecks {
+				if err := c.check(node, env); err != nil {
+					mutex.Lock()
+					failures[node] = append(failures[node], c.name+": "+err.Error())
+					mutex.Unlock()
+				}
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	return failures
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Control plane images only running on masters, workers need the
+// other ones (kube-proxy, pause and coredns).
+var masterOnlyImages = []string{"kube-apiserver", "kube-controller-manager", "kube-scheduler", "etcd"}
+
+var (
+	// image references and registries are part of commands run in a
+	// shell on the nodes, only characters valid in them are allowed
+	imageReference = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/:@-]*$`)
+	// e.g. v1.18.6 or v1.19.0-rc.1
+	kubernetesVersion = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.]+)?$`)
+)
+
+// validVersion returns true if version is a kubernetes version.
+func validVersion(version string) bool {
+	return kubernetesVersion.MatchString(version) && parseVersion(version) != nil
+}
+
+// imageName returns the name of an image without registry and tag.
+func imageName(image string) string {
+	if i := strings.LastIndex(image, "/"); i >= 0 {
+		image = image[i+1:]
+	}
+	if i := strings.IndexAny(image, ":@"); i >= 0 {
+		image = image[:i]
+	}
+	return image
+}
+
+// controlPlaneImages returns the images kubeadm needs for the
+// kubernetes version, only the ones of workers if master is false.
+func controlPlaneImages(firstMaster string, kubernetes_version string, image_repository string, master bool) ([]string, error) {
+	args := []string{"config", "images", "list", "--kubernetes-version=" + kubernetes_version}
+	if len(image_repository) > 0 {
+		args = append(args, "--image-repository="+image_repository)
+	}
+	success, message := executeCmdSalt(firstMaster, "kubeadm", args...)
+	if success != true {
+		return nil, errors.New(message)
+	}
+
+	var images []string
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line)
+		// salt prefixes the output with "<minion>:"
+		if len(line) == 0 || strings.HasSuffix(line, ":") {
+			continue
+		}
+		if !master && contains(masterOnlyImages, imageName(line)) {
+			continue
+		}
+		images = append(images, line)
+	}
+	if len(images) == 0 {
+		return nil, errors.New("kubeadm did not report any images")
+	}
+	return images, nil
+}
+
+// manifestImages returns the container images referenced in a yaml
+// document stream.
+func manifestImages(data string) []string {
+	var images []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "- ")
+		if !strings.HasPrefix(line, "image:") {
+			continue
+		}
+		var value string
+		if err := yaml.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "image:"))), &value); err != nil {
+			continue
+		}
+		if len(value) > 0 {
+			images = append(images, value)
+		}
+	}
+	return images
+}
+
+// addonImages returns the images of all manifests and kustomize
+// services tracked by kubicd.
+func addonImages() []string {
+	var images []string
+
+	if cfg, err := ini.Load("/var/lib/kubic-control/k8s-yaml.conf"); err == nil {
+		for _, key := range cfg.Section("").KeyStrings() {
+			data, err := ioutil.ReadFile(key)
+			if err != nil {
+				continue
+			}
+			images = append(images, manifestImages(string(data))...)
+		}
+	}
+	if cfg, err := ini.Load("/var/lib/kubic-control/k8s-kustomize.conf"); err == nil {
+		for _, key := range cfg.Section("").KeyStrings() {
+			success, output := tools.ExecuteCmd("kustomize", "build",
+				"/var/lib/kubic-control/kustomize/"+key+"/overlay")
+			if success != true {
+				continue
+			}
+			images = append(images, manifestImages(output)...)
+		}
+	}
+	return images
+}
+
+// uniqueImages sorts the images and removes duplicates.
+func uniqueImages(images []string) []string {
+	sort.Strings(images)
+	var result []string
+	for i, image := range images {
+		if i == 0 || image != images[i-1] {
+			result = append(result, image)
+		}
+	}
+	return result
+}
+
+// runRetcode runs the command on the node and fails if the exit
+// status is not 0.
+func runRetcode(node string, command string) error {
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=json", "--static",
+		node, "cmd.retcode", command)
+	if success != true {
+		return errors.New(message)
+	}
+	var retcode map[string]int
+	if err := json.Unmarshal([]byte(message), &retcode); err != nil {
+		return errors.New("cannot parse salt output: " + err.Error())
+	}
+	if rc, ok := retcode[node]; !ok {
+		return errors.New("node did not respond")
+	} else if rc != 0 {
+		return errors.New("'" + command + "' failed")
+	}
+	return nil
+}
+
+// pullImages pulls the images with crictl on the node.
+func pullImages(node string, images []string) error {
+	for _, image := range images {
+		if !imageReference.MatchString(image) {
+			return errors.New("invalid image reference '" + image + "'")
+		}
+		if err := runRetcode(node, "crictl pull "+image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrepullImages pulls the control plane images and, if requested, the
+// images of the tracked add-ons on the selected nodes, so that later
+// operations do not depend on the registry being reachable.
+func PrepullImages(in *pb.PrepullRequest, stream pb.Kubeadm_PrepullImagesServer) error {
+	firstMaster := Read_Cfg("control-plane.conf", "master")
+
+	kubernetes_version := in.KubernetesVersion
+	if len(kubernetes_version) == 0 {
+		success, message := clusterVersion()
+		if success != true {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+				return err
+			}
+			return nil
+		}
+		kubernetes_version = message
+	}
+	if !validVersion(kubernetes_version) {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid kubernetes version '" + kubernetes_version + "'"}); err != nil {
+			return err
+		}
+		return nil
+	}
+	image_repository := in.ImageRepository
+	if len(image_repository) == 0 {
+		image_repository = Read_Cfg("control-plane.conf", "image_repository")
+	}
+	if len(image_repository) > 0 && !imageReference.MatchString(image_repository) {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid image repository '" + image_repository + "'"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	nodelist, err := targetNodes(in.NodeNames, in.Role, in.LabelSelector)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(nodelist) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "No Nodes found"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	success, message, masters := tools.GetListOfNodes("master")
+	if success != true {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for i := range masters {
+		masters[i] = strings.TrimSpace(masters[i])
+	}
+
+	// masters pull with kubeadm itself, workers only need some of
+	// the control plane images
+	workerImages, err := controlPlaneImages(firstMaster, kubernetes_version, image_repository, false)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot get list of images: " + err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	kubeadmPull := "kubeadm config images pull --kubernetes-version=" + kubernetes_version
+	if len(image_repository) > 0 {
+		kubeadmPull = kubeadmPull + " --image-repository=" + image_repository
+	}
+	var addons []string
+	if in.Addons {
+		addons = uniqueImages(addonImages())
+	}
+
+	stream.Send(&pb.StatusReply{Success: true, Message: "Pulling images for kubernetes " + kubernetes_version + " ..."})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failed []string
+
+	for _, node := range nodelist {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+
+			var err error
+			if contains(masters, node) {
+				err = runRetcode(node, kubeadmPull)
+			} else {
+				err = pullImages(node, workerImages)
+			}
+			if err == nil {
+				err = pullImages(node, addons)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failed = append(failed, node)
+				stream.Send(&pb.StatusReply{Success: false, Message: node + ": " + err.Error()})
+			} else {
+				stream.Send(&pb.StatusReply{Success: true, Message: node + ": images pulled"})
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Pulling images failed on " + strings.Join(failed, ", ")}); err != nil {
+			return err
+		}
+		return nil
+	}
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Images pulled on " + strings.Join(nodelist, ", ")}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -15,10 +15,19 @@
 package kubeadm
 
 import (
+	"context"
+
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
-func RebootNode(nodeName string) (bool, string) {
+func RebootNode(ctx context.Context, nodeName string) (bool, string) {
+
+	audit.AddTargets(ctx, []string{nodeName})
+	if allowed, message := rbac.CheckTargets(ctx, []string{nodeName}, ""); !allowed {
+		return false, message
+	}
 
 	// salt host names are not identical with kubernetes node name.
 	hostname, err := tools.GetNodeName(nodeName)
@@ -0,0 +1,173 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// The kubelet passes the credentials of its config.json to CRI-O for
+// pods, crictl and CRI-O itself use the global auth file.
+const (
+	kubeletAuthFile = "/var/lib/kubelet/config.json"
+	crioAuthFile    = "/etc/crio/auth.json"
+	crioAuthDropIn  = "/etc/crio/crio.conf.d/91-kubicd-auth.conf"
+)
+
+// renderAuthFile returns the credentials in the format of the docker
+// config.json.
+func renderAuthFile(credentials []*pb.RegistryCredential) ([]byte, error) {
+	type auth struct {
+		Auth string `json:"auth"`
+	}
+	auths := make(map[string]auth)
+	for _, c := range credentials {
+		if len(c.Registry) == 0 || strings.ContainsAny(c.Registry, " \t\n") {
+			return nil, errors.New("Invalid registry '" + c.Registry + "'")
+		}
+		if len(c.Username) == 0 || strings.Contains(c.Username, ":") {
+			return nil, errors.New("Invalid username for registry '" + c.Registry + "'")
+		}
+		if _, ok := auths[c.Registry]; ok {
+			return nil, errors.New("Duplicate credentials for registry '" + c.Registry + "'")
+		}
+		auths[c.Registry] = auth{Auth: base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))}
+	}
+	return json.MarshalIndent(map[string]map[string]auth{"auths": auths}, "", "  ")
+}
+
+// setRegistryCredentials writes or removes the auth files on the node,
+// restarts CRI-O and waits until the node is Ready again.
+func setRegistryCredentials(stream pb.Runtime_SetRegistryCredentialsServer, node string, data []byte, timeout time.Duration) error {
+	hostname, err := tools.GetNodeName(node)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "cmd.run",
+			"rm -f "+kubeletAuthFile+" "+crioAuthFile+" "+crioAuthDropIn); success != true {
+			return errors.New(message)
+		}
+	} else {
+		if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "cmd.run",
+			"mkdir -p /var/lib/kubelet /etc/crio/crio.conf.d"); success != true {
+			return errors.New(message)
+		}
+		if success, message := tools.CopySecretFileSalt(node, kubeletAuthFile, data, "0600"); success != true {
+			return errors.New(message)
+		}
+		if success, message := tools.CopySecretFileSalt(node, crioAuthFile, data, "0600"); success != true {
+			return errors.New(message)
+		}
+		dropIn := "# Generated by kubicd, do not edit\n[crio.image]\nglobal_auth_file = " + tomlString(crioAuthFile) + "\n"
+		if success, message := tools.WriteFileSalt(node, crioAuthDropIn, []byte(dropIn), "0644"); success != true {
+			return errors.New(message)
+		}
+	}
+
+	// kubelet is restarted after crio, so that it reports the state
+	// of the node at once
+	stream.Send(&pb.StatusReply{Success: true, Message: node + ": restarting crio and kubelet..."})
+	return restartServices(stream.Context(), node, hostname, []string{"crio", "kubelet"}, timeout)
+}
+
+// SetRegistryCredentials replaces the registry credentials of CRI-O
+// and the kubelet on the selected nodes with the ones of the request,
+// restarting CRI-O on one node after the other.
+func SetRegistryCredentials(in *pb.RegistryCredentialsRequest, stream pb.Runtime_SetRegistryCredentialsServer) error {
+	var data []byte
+	var err error
+
+	if len(in.Credentials) > 0 {
+		data, err = renderAuthFile(in.Credentials)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	timeout := 5 * time.Minute
+	if len(in.Timeout) > 0 {
+		timeout, err = time.ParseDuration(in.Timeout)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid timeout: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	nodelist, err := targetNodes(in.NodeNames, in.Role, in.LabelSelector)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	if len(nodelist) == 0 {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "No Nodes found"}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for i, node := range nodelist {
+		if err := setRegistryCredentials(stream, node, data, timeout); err != nil {
+			message := "Update of registry credentials stopped, failed: " + node + " (" + err.Error() + ")"
+			if i+1 < len(nodelist) {
+				message = message + ", not updated: " + strings.Join(nodelist[i+1:], ", ")
+			}
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: node + ": registry credentials updated and Ready"}); err != nil {
+			return err
+		}
+	}
+
+	var registries []string
+	for _, c := range in.Credentials {
+		registries = append(registries, c.Registry)
+	}
+	message := "Registry credentials removed from " + strings.Join(nodelist, ", ")
+	if len(registries) > 0 {
+		message = "Credentials for " + strings.Join(registries, ", ") + " set on " + strings.Join(nodelist, ", ")
+	}
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: message}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -20,6 +20,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
@@ -78,7 +80,18 @@ func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) er
 		return nil
 	}
 
-	haproxy_salt := Read_Cfg("control-plane.conf", "loadbalancer_salt")
+	audit.AddTargets(stream.Context(), nodelist)
+
+	// Make sure the caller is allowed to remove all these nodes before
+	// we change anything
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	haproxy_salt := strings.Join(loadBalancers(), ",")
 	var wg sync.WaitGroup
 	wg.Add(nodelistLength)
 
@@ -92,7 +105,7 @@ func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) er
 			// If loadbalancer is known, remove from haproxy
 			if len(haproxy_salt) > 0 {
 				stream.Send(&pb.StatusReply{Success: true, Message: nodelist[i] + ": removing node from haproxy loadbalancer..."})
-				success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", haproxy_salt, "cmd.run", "haproxycfg server remove "+nodelist[i])
+				success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "-L", haproxy_salt, "cmd.run", "haproxycfg server remove "+nodelist[i])
 				if success != true {
 					if err := stream.Send(&pb.StatusReply{Success: false, Message: nodelist[i] + ": " + message}); err != nil {
 						log.Errorf("Send message failed: %s", err)
@@ -115,7 +128,7 @@ func RemoveNode(in *pb.RemoveNodeRequest, stream pb.Kubeadm_RemoveNodeServer) er
 					log.Errorf("Send message failed: %s", err)
 				}
 			} else {
-				if err := stream.Send(&pb.StatusReply{Success: false,
+				if err := stream.Send(&pb.StatusReply{Success: true,
 					Message: nodelist[i] + ": successfully removed"}); err != nil {
 					log.Errorf("Send message failed: %s", err)
 				}
@@ -0,0 +1,395 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// How often the state of a rebooting node is checked
+var readyPollInterval = 10 * time.Second
+
+// selectNodes returns the salt names of all master and worker nodes
+// matching target, which can be a glob, a comma separated list or a
+// single node name. Names of a list or a single name which are no
+// master or worker node are an error, as is an empty target.
+func selectNodes(target string) ([]string, error) {
+	if len(strings.Trim(target, ", \t")) == 0 {
+		return nil, errors.New("No node given")
+	}
+
+	var success bool
+	var message string
+	if strings.Contains(target, ",") && !strings.Contains(target, "[") {
+		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", "-L", target, "grains.get", "kubicd")
+	} else {
+		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", target, "grains.get", "kubicd")
+	}
+	if success != true {
+		return nil, errors.New(message)
+	}
+
+	var nodelist []string
+	for _, entry := range strings.Split(message, "\n") {
+		if strings.Contains(entry, "kubic-worker-node") || strings.Contains(entry, "kubic-master-node") {
+			nodelist = append(nodelist, strings.Split(entry, ":")[0])
+		}
+	}
+
+	if !strings.ContainsAny(target, "[*?") {
+		var unknown []string
+		for _, node := range strings.Split(target, ",") {
+			if node = strings.TrimSpace(node); len(node) > 0 && !contains(nodelist, node) {
+				unknown = append(unknown, node)
+			}
+		}
+		if len(unknown) > 0 {
+			return nil, errors.New("Not a node of the cluster: " + strings.Join(unknown, ", "))
+		}
+	}
+	return nodelist, nil
+}
+
+// kubicdNode returns true if the node is the machine kubicd runs on.
+func kubicdNode(node string) bool {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	if strings.SplitN(node, ".", 2)[0] == hostname {
+		return true
+	}
+	nodename, err := tools.GetNodeName(node)
+	return err == nil && strings.SplitN(nodename, ".", 2)[0] == hostname
+}
+
+// targetNodes returns the salt names of the nodes matching all given
+// criteria: node names as accepted by selectNodes, the role and a
+// label selector of the kubernetes nodes. Without criteria all master
+// and worker nodes are returned.
+func targetNodes(nodeNames string, role string, labelSelector string) ([]string, error) {
+	var nodelist []string
+	if len(role) > 0 {
+		if role != "master" && role != "worker" {
+			return nil, errors.New("Invalid role '" + role + "', valid roles are 'master' or 'worker'")
+		}
+		success, message, nodes := tools.GetListOfNodes(role)
+		if success != true {
+			return nil, errors.New(message)
+		}
+		nodelist = nodes
+	}
+	if len(nodeNames) > 0 {
+		nodes, err := selectNodes(nodeNames)
+		if err != nil {
+			return nil, err
+		}
+		if len(role) > 0 {
+			// both given: only nodes matching both
+			nodes = intersect(nodelist, nodes)
+		}
+		nodelist = nodes
+	}
+	if len(role) == 0 && len(nodeNames) == 0 {
+		for _, r := range []string{"master", "worker"} {
+			// no nodes of a role is no error
+			if success, _, nodes := tools.GetListOfNodes(r); success {
+				nodelist = append(nodelist, nodes...)
+			}
+		}
+	}
+
+	var result []string
+	for _, node := range nodelist {
+		if node = strings.TrimSpace(node); len(node) > 0 {
+			result = append(result, node)
+		}
+	}
+	if len(labelSelector) == 0 || len(result) == 0 {
+		return result, nil
+	}
+
+	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"get", "nodes", "-l", labelSelector, "-o", "jsonpath={.items[*].metadata.name}")
+	if success != true {
+		return nil, errors.New(message)
+	}
+	hostnames := strings.Fields(message)
+	var selected []string
+	for _, node := range result {
+		hostname, err := tools.GetNodeName(node)
+		if err == nil && contains(hostnames, hostname) {
+			selected = append(selected, node)
+		}
+	}
+	return selected, nil
+}
+
+// kubectlGetNode returns the field of the kubernetes node selected by
+// the jsonpath.
+func kubectlGetNode(hostname string, jsonpath string) (string, error) {
+	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"get", "node", hostname, "-o", "jsonpath="+jsonpath)
+	if success != true {
+		return "", errors.New(message)
+	}
+	return strings.TrimSpace(message), nil
+}
+
+// waitForReboot waits until the node runs with a new boot ID and is
+// Ready again.
+func waitForReboot(ctx context.Context, hostname string, bootID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+
+		// errors are expected while the node is down
+		newBootID, err := kubectlGetNode(hostname, "{.status.nodeInfo.bootID}")
+		if err == nil && len(newBootID) > 0 && newBootID != bootID {
+			ready, err := kubectlGetNode(hostname, "{.status.conditions[?(@.type==\"Ready\")].status}")
+			if err == nil && ready == "True" {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return errors.New("node not Ready after " + timeout.String())
+		}
+	}
+}
+
+// rebootAndWait drains, reboots and uncordons one node. The drain uses
+// the eviction API, so PodDisruptionBudgets are respected. Once the
+// node is drained, it is uncordoned on every path, even if the caller
+// went away or the node did not become Ready in time.
+func rebootAndWait(ctx context.Context, node string, timeout time.Duration, send func(bool, string)) error {
+	hostname, err := tools.GetNodeName(node)
+	if err != nil {
+		return err
+	}
+	bootID, err := kubectlGetNode(hostname, "{.status.nodeInfo.bootID}")
+	if err != nil {
+		return err
+	}
+
+	send(true, node+": draining...")
+	success, message := tools.DrainNodeWithOptions(hostname, tools.DrainOptions{}, func(progress string) {
+		send(true, node+": "+progress)
+	})
+	uncordon := func() error {
+		if success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf", "uncordon", hostname); success != true {
+			return errors.New("uncordon failed: " + message)
+		}
+		return nil
+	}
+	if success != true {
+		// don't leave the node cordoned if nothing happened
+		uncordon()
+		return errors.New("drain failed: " + message)
+	}
+	if err := ctx.Err(); err != nil {
+		uncordon()
+		return err
+	}
+
+	send(true, node+": rebooting...")
+	if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "system.reboot"); success != true {
+		uncordon()
+		return errors.New("reboot failed: " + message)
+	}
+
+	// the reboot cannot be stopped anymore, wait for the node without
+	// the context of the caller, else it would stay cordoned
+	send(true, node+": waiting for node to become Ready...")
+	err = waitForReboot(context.Background(), hostname, bootID, timeout)
+
+	send(true, node+": uncordoning...")
+	if uerr := uncordon(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// RollingReboot reboots the selected nodes, masters one after the
+// other first, then maximal MaxUnavailable workers at the same time.
+// After a failure no further node is rebooted.
+func RollingReboot(in *pb.RollingRebootRequest, stream pb.Kubeadm_RollingRebootServer) error {
+	var sendMutex sync.Mutex
+	send := func(success bool, message string) {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
+			log.Errorf("Send message failed: %s", err)
+		}
+	}
+
+	maxUnavailable := int(in.MaxUnavailable)
+	if maxUnavailable <= 0 {
+		maxUnavailable = 1
+	}
+	timeout := 15 * time.Minute
+	if len(in.Timeout) > 0 {
+		var err error
+		timeout, err = time.ParseDuration(in.Timeout)
+		if err != nil {
+			send(false, "Invalid timeout: "+err.Error())
+			return nil
+		}
+	}
+
+	var nodelist []string
+	if len(in.Role) > 0 || len(in.NodeNames) > 0 {
+		var err error
+		nodelist, err = targetNodes(in.NodeNames, in.Role, "")
+		if err != nil {
+			send(false, err.Error())
+			return nil
+		}
+	}
+	if len(nodelist) == 0 {
+		send(true, "No Nodes found")
+		return nil
+	}
+
+	audit.AddTargets(stream.Context(), nodelist)
+	if allowed, message := rbac.CheckTargets(stream.Context(), nodelist, ""); !allowed {
+		send(false, message)
+		return nil
+	}
+
+	// rebooting the own node would end this call with the node still
+	// cordoned
+	var self, others []string
+	for _, node := range nodelist {
+		if kubicdNode(node) {
+			self = append(self, node)
+			send(false, node+": skipped, kubicd runs on this node, reboot it with 'kubicctl node reboot' afterwards")
+		} else {
+			others = append(others, node)
+		}
+	}
+	nodelist = others
+	if len(nodelist) == 0 {
+		send(false, "No nodes to reboot")
+		return nil
+	}
+
+	_, _, masterlist := tools.GetListOfNodes("master")
+	var masters, workers []string
+	for _, node := range nodelist {
+		if contains(masterlist, node) {
+			masters = append(masters, node)
+		} else {
+			workers = append(workers, node)
+		}
+	}
+
+	send(true, "Rebooting "+strings.Join(nodelist, ", ")+"...")
+
+	var mutex sync.Mutex
+	var failed []string
+	var skipped []string
+	reboot := func(nodes []string, parallel int) {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, parallel)
+		for _, node := range nodes {
+			slots <- struct{}{}
+			mutex.Lock()
+			stop := len(failed) > 0 || stream.Context().Err() != nil
+			if stop {
+				skipped = append(skipped, node)
+			}
+			mutex.Unlock()
+			if stop {
+				<-slots
+				continue
+			}
+
+			wg.Add(1)
+			go func(node string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				if err := rebootAndWait(stream.Context(), node, timeout, send); err != nil {
+					send(false, node+": "+err.Error())
+					mutex.Lock()
+					failed = append(failed, node)
+					mutex.Unlock()
+					return
+				}
+				send(true, node+": rebooted and Ready")
+			}(node)
+		}
+		wg.Wait()
+	}
+	reboot(masters, 1)
+	reboot(workers, maxUnavailable)
+
+	if len(failed) == 0 && len(skipped) > 0 {
+		// the caller went away, no new node was rebooted afterwards
+		send(false, "Rolling reboot canceled, not rebooted: "+strings.Join(append(skipped, self...), ", "))
+		return stream.Context().Err()
+	}
+	skipped = append(skipped, self...)
+	if len(failed) > 0 {
+		message := "Rolling reboot stopped, failed: " + strings.Join(failed, ", ")
+		if len(skipped) > 0 {
+			message = message + ", not rebooted: " + strings.Join(skipped, ", ")
+		}
+		send(false, message)
+		return nil
+	}
+	if len(self) > 0 {
+		send(false, "Nodes rebooted, except "+strings.Join(self, ", ")+" running kubicd")
+		return nil
+	}
+	send(true, "All nodes rebooted")
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
+
+func intersect(a []string, b []string) []string {
+	var result []string
+	for _, entry := range b {
+		if contains(a, entry) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
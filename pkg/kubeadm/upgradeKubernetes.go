@@ -15,12 +15,20 @@
 package kubeadm
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	pb "github.com/thkukuk/kubic-control/api"
 	"github.com/thkukuk/kubic-control/pkg/deployment"
 	"github.com/thkukuk/kubic-control/pkg/tools"
+	"gopkg.in/yaml.v2"
 )
 
 func uncordon(stream pb.Kubeadm_UpgradeKubernetesServer, hostname string) error {
@@ -35,11 +43,38 @@ func uncordon(stream pb.Kubeadm_UpgradeKubernetesServer, hostname string) error
 	return nil
 }
 
-func upgradeFirstMaster(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernetesServer, kubernetes_version string) error {
+// setImageRepository changes the registry of the control plane images
+// in the ClusterConfiguration, kubeadm upgrade uses it for all nodes.
+func setImageRepository(image_repository string) error {
+	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"-n", "kube-system", "get", "configmap", "kubeadm-config", "-o", "jsonpath={.data.ClusterConfiguration}")
+	if success != true {
+		return errors.New(message)
+	}
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(message), &config); err != nil {
+		return errors.New("Cannot parse ClusterConfiguration: " + err.Error())
+	}
+	data, err := yaml.Marshal(setKey(config, "imageRepository", image_repository))
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]map[string]string{"data": {"ClusterConfiguration": string(data)}})
+	if err != nil {
+		return err
+	}
+	success, message = tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"-n", "kube-system", "patch", "configmap", "kubeadm-config", "--type", "merge", "-p", string(patch))
+	if success != true {
+		return errors.New(message)
+	}
+	return nil
+}
+
+func upgradeFirstMaster(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernetesServer, firstMaster string, kubernetes_version string) (bool, error) {
 	var hostname string
 	var err error
 
-	firstMaster := Read_Cfg("control-plane.conf", "master")
 	if len(firstMaster) > 0 {
 		hostname, err = tools.GetNodeName(firstMaster)
 	} else {
@@ -47,42 +82,75 @@ func upgradeFirstMaster(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernet
 		if err != nil {
 			if err2 := stream.Send(&pb.StatusReply{Success: false,
 				Message: "Could not get hostname: " + err.Error()}); err2 != nil {
-				return err2
+				return false, err2
 			}
-			return nil
+			return false, nil
+		}
+	}
+
+	if len(in.ImageRepository) > 0 {
+		if !imageReference.MatchString(in.ImageRepository) {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid image repository '" + in.ImageRepository + "'"}); err != nil {
+				return false, err
+			}
+			return false, nil
 		}
+		if err = stream.Send(&pb.StatusReply{Success: true, Message: "Switch to image repository " + in.ImageRepository + "..."}); err != nil {
+			return false, err
+		}
+		if err := setImageRepository(in.ImageRepository); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot change image repository: " + err.Error()}); err != nil {
+				return false, err
+			}
+			return false, nil
+		}
+		update_cfg("control-plane.conf", "image_repository", in.ImageRepository)
 	}
 
 	if err = stream.Send(&pb.StatusReply{Success: true, Message: "Validate whether the cluster is upgradeable..."}); err != nil {
-		return err
+		return false, err
 	}
 	success, message := executeCmdSalt(firstMaster, "kubeadm", "upgrade", "plan", kubernetes_version)
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
-			return err
+			return false, err
 		}
-		return nil
+		return false, nil
 	}
 
 	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Drain first control plane master (" + hostname + ")..."}); err != nil {
-		return err
+		return false, err
 	}
 	// if draining fails, ignore
 	tools.DrainNode(hostname, "")
 
 	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Upgrade the control plane..."}); err != nil {
 		uncordon(stream, hostname)
-		return err
+		return false, err
 	}
 	success, message = executeCmdSalt(firstMaster, "kubeadm", "upgrade", "apply", kubernetes_version, "--yes")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			uncordon(stream, hostname)
-			return err
+			return false, err
 		}
 		uncordon(stream, hostname)
-		return nil
+		return false, nil
+	}
+	// kubeadm replaced the kubelet configuration with the one of the
+	// ConfigMap, settings of single nodes are only recorded for salt
+	// minions
+	if len(firstMaster) > 0 {
+		if err := reapplyKubeletOverrides(firstMaster); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot apply kubelet settings again: " + err.Error()}); err != nil {
+				uncordon(stream, hostname)
+				return false, err
+			}
+			uncordon(stream, hostname)
+			return false, nil
+		}
 	}
+
 	// strip down kubernetes_version to get kubelet major version
 	// for openSUSE Kubic (from "v1.18.6" to "1.18")
 	kubelet_version := kubernetes_version[1:]
@@ -93,76 +161,290 @@ func upgradeFirstMaster(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernet
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			uncordon(stream, hostname)
-			return err
+			return false, err
 		}
 		uncordon(stream, hostname)
-		return nil
+		return false, nil
 	}
 	success, message = executeCmdSalt(firstMaster, "systemctl", "restart", "kubelet")
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			uncordon(stream, hostname)
-			return err
+			return false, err
 		}
 		uncordon(stream, hostname)
-		return nil
+		return false, nil
+	}
+	return true, uncordon(stream, hostname)
+}
+
+// rollout keeps track of the failures while upgrading the nodes, the
+// failure budget is shared by masters and workers.
+type rollout struct {
+	stream         pb.Kubeadm_UpgradeKubernetesServer
+	sendMutex      sync.Mutex
+	state          *upgradeState
+	kubeletVersion string
+	podSelector    string
+	healthTimeout  time.Duration
+	maxFailures    int
+
+	mutex    sync.Mutex
+	failures int
+	skipped  []string
+}
+
+func (r *rollout) send(success bool, message string) {
+	r.sendMutex.Lock()
+	defer r.sendMutex.Unlock()
+	if err := r.stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
+		log.Errorf("Send message failed: %s", err)
+	}
+}
+
+// exhausted returns true if the failure budget is used up.
+func (r *rollout) exhausted() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.maxFailures > 0 && r.failures >= r.maxFailures
+}
+
+// allReady returns true if every line of the output is "True". The
+// lines are the Ready conditions of pods, a pod without condition has
+// an empty line.
+func allReady(output string) bool {
+	output = strings.TrimSuffix(output, "\n")
+	if len(output) == 0 {
+		return true
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "True" {
+			return false
+		}
+	}
+	return true
+}
+
+// healthCheck describes when a node is healthy again after kubelet
+// or the container runtime was restarted.
+type healthCheck struct {
+	// salt minion and kubernetes name of the node
+	node     string
+	hostname string
+	// services which have to run on the node
+	services []string
+	// the Ready condition from before the restart is still shown for
+	// some time, only a newer heartbeat counts
+	heartbeat time.Time
+	// major.minor version kubelet has to report
+	kubeletVersion string
+	// running pods matching the selector have to be Ready
+	podSelector string
+}
+
+// readyHeartbeat returns the time kubelet last reported the Ready
+// condition of the node.
+func readyHeartbeat(hostname string) (time.Time, error) {
+	heartbeat, err := kubectlGetNode(hostname, "{.status.conditions[?(@.type==\"Ready\")].lastHeartbeatTime}")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, heartbeat)
+}
+
+// serviceRunning returns true if salt reports the service as running.
+func serviceRunning(node string, service string) bool {
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", node, "service.status", service)
+	return success == true && strings.HasSuffix(strings.TrimSpace(message), "True")
+}
+
+// healthy returns true if the node fulfills all conditions of the
+// check.
+func (c healthCheck) healthy() bool {
+	for _, service := range c.services {
+		if !serviceRunning(c.node, service) {
+			return false
+		}
+	}
+
+	ready, err := kubectlGetNode(c.hostname, "{.status.conditions[?(@.type==\"Ready\")].status}")
+	if err != nil || ready != "True" {
+		return false
+	}
+	if !c.heartbeat.IsZero() {
+		heartbeat, err := readyHeartbeat(c.hostname)
+		if err != nil || !heartbeat.After(c.heartbeat) {
+			return false
+		}
+	}
+	if len(c.kubeletVersion) > 0 {
+		version, err := kubectlGetNode(c.hostname, "{.status.nodeInfo.kubeletVersion}")
+		if err != nil || !strings.HasPrefix(version, "v"+c.kubeletVersion+".") {
+			return false
+		}
+	}
+
+	if len(c.podSelector) == 0 {
+		return true
+	}
+	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"get", "pods", "--all-namespaces", "--field-selector", "spec.nodeName="+c.hostname+",status.phase=Running", "-l", c.podSelector,
+		"-o", "jsonpath={range .items[*]}{.status.conditions[?(@.type==\"Ready\")].status}{\"\\n\"}{end}")
+	return success == true && allReady(message)
+}
+
+// waitForHealthy waits until the node is healthy according to the
+// check. Completed pods never become Ready again and are ignored.
+func waitForHealthy(ctx context.Context, check healthCheck, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if check.healthy() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if len(check.podSelector) > 0 {
+				return errors.New("node or pods matching '" + check.podSelector + "' not Ready after " + timeout.String())
+			}
+			return errors.New("node not Ready after " + timeout.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// restartServices restarts the services on the node one after the
+// other and waits until they are running and the node reported Ready
+// after the restart.
+func restartServices(ctx context.Context, node string, hostname string, services []string, timeout time.Duration) error {
+	heartbeat, err := readyHeartbeat(hostname)
+	if err != nil {
+		return err
 	}
-	return uncordon(stream, hostname)
+	for _, service := range services {
+		if success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "service.restart", service); success != true {
+			return errors.New(message)
+		}
+	}
+	return waitForHealthy(ctx, healthCheck{node: node, hostname: hostname, services: services, heartbeat: heartbeat}, timeout)
 }
 
-func upgradeNodes(in *pb.UpgradeRequest,
-	stream pb.Kubeadm_UpgradeKubernetesServer,
-	role string, kubernetes_version string) (string, error) {
+// upgradeNode upgrades kubeadm configuration and kubelet of one node
+// and waits until it is healthy again. The returned string describes
+// the failed step.
+func (r *rollout) upgradeNode(node string) (string, error) {
+	hostname, err := tools.GetNodeName(node)
+	if err != nil {
+		return "determine hostname", err
+	}
+
+	// if draining fails, ignore
+	tools.DrainNode(hostname, "")
+
+	check := healthCheck{node: node, hostname: hostname, services: []string{"kubelet"},
+		kubeletVersion: r.kubeletVersion, podSelector: r.podSelector}
+
+	failedStep := ""
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "cmd.run",
+		"\"kubeadm upgrade node\"")
+	if success != true {
+		failedStep = "kubeadm"
+	} else if err := reapplyKubeletOverrides(node); err != nil {
+		success, message = false, err.Error()
+		failedStep = "kubelet_config"
+	} else {
+		// Update kubelet
+		success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "cmd.run",
+			"\"sed -i s/KUBELET_VER=.*/KUBELET_VER="+r.kubeletVersion+"/ /etc/sysconfig/kubelet\"")
+		if success != true {
+			failedStep = "kubelet_ver"
+		} else if check.heartbeat, err = readyHeartbeat(hostname); err != nil {
+			success, message = false, err.Error()
+			failedStep = "heartbeat"
+		} else {
+			success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", node, "service.restart", "kubelet")
+			if success != true {
+				failedStep = "kubelet"
+			}
+		}
+	}
+	// uncordon, most likely node will still work, else we can run out of nodes
+	if success, uncordonMessage := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf", "uncordon", hostname); success != true && len(failedStep) == 0 {
+		failedStep = "uncordon"
+		message = uncordonMessage
+	}
+	if len(failedStep) > 0 {
+		return failedStep, errors.New(message)
+	}
+
+	r.send(true, node+": waiting for node to become healthy...")
+	if err := waitForHealthy(r.stream.Context(), check, r.healthTimeout); err != nil {
+		return "health", err
+	}
+	return "", nil
+}
+
+// upgradeNodes upgrades all nodes of the role, maximal parallel nodes
+// at the same time. If the failure budget is used up or the caller
+// went away, the remaining nodes are skipped.
+func upgradeNodes(r *rollout, role string, parallel int) (string, error) {
 	// Get list of all role nodes:
 	success, message, nodelist := tools.GetListOfNodes(role)
 	if success != true {
-		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
+		if err := r.stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return "", err
 		}
 		return "", nil
 	}
 
-	// strip down kubernetes_version to get kubelet major version
-	// for openSUSE Kubic (from "v1.18.6" to "1.18")
-	kubelet_version := kubernetes_version[1:]
-	kubelet_version = kubelet_version[:strings.LastIndex(kubelet_version, ".")]
+	firstMaster := Read_Cfg("control-plane.conf", "master")
 
 	var failedNodes = ""
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
 	for i := range nodelist {
-		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Upgrade " + nodelist[i] + "..."}); err != nil {
-			return "", err
+		node := strings.TrimSpace(nodelist[i])
+		if len(node) == 0 || (role == "master" && node == firstMaster) {
+			continue
+		}
+		if r.state.phase(node) == phaseDone {
+			r.send(true, node+": already upgraded")
+			continue
+		}
+		slots <- struct{}{}
+		if r.exhausted() || r.stream.Context().Err() != nil {
+			<-slots
+			r.mutex.Lock()
+			r.skipped = append(r.skipped, node)
+			r.mutex.Unlock()
+			continue
 		}
-		hostname, err := tools.GetNodeName(nodelist[i])
-		if err != nil {
-			failedNodes = failedNodes + nodelist[i] + "(determine hostname), "
-		} else {
-			// if draining fails, ignore
-			tools.DrainNode(hostname, "")
 
-			success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", nodelist[i], "cmd.run",
-				"\"kubeadm upgrade node\"")
-			if success != true {
-				failedNodes = failedNodes + nodelist[i] + " (kubeadm), "
-			} else {
-				// Update kubelet
-				success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", nodelist[i], "cmd.run",
-					"\"sed -i s/KUBELET_VER=.*/KUBELET_VER="+kubelet_version+"/ /etc/sysconfig/kubelet\"")
-				if success != true {
-					failedNodes = failedNodes + nodelist[i] + " (kubelet_ver), "
-				} else {
-					success, message = tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", nodelist[i], "service.restart", "kubelet")
-					if success != true {
-						failedNodes = failedNodes + nodelist[i] + " (kubelet), "
-					}
-				}
-			}
-			// uncordon, most likely node will still work, else we can run out of nodes
-			success, message = tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf", "uncordon", hostname)
-			if success != true {
-				failedNodes = failedNodes + nodelist[i] + " (uncordon), "
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			r.send(true, "Upgrade "+node+"...")
+			r.state.setPhase(node, role, phaseUpgrading, "")
+			if step, err := r.upgradeNode(node); err != nil {
+				r.send(false, node+": "+err.Error())
+				r.state.setPhase(node, role, phaseFailed, step+": "+err.Error())
+				r.mutex.Lock()
+				r.failures++
+				failedNodes = failedNodes + node + " (" + step + "), "
+				r.mutex.Unlock()
+				return
 			}
-		}
+			r.state.setPhase(node, role, phaseDone, "")
+			r.send(true, node+": upgraded and healthy")
+		}(node)
 	}
+	wg.Wait()
 	return failedNodes, nil
 }
 
@@ -170,50 +452,173 @@ func UpgradeKubernetes(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernete
 
 	multiMaster := Read_Cfg("control-plane.conf", "MultiMaster")
 
-	kubernetes_version := ""
-	if len(in.KubernetesVersion) > 0 {
-		kubernetes_version = in.KubernetesVersion
+	maxParallel := int(in.MaxParallel)
+	if maxParallel <= 0 {
+		maxParallel = 1
+	}
+	healthTimeout := 10 * time.Minute
+	if len(in.HealthTimeout) > 0 {
+		var err error
+		healthTimeout, err = time.ParseDuration(in.HealthTimeout)
+		if err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Invalid health timeout: " + err.Error()}); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+
+	upgradeMutex.Lock()
+	if upgradeActive {
+		upgradeMutex.Unlock()
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Another upgrade is running"}); err != nil {
+			return err
+		}
+		return nil
+	}
+	upgradeActive = true
+	upgradeMutex.Unlock()
+	defer func() {
+		upgradeMutex.Lock()
+		upgradeActive = false
+		upgradeMutex.Unlock()
+	}()
+
+	state, err := loadUpgradeState()
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Cannot read upgrade state: " + err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+	unfinished := state != nil && state.state() != upgradeDone
+
+	firstMaster, err := findFirstMaster(true)
+	if err != nil {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: err.Error()}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	var success bool
+	var kubernetes_version string
+	if in.Resume {
+		if !unfinished {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "No unfinished upgrade found"}); err != nil {
+				return err
+			}
+			return nil
+		}
+		kubernetes_version = state.version()
+		if len(in.KubernetesVersion) > 0 && in.KubernetesVersion != kubernetes_version {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "The unfinished upgrade is to version " + kubernetes_version + ", not " + in.KubernetesVersion}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Resume upgrade to " + kubernetes_version + "..."}); err != nil {
+			return err
+		}
 	} else {
-		success, message := tools.GetKubeadmVersion("") // XXX Upgrade needs to support remote master
+		success, kubernetes_version = upgradeTarget(in, firstMaster)
 		if success != true {
-			if err := stream.Send(&pb.StatusReply{Success: false, Message: message}); err != nil {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: kubernetes_version}); err != nil {
+				return err
+			}
+			return nil
+		}
+		if unfinished && state.version() == kubernetes_version {
+			if err := stream.Send(&pb.StatusReply{Success: false, Message: "The upgrade to " + kubernetes_version + " was not finished, use --resume to continue it"}); err != nil {
 				return err
 			}
 			return nil
 		}
-		kubernetes_version = message
 	}
 
-	// XXX Check if kuberadm is new enough on all nodes
-	// salt '*' --module-executors='[direct_call]' --out=txt pkg.version kubernetes-kubeadm
-
-	if err := upgradeFirstMaster(in, stream, kubernetes_version); err != nil {
+	// Refuse to start if not all nodes can be upgraded
+	if err := stream.Send(&pb.StatusReply{Success: true, Message: "Check kubeadm and kubelet versions of all nodes..."}); err != nil {
 		return err
 	}
+	success, message, nodes := planUpgrade(firstMaster, kubernetes_version)
+	for _, node := range nodes {
+		if err := stream.Send(&pb.StatusReply{Success: len(node.Problem) == 0, Message: nodeVersionsString(node)}); err != nil {
+			return err
+		}
+	}
+	if success != true {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Upgrade refused: " + message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if !in.Resume {
+		state = newUpgradeState(kubernetes_version, nodes)
+	}
+	state.setState(upgradeRunning)
+
+	firstMasterNode := firstMasterName()
+	if state.phase(firstMasterNode) == phaseDone {
+		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Control plane already upgraded"}); err != nil {
+			return err
+		}
+	} else {
+		state.setPhase(firstMasterNode, "master", phaseUpgrading, "")
+		success, err := upgradeFirstMaster(in, stream, firstMaster, kubernetes_version)
+		if success != true {
+			state.setPhase(firstMasterNode, "master", phaseFailed, "upgrade of the control plane failed")
+			state.setState(upgradeFailed)
+			return err
+		}
+		state.setPhase(firstMasterNode, "master", phaseDone, "")
+	}
+
+	// strip down kubernetes_version to get kubelet major version
+	// for openSUSE Kubic (from "v1.18.6" to "1.18")
+	kubelet_version := kubernetes_version[1:]
+	kubelet_version = kubelet_version[:strings.LastIndex(kubelet_version, ".")]
+
+	r := &rollout{stream: stream, state: state, kubeletVersion: kubelet_version, podSelector: in.PodSelector,
+		healthTimeout: healthTimeout, maxFailures: int(in.MaxFailures)}
+
+	// masters are always upgraded one after the other
 	var failedMaster string
 	if strings.EqualFold(multiMaster, "True") {
 		var err error
-		if failedMaster, err = upgradeNodes(in, stream, "master", kubernetes_version); err != nil {
+		if failedMaster, err = upgradeNodes(r, "master", 1); err != nil {
 			return err
 		}
 	}
 	var failedWorker string
 	{
 		var err error
-		if failedWorker, err = upgradeNodes(in, stream, "worker", kubernetes_version); err != nil {
+		if failedWorker, err = upgradeNodes(r, "worker", maxParallel); err != nil {
+			return err
+		}
+	}
+	if err := stream.Context().Err(); err != nil {
+		// the caller went away, the upgrade can be resumed later
+		log.Warnf("Upgrade canceled, not upgraded: %s", strings.Join(r.skipped, ", "))
+		state.setState(upgradeFailed)
+		return err
+	}
+	if len(r.skipped) > 0 {
+		if err := stream.Send(&pb.StatusReply{Success: false, Message: "Upgrade stopped after " + strconv.Itoa(r.failures) + " failed nodes, not upgraded: " + strings.Join(r.skipped, ", ")}); err != nil {
 			return err
 		}
 	}
 
 	// Update pod network, kured and other pods we are running:
-	success, message := deployment.UpdateAll(false)
+	success, message = deployment.UpdateAll(false)
 	if success != true {
 		if err := stream.Send(&pb.StatusReply{Success: success, Message: message}); err != nil {
 			return err
 		}
 	}
 
-	if len(failedMaster) > 0 || len(failedWorker) > 0 {
+	if len(failedMaster) > 0 || len(failedWorker) > 0 || len(r.skipped) > 0 {
+		state.setState(upgradeFailed)
 		if len(failedMaster) > 0 {
 			if err := stream.Send(&pb.StatusReply{Success: false, Message: "Upgrade of some master nodes failed: " + strings.TrimSuffix(failedMaster, ", ")}); err != nil {
 				return err
@@ -225,6 +630,7 @@ func UpgradeKubernetes(in *pb.UpgradeRequest, stream pb.Kubeadm_UpgradeKubernete
 			}
 		}
 	} else {
+		state.setState(upgradeDone)
 		if err := stream.Send(&pb.StatusReply{Success: true, Message: "Kubernetes cluster was successfully upgraded to version " + kubernetes_version}); err != nil {
 			return err
 		}
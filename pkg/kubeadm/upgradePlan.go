@@ -0,0 +1,265 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// parseVersion returns major, minor and patch of versions like
+// "v1.18.3" or "1.18.3-lp152.1.2", nil if it cannot be parsed.
+func parseVersion(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return nil
+	}
+	result := make([]int, 3)
+	for i := 0; i < len(parts) && i < 3; i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return nil
+		}
+		result[i] = n
+	}
+	return result
+}
+
+// compareVersions returns -1, 0 or 1 if a is older, equal or newer
+// than b.
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < 3; i++ {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// newestVersion returns the newest of several installed versions as
+// reported by salt, e.g. "1.17.2,1.18.4".
+func newestVersion(versions string) string {
+	newest := ""
+	for _, v := range strings.Split(versions, ",") {
+		if parseVersion(v) == nil {
+			continue
+		}
+		if len(newest) == 0 || compareVersions(parseVersion(v), parseVersion(newest)) > 0 {
+			newest = strings.TrimSpace(v)
+		}
+	}
+	return newest
+}
+
+// upgradeTarget returns the kubernetes version to upgrade to, by
+// default the version of kubeadm on the first master.
+func upgradeTarget(in *pb.UpgradeRequest, firstMaster string) (bool, string) {
+	if len(in.KubernetesVersion) > 0 {
+		return true, in.KubernetesVersion
+	}
+	return tools.GetKubeadmVersion(firstMaster)
+}
+
+// clusterVersion returns the version of the API server.
+func clusterVersion() (bool, string) {
+	success, message := tools.ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf", "version", "-o", "json")
+	if success != true {
+		return false, message
+	}
+	var v struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := json.Unmarshal([]byte(message), &v); err != nil || len(v.ServerVersion.GitVersion) == 0 {
+		return false, "Cannot determine the version of the API server"
+	}
+	return true, v.ServerVersion.GitVersion
+}
+
+// packageVersions queries the installed kubeadm and kubelet versions
+// of the nodes via salt.
+func packageVersions(nodelist []string) (map[string]map[string]string, error) {
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=json", "--static",
+		"-L", strings.Join(nodelist, ","), "pkg.version", "kubernetes-kubeadm", "kubernetes-kubelet")
+	if success != true {
+		return nil, fmt.Errorf("%s", message)
+	}
+	versions := make(map[string]map[string]string)
+	if err := json.Unmarshal([]byte(message), &versions); err != nil {
+		return nil, fmt.Errorf("Cannot parse package versions: %v", err)
+	}
+	return versions, nil
+}
+
+// checkNodeVersions validates the installed versions of one node
+// against the target and returns the problem, empty if there is none.
+func checkNodeVersions(node *pb.NodeVersions, target []int) string {
+	var problems []string
+
+	kubeadm := parseVersion(node.Kubeadm)
+	if kubeadm == nil {
+		problems = append(problems, "kubernetes-kubeadm is not installed")
+	} else if kubeadm[0] != target[0] || kubeadm[1] != target[1] {
+		problems = append(problems, "kubeadm "+node.Kubeadm+" cannot upgrade to a different minor version")
+	} else if compareVersions(kubeadm, target) < 0 {
+		problems = append(problems, "kubeadm "+node.Kubeadm+" is older than the target version")
+	}
+
+	// the kubelet is switched to the target minor version, it
+	// must not be older or newer than the control plane
+	kubelet := parseVersion(node.Kubelet)
+	if kubelet == nil {
+		problems = append(problems, "kubernetes-kubelet is not installed")
+	} else if kubelet[0] != target[0] || kubelet[1] != target[1] {
+		problems = append(problems, "kubelet "+node.Kubelet+" does not match the target minor version")
+	}
+
+	return strings.Join(problems, ", ")
+}
+
+// planUpgrade checks whether the cluster and all nodes can be upgraded
+// to kubernetes_version. It returns false if the upgrade cannot be
+// started, the per node versions and problems are always returned if
+// the nodes could be queried.
+func planUpgrade(firstMaster string, kubernetes_version string) (bool, string, []*pb.NodeVersions) {
+	target := parseVersion(kubernetes_version)
+	if target == nil {
+		return false, "Invalid kubernetes version: " + kubernetes_version, nil
+	}
+
+	// kubeadm can only upgrade one minor version at a time
+	success, current := clusterVersion()
+	if success != true {
+		return false, current, nil
+	}
+	if cur := parseVersion(current); cur != nil {
+		if compareVersions(target, cur) < 0 {
+			return false, "Cannot downgrade from " + current + " to " + kubernetes_version, nil
+		}
+		if target[0] != cur[0] || target[1] > cur[1]+1 {
+			return false, "Cannot skip minor versions, upgrade from " + current + " to " + kubernetes_version + " is not supported", nil
+		}
+	}
+
+	var nodes []*pb.NodeVersions
+	var saltNodes []string
+
+	if len(firstMaster) > 0 {
+		saltNodes = append(saltNodes, firstMaster)
+		nodes = append(nodes, &pb.NodeVersions{Node: firstMaster, Role: "master"})
+	} else {
+		node := &pb.NodeVersions{Node: "localhost", Role: "master"}
+		if success, version := tools.ExecuteCmd("rpm", "-q", "--qf", "%{VERSION}", "kubernetes-kubeadm"); success {
+			node.Kubeadm = strings.TrimSpace(version)
+		}
+		if success, version := tools.ExecuteCmd("rpm", "-q", "--qf", "%{VERSION}", "kubernetes-kubelet"); success {
+			node.Kubelet = strings.TrimSpace(version)
+		}
+		nodes = append(nodes, node)
+	}
+
+	roles := []string{"worker"}
+	if strings.EqualFold(Read_Cfg("control-plane.conf", "MultiMaster"), "True") {
+		roles = []string{"master", "worker"}
+	}
+	for _, role := range roles {
+		success, message, nodelist := tools.GetListOfNodes(role)
+		if success != true {
+			return false, message, nil
+		}
+		for _, n := range nodelist {
+			n = strings.TrimSpace(n)
+			if len(n) == 0 || n == firstMaster {
+				continue
+			}
+			saltNodes = append(saltNodes, n)
+			nodes = append(nodes, &pb.NodeVersions{Node: n, Role: role})
+		}
+	}
+
+	if len(saltNodes) > 0 {
+		versions, err := packageVersions(saltNodes)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		for _, node := range nodes {
+			if pkgs, ok := versions[node.Node]; ok {
+				node.Kubeadm = newestVersion(pkgs["kubernetes-kubeadm"])
+				node.Kubelet = newestVersion(pkgs["kubernetes-kubelet"])
+			} else if node.Node != "localhost" {
+				node.Problem = "node did not respond"
+			}
+		}
+	}
+
+	failed := 0
+	for _, node := range nodes {
+		if len(node.Problem) == 0 {
+			node.Problem = checkNodeVersions(node, target)
+		}
+		if len(node.Problem) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return false, fmt.Sprintf("%d of %d nodes cannot be upgraded to %s", failed, len(nodes), kubernetes_version), nodes
+	}
+	return true, "All nodes can be upgraded from " + current + " to " + kubernetes_version, nodes
+}
+
+// UpgradePlan returns the kubeadm and kubelet versions of all nodes
+// and whether they can be upgraded.
+func UpgradePlan(in *pb.UpgradeRequest) *pb.UpgradePlanReply {
+	// only show which master would take over
+	firstMaster, err := findFirstMaster(false)
+	if err != nil {
+		return &pb.UpgradePlanReply{Success: false, Message: err.Error()}
+	}
+	success, kubernetes_version := upgradeTarget(in, firstMaster)
+	if success != true {
+		return &pb.UpgradePlanReply{Success: false, Message: kubernetes_version}
+	}
+	success, message, nodes := planUpgrade(firstMaster, kubernetes_version)
+	return &pb.UpgradePlanReply{Success: success, Message: message,
+		KubernetesVersion: kubernetes_version, Node: nodes}
+}
+
+// nodeVersionsString formats a row of the upgrade plan.
+func nodeVersionsString(node *pb.NodeVersions) string {
+	kubeadm, kubelet := node.Kubeadm, node.Kubelet
+	if len(kubeadm) == 0 {
+		kubeadm = "-"
+	}
+	if len(kubelet) == 0 {
+		kubelet = "-"
+	}
+	line := node.Node + " (" + node.Role + "): kubeadm " + kubeadm + ", kubelet " + kubelet
+	if len(node.Problem) > 0 {
+		line = line + ": " + node.Problem
+	}
+	return line
+}
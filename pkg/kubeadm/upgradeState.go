@@ -0,0 +1,198 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubeadm
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	pb "github.com/thkukuk/kubic-control/api"
+	"gopkg.in/ini.v1"
+)
+
+// The progress of the last upgrade. The default section contains the
+// target version and the state of the upgrade, every node has a
+// section with its role and phase.
+const upgradeStateFile = "/var/lib/kubic-control/upgrade-state.conf"
+
+// States of the upgrade
+const (
+	upgradeRunning     = "running"
+	upgradeFailed      = "failed"
+	upgradeDone        = "done"
+	upgradeInterrupted = "interrupted"
+)
+
+// Phases of a node during the upgrade
+const (
+	phasePending   = "pending"
+	phaseUpgrading = "upgrading"
+	phaseDone      = "done"
+	phaseFailed    = "failed"
+)
+
+var (
+	// only one upgrade at a time
+	upgradeMutex  sync.Mutex
+	upgradeActive = false
+)
+
+type upgradeState struct {
+	mutex sync.Mutex
+	cfg   *ini.File
+}
+
+// newUpgradeState creates the state of a new upgrade with all nodes
+// of the upgrade plan pending.
+func newUpgradeState(kubernetes_version string, nodes []*pb.NodeVersions) *upgradeState {
+	s := &upgradeState{cfg: ini.Empty()}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	global := s.cfg.Section("")
+	global.Key("version").SetValue(kubernetes_version)
+	global.Key("state").SetValue(upgradeRunning)
+	global.Key("started").SetValue(now)
+	global.Key("first_master").SetValue(firstMasterName())
+	for _, node := range nodes {
+		section := s.cfg.Section(node.Node)
+		section.Key("role").SetValue(node.Role)
+		section.Key("phase").SetValue(phasePending)
+	}
+	return s
+}
+
+// loadUpgradeState reads the state of the last upgrade, nil if there
+// was none.
+func loadUpgradeState() (*upgradeState, error) {
+	cfg, err := ini.Load(upgradeStateFile)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) && os.IsNotExist(pathErr) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &upgradeState{cfg: cfg}, nil
+}
+
+// save writes the state, errors are only logged since they should not
+// abort a running upgrade.
+func (s *upgradeState) save() {
+	s.cfg.Section("").Key("updated").SetValue(time.Now().UTC().Format(time.RFC3339))
+	if err := s.cfg.SaveTo(upgradeStateFile); err != nil {
+		log.Errorf("Cannot save upgrade state: %v", err)
+	}
+}
+
+func (s *upgradeState) version() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cfg.Section("").Key("version").String()
+}
+
+func (s *upgradeState) state() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cfg.Section("").Key("state").String()
+}
+
+func (s *upgradeState) setState(state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cfg.Section("").Key("state").SetValue(state)
+	s.save()
+}
+
+func (s *upgradeState) phase(node string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cfg.Section(node).Key("phase").MustString(phasePending)
+}
+
+// setPhase records the phase of a node, nodes added to the cluster
+// during the upgrade get a new section.
+func (s *upgradeState) setPhase(node string, role string, phase string, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	section := s.cfg.Section(node)
+	section.Key("role").SetValue(role)
+	section.Key("phase").SetValue(phase)
+	section.Key("message").SetValue(strings.Join(strings.Fields(message), " "))
+	s.save()
+}
+
+// UpgradeStatus returns the progress of the current or last upgrade.
+func UpgradeStatus() *pb.UpgradeStatusReply {
+	s, err := loadUpgradeState()
+	if err != nil {
+		return &pb.UpgradeStatusReply{Success: false, Message: "Cannot read upgrade state: " + err.Error()}
+	}
+	if s == nil {
+		return &pb.UpgradeStatusReply{Success: true, Message: "No upgrade was started yet"}
+	}
+
+	upgradeMutex.Lock()
+	active := upgradeActive
+	upgradeMutex.Unlock()
+
+	global := s.cfg.Section("")
+	reply := &pb.UpgradeStatusReply{Success: true,
+		KubernetesVersion: global.Key("version").String(),
+		State:             global.Key("state").String(),
+		Started:           global.Key("started").String(),
+		Updated:           global.Key("updated").String(),
+	}
+	// kubicd was restarted during the upgrade
+	if reply.State == upgradeRunning && !active {
+		reply.State = upgradeInterrupted
+	}
+
+	firstMaster := global.Key("first_master").String()
+	var nodes []string
+	for _, name := range s.cfg.SectionStrings() {
+		if name != ini.DefaultSection && name != firstMaster {
+			nodes = append(nodes, name)
+		}
+	}
+	sort.Strings(nodes)
+	// first master first, followed by the masters and workers
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return s.cfg.Section(nodes[i]).Key("role").String() == "master" &&
+			s.cfg.Section(nodes[j]).Key("role").String() != "master"
+	})
+	if _, err := s.cfg.GetSection(firstMaster); err == nil {
+		nodes = append([]string{firstMaster}, nodes...)
+	}
+
+	done := 0
+	for _, name := range nodes {
+		section := s.cfg.Section(name)
+		node := &pb.NodeUpgradeStatus{Node: name, Role: section.Key("role").String(),
+			Phase: section.Key("phase").String(), Message: section.Key("message").String()}
+		if node.Phase == phaseDone {
+			done++
+		}
+		reply.Node = append(reply.Node, node)
+	}
+	reply.Message = "Upgrade to " + reply.KubernetesVersion + " " + reply.State + ", " +
+		strconv.Itoa(done) + " of " + strconv.Itoa(len(nodes)) + " nodes upgraded"
+	return reply
+}
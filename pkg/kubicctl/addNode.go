@@ -16,41 +16,51 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 var (
-	nodeType = "worker"
+	nodeType   = "worker"
+	nodeLabels []string
+	nodeTaints []string
+	nodeRole   = ""
+
+	ignorePreflight = false
 )
 
 func AddNodeCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
-		Use:   "add <node>",
-		Short: "Add new nodes to cluster",
-		Run:   addNode,
-		Args:  cobra.ExactArgs(1),
+		Use:               "add <node>",
+		Short:             "Add new nodes to cluster",
+		Run:               addNode,
+		ValidArgsFunction: completeMinions,
+		Args:              cobra.ExactArgs(1),
 	}
 
 	subCmd.PersistentFlags().StringVar(&nodeType, "type", nodeType, "type of node, valid values are 'worker' or 'master'")
+	subCmd.PersistentFlags().StringArrayVar(&nodeLabels, "label", nodeLabels, "Label key=value of the nodes, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&nodeTaints, "taint", nodeTaints, "Taint key=value:Effect of the nodes, can be used several times")
+	subCmd.PersistentFlags().StringVar(&nodeRole, "node-role", nodeRole, "Role shown by kubectl, sets the label node-role.kubernetes.io/<role>")
+
+	subCmd.PersistentFlags().BoolVar(&ignorePreflight, "ignore-preflight", ignorePreflight, "Add the nodes even if the pre-flight checks fail")
+
+	subCmd.RegisterFlagCompletionFunc("type", completeWords("worker", "master"))
 
 	return subCmd
 }
 
 func addNode(cmd *cobra.Command, args []string) {
-	// Set up a connection to the server.
-
 	nodes := args[0]
 
+	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -59,32 +69,15 @@ func addNode(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
-	stream, err := client.AddNode(ctx, &pb.AddNodeRequest{NodeNames: nodes, Type: nodeType})
+	stream, err := client.AddNode(ctx, &pb.AddNodeRequest{NodeNames: nodes, Type: nodeType,
+		Labels: nodeLabels, Taints: nodeTaints, NodeRole: nodeRole, IgnorePreflight: ignorePreflight})
 	if err != nil {
-		log.Errorf("could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Adding node %s failed: %v\n", nodes, err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Adding node %s failed: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
-		}
-		if r.Success != true {
-			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-			os.Exit(1)
-		} else {
-			fmt.Printf("%s\n", r.Message)
-		}
+	retval := receiveStream(stream, "Adding node "+nodes)
+	if retval == output.ExitSuccess {
+		output.Info("Node(s) successfully added\n")
 	}
-
-	fmt.Print("Node(s) successfully added\n")
+	os.Exit(retval)
 }
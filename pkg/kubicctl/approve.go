@@ -0,0 +1,122 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	rejectRequest = false
+
+	// ID of an approved request, sent with unary calls which need
+	// the approval of a second user
+	approvalID = ""
+)
+
+// approvalInterceptor adds the approved request ID to unary calls.
+func approvalInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if len(approvalID) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, "approval-id", approvalID)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func ApproveCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "approve [<id>]",
+		Short: "Approve or reject a request waiting for a second user, list pending requests without id",
+		Run:   approveRequest,
+		Args:  cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().BoolVar(&rejectRequest, "reject", rejectRequest, "Reject the request instead of approving it")
+
+	return subCmd
+}
+
+func approveRequest(cmd *cobra.Command, args []string) {
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewApprovalClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if len(args) == 0 {
+		r, err := c.List(ctx, &pb.Empty{})
+		if err != nil {
+			output.Fail(output.ExitCode(err), "Could not list pending requests: %v", err)
+		}
+		if !r.Success {
+			output.Fail(output.ExitFailure, "Listing pending requests failed: %s", r.Message)
+		}
+
+		type pendingRequest struct {
+			ID      string `json:"id" yaml:"id"`
+			User    string `json:"user" yaml:"user"`
+			Method  string `json:"method" yaml:"method"`
+			Request string `json:"request" yaml:"request"`
+			Expires string `json:"expires" yaml:"expires"`
+		}
+		pending := []pendingRequest{}
+		for _, p := range r.Request {
+			pending = append(pending, pendingRequest{p.Id, p.User, p.Method, p.Request, p.Expires})
+		}
+		output.Result(map[string][]pendingRequest{"requests": pending}, func() {
+			if len(pending) == 0 {
+				fmt.Println("No pending requests")
+			}
+			for _, p := range pending {
+				fmt.Printf("%s: %s by %s, expires %s\n    %s\n", p.ID, p.Method, p.User, p.Expires, p.Request)
+			}
+		})
+		return
+	}
+
+	var r *pb.StatusReply
+	decision := "approved"
+	if rejectRequest {
+		decision = "rejected"
+		r, err = c.Reject(ctx, &pb.ApprovalRequest{Id: args[0]})
+	} else {
+		r, err = c.Approve(ctx, &pb.ApprovalRequest{Id: args[0]})
+	}
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not send decision: %v", err)
+	}
+	if !r.Success {
+		output.Fail(output.ExitFailure, "%s", r.Message)
+	}
+	output.Result(struct {
+		ID       string `json:"id" yaml:"id"`
+		Decision string `json:"decision" yaml:"decision"`
+	}{args[0], decision}, func() {
+		fmt.Printf("Request %s %s\n", args[0], decision)
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	auditUser   = ""
+	auditMethod = ""
+	auditSince  = ""
+)
+
+// auditEntry is one record of the audit log in JSON or YAML output
+type auditEntry struct {
+	Time     string   `json:"time" yaml:"time"`
+	ID       string   `json:"id" yaml:"id"`
+	User     string   `json:"user" yaml:"user"`
+	Peer     string   `json:"peer" yaml:"peer"`
+	Method   string   `json:"method" yaml:"method"`
+	Request  string   `json:"request,omitempty" yaml:"request,omitempty"`
+	Targets  []string `json:"targets,omitempty" yaml:"targets,omitempty"`
+	Outcome  string   `json:"outcome" yaml:"outcome"`
+	Message  string   `json:"message,omitempty" yaml:"message,omitempty"`
+	Duration string   `json:"duration" yaml:"duration"`
+	Hash     string   `json:"hash" yaml:"hash"`
+}
+
+func AuditQueryCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "query",
+		Short: "Print records of the audit log",
+		Run:   auditQuery,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	subCmd.PersistentFlags().StringVar(&auditUser, "user", auditUser, "Only print calls of this user")
+	subCmd.PersistentFlags().StringVar(&auditMethod, "method", auditMethod, "Only print calls of functions matching this pattern, e.g. 'Kubeadm/*'")
+	subCmd.PersistentFlags().StringVar(&auditSince, "since", auditSince, "Only print calls newer than this duration (e.g. '24h') or RFC3339 time")
+
+	return subCmd
+}
+
+func auditQuery(cmd *cobra.Command, args []string) {
+	since := ""
+	if len(auditSince) > 0 {
+		if d, err := time.ParseDuration(auditSince); err == nil {
+			since = time.Now().Add(-d).UTC().Format(time.RFC3339)
+		} else if _, err := time.Parse(time.RFC3339, auditSince); err == nil {
+			since = auditSince
+		} else {
+			output.Fail(output.ExitFailure, "Invalid value for --since: '%s'", auditSince)
+		}
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewAuditClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	stream, err := client.Query(ctx, &pb.AuditQueryRequest{User: auditUser,
+		Method: auditMethod, Since: since})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not query audit log: %v", err)
+	}
+
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			output.Fail(output.ExitCode(err), "Querying audit log failed: %v", err)
+		}
+		output.Result(auditEntry{r.Time, r.Id, r.User, r.Peer,
+			strings.TrimPrefix(r.Method, "/api."), r.Request, r.Targets,
+			r.Outcome, r.Message, r.Duration, r.Hash}, func() {
+			fmt.Printf("%s %s %s@%s %s %s", r.Time, r.Id, r.User, r.Peer,
+				strings.TrimPrefix(r.Method, "/api."), r.Outcome)
+			if len(r.Targets) > 0 {
+				fmt.Printf(" targets=%s", strings.Join(r.Targets, ","))
+			}
+			if len(r.Request) > 0 && r.Request != "{}" {
+				fmt.Printf(" request=%s", r.Request)
+			}
+			if len(r.Message) > 0 {
+				fmt.Printf(" (%s)", strings.Replace(r.Message, "\n", " ", -1))
+			}
+			fmt.Print("\n")
+		})
+	}
+}
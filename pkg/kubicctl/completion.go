@@ -0,0 +1,227 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+	"google.golang.org/grpc"
+)
+
+// Lists fetched from kubicd for completion are cached for this time,
+// so that pressing tab several times doesn't query kubicd every time.
+var completionCacheTTL = 30 * time.Second
+
+func CompletionCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "completion bash|zsh|fish",
+		Short: "Generate the shell completion script",
+		Long: `Generate the shell completion script for bash, zsh or fish.
+
+Besides commands and options, the names of nodes and salt minions are
+completed by asking kubicd, the answers are cached for a short time.
+
+bash:
+  $ source <(kubicctl completion bash)
+  # or permanently:
+  $ kubicctl completion bash > /etc/bash_completion.d/kubicctl
+
+zsh:
+  $ kubicctl completion zsh > "${fpath[1]}/_kubicctl"
+
+fish:
+  $ kubicctl completion fish > ~/.config/fish/completions/kubicctl.fish
+`,
+		Run:       generateCompletion,
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"bash", "zsh", "fish"},
+	}
+
+	return subCmd
+}
+
+func generateCompletion(cmd *cobra.Command, args []string) {
+	var err error
+
+	switch args[0] {
+	case "bash":
+		err = cmd.Root().GenBashCompletionV2(os.Stdout, true)
+	case "zsh":
+		err = cmd.Root().GenZshCompletion(os.Stdout)
+	case "fish":
+		err = cmd.Root().GenFishCompletion(os.Stdout, true)
+	}
+	if err != nil {
+		output.Fail(output.ExitFailure, "Cannot generate completion: %v", err)
+	}
+}
+
+// completeWords returns a completion function for a fixed list of words.
+func completeWords(words ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return words, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+func completeContexts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 || userConfig == nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return contextNames(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeNodes completes the first argument with the masters and
+// workers of the cluster, a comma separated list of nodes is allowed.
+func completeNodes(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeList(cmd, "nodes", toComplete, func(client pb.KubeadmClient, ctx context.Context) (*pb.ListReply, error) {
+		masters, err := client.ListMasters(ctx, &pb.Empty{})
+		if err != nil || !masters.Success {
+			return masters, err
+		}
+		workers, err := client.ListNodes(ctx, &pb.Empty{})
+		if err != nil || !workers.Success {
+			return workers, err
+		}
+		workers.Node = append(masters.Node, workers.Node...)
+		return workers, nil
+	})
+}
+
+// completeMinion completes the salt minions known to the salt master.
+func completeMinion(cmd *cobra.Command, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeList(cmd, "minions", toComplete, func(client pb.KubeadmClient, ctx context.Context) (*pb.ListReply, error) {
+		return client.ListMinions(ctx, &pb.Empty{})
+	})
+}
+
+// completeMinions completes the first argument with salt minions.
+func completeMinions(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeMinion(cmd, toComplete)
+}
+
+func completeMinionFlag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeMinion(cmd, toComplete)
+}
+
+// completeList returns the names fetched by list, from the cache if
+// it is recent enough. Names are completed after the last comma of
+// toComplete.
+func completeList(cmd *cobra.Command, what string, toComplete string,
+	list func(pb.KubeadmClient, context.Context) (*pb.ListReply, error)) ([]string, cobra.ShellCompDirective) {
+	// the persistent pre run of the root command is not called
+	// for completion
+	if len(contextName) > 0 {
+		if userConfig == nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		if _, err := userConfig.GetSection(contextPrefix + contextName); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+	}
+	applyContext(cmd)
+	if err := applyConnectionFlags(cmd); err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	cacheFile := completionCacheFile(what)
+	names, ok := readCompletionCache(cacheFile)
+	if !ok {
+		conn, err := CreateConnection()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		defer conn.Close()
+		names, err = fetchList(conn, list)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		writeCompletionCache(cacheFile, names)
+	}
+
+	prefix := ""
+	if i := strings.LastIndex(toComplete, ","); i >= 0 {
+		prefix = toComplete[:i+1]
+	}
+	var completions []string
+	for _, name := range names {
+		completions = append(completions, prefix+name)
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+func fetchList(conn *grpc.ClientConn, list func(pb.KubeadmClient, context.Context) (*pb.ListReply, error)) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := list(pb.NewKubeadmClient(conn), ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Success {
+		return nil, fmt.Errorf("%s", r.Message)
+	}
+	return r.Node, nil
+}
+
+// completionCacheFile returns the cache file for the list what of the
+// kubicd kubicctl is connected to.
+func completionCacheFile(what string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(kubicdName())
+	return filepath.Join(dir, "kubicctl", "completion", name+"-"+what)
+}
+
+func readCompletionCache(file string) ([]string, bool) {
+	if len(file) == 0 {
+		return nil, false
+	}
+	info, err := os.Stat(file)
+	if err != nil || time.Since(info.ModTime()) > completionCacheTTL {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	return strings.Fields(string(data)), true
+}
+
+func writeCompletionCache(file string, names []string) {
+	if len(file) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return
+	}
+	ioutil.WriteFile(file, []byte(strings.Join(names, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	kubeletRole             = ""
+	kubeletSelector         = ""
+	evictionHard            []string
+	evictionSoft            []string
+	evictionSoftGracePeriod []string
+	maxPods                 int32
+	systemReserved          []string
+	kubeReserved            []string
+	kubeletTimeout          = "5m"
+)
+
+func ConfigureKubeletCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "kubelet-config [<nodes>]",
+		Short:             "Change the kubelet configuration of nodes and restart kubelet one node after the other",
+		Run:               configureKubelet,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&kubeletRole, "role", kubeletRole, "Only nodes of this role: 'worker' or 'master'")
+	subCmd.PersistentFlags().StringVarP(&kubeletSelector, "selector", "l", kubeletSelector, "Only nodes matching this label selector")
+	subCmd.PersistentFlags().StringArrayVar(&evictionHard, "eviction-hard", evictionHard, "Hard eviction threshold signal=quantity, signal- removes it, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&evictionSoft, "eviction-soft", evictionSoft, "Soft eviction threshold signal=quantity, signal- removes it, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&evictionSoftGracePeriod, "eviction-soft-grace-period", evictionSoftGracePeriod, "Grace period signal=duration of a soft eviction threshold, can be used several times")
+	subCmd.PersistentFlags().Int32Var(&maxPods, "max-pods", maxPods, "Maximal number of pods per node, 0 keeps the current value")
+	subCmd.PersistentFlags().StringArrayVar(&systemReserved, "system-reserved", systemReserved, "Resource resource=quantity reserved for the system, resource- removes it, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&kubeReserved, "kube-reserved", kubeReserved, "Resource resource=quantity reserved for kubernetes, resource- removes it, can be used several times")
+	subCmd.PersistentFlags().StringVar(&kubeletTimeout, "timeout", kubeletTimeout, "Time to wait until a node is Ready again")
+	subCmd.RegisterFlagCompletionFunc("role", completeWords("worker", "master"))
+
+	return subCmd
+}
+
+func configureKubelet(cmd *cobra.Command, args []string) {
+	nodes := ""
+	if len(args) > 0 {
+		nodes = args[0]
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	defer cancel()
+
+	stream, err := client.ConfigureKubelet(ctx, &pb.KubeletConfigRequest{NodeNames: nodes,
+		Role: kubeletRole, LabelSelector: kubeletSelector,
+		EvictionHard: evictionHard, EvictionSoft: evictionSoft, EvictionSoftGracePeriod: evictionSoftGracePeriod,
+		MaxPods: maxPods, SystemReserved: systemReserved, KubeReserved: kubeReserved,
+		Timeout: kubeletTimeout})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Configuring kubelet"))
+}
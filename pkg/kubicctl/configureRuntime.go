@@ -0,0 +1,91 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	runtimeRole        = ""
+	runtimeSelector    = ""
+	registryMirrors    []string
+	insecureRegistries []string
+	pauseImage         = ""
+	storageDriver      = ""
+	pidsLimit          int64
+	runtimeTimeout     = "5m"
+	runtimeReset       = false
+)
+
+func ConfigureRuntimeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "configure [<nodes>]",
+		Short:             "Configure CRI-O and the registries of nodes and restart crio one node after the other",
+		Run:               configureRuntime,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&runtimeRole, "role", runtimeRole, "Only nodes of this role: 'worker' or 'master'")
+	subCmd.PersistentFlags().StringVarP(&runtimeSelector, "selector", "l", runtimeSelector, "Only nodes matching this label selector")
+	subCmd.PersistentFlags().StringArrayVar(&registryMirrors, "registry-mirror", registryMirrors, "Mirrors registry=mirror[,mirror...] of a registry, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&insecureRegistries, "insecure-registry", insecureRegistries, "Registry reachable without TLS verification, can be used several times")
+	subCmd.PersistentFlags().StringVar(&pauseImage, "pause-image", pauseImage, "Image of the pause container")
+	subCmd.PersistentFlags().StringVar(&storageDriver, "storage-driver", storageDriver, "Storage driver of the containers")
+	subCmd.PersistentFlags().Int64Var(&pidsLimit, "pids-limit", pidsLimit, "Maximal number of processes per container, -1 for unlimited, 0 keeps the default")
+	subCmd.PersistentFlags().StringVar(&runtimeTimeout, "timeout", runtimeTimeout, "Time to wait until a node is Ready again")
+	subCmd.PersistentFlags().BoolVar(&runtimeReset, "reset", runtimeReset, "Remove all settings, resetting crio and the registries to the defaults of the image")
+	subCmd.RegisterFlagCompletionFunc("role", completeWords("worker", "master"))
+	subCmd.RegisterFlagCompletionFunc("storage-driver", completeWords("overlay", "btrfs", "vfs"))
+
+	return subCmd
+}
+
+func configureRuntime(cmd *cobra.Command, args []string) {
+	nodes := ""
+	if len(args) > 0 {
+		nodes = args[0]
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewRuntimeClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	defer cancel()
+
+	stream, err := client.Configure(ctx, &pb.RuntimeConfigRequest{NodeNames: nodes,
+		Role: runtimeRole, LabelSelector: runtimeSelector,
+		RegistryMirrors: registryMirrors, InsecureRegistries: insecureRegistries,
+		PauseImage: pauseImage, StorageDriver: storageDriver, PidsLimit: pidsLimit,
+		Timeout: runtimeTimeout, Reset_: runtimeReset})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Configuring container runtime"))
+}
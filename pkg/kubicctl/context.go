@@ -0,0 +1,116 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
+	"gopkg.in/ini.v1"
+)
+
+// A context is a kubicd server with the certificates to access it,
+// stored as "[context <name>]" section in kubicctl.conf:
+//
+//	[global]
+//	current-context = prod
+//
+//	[context prod]
+//	server = kubicd.prod.example.com
+//	port = 7148
+//	cafile = ~/.config/kubicctl/prod/Kubic-Control-CA.crt
+//	crtfile = ~/.config/kubicctl/prod/user.crt
+//	keyfile = ~/.config/kubicctl/prod/user.key
+//
+// Without context, server and port of the [global] section are used.
+
+const contextPrefix = "context "
+
+var (
+	contextName = ""
+	userConfig  = ini.Empty()
+)
+
+func ContextCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "context",
+		Short: "Manage contexts for several kubicd servers",
+		// the selected context is not applied, so that a broken
+		// one can be fixed
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := output.Validate(); err != nil {
+				output.Fail(output.ExitFailure, "%v", err)
+			}
+		},
+	}
+
+	subCmd.AddCommand(
+		ContextListCmd(),
+		ContextUseCmd(),
+		ContextAddCmd(),
+		ContextRemoveCmd(),
+	)
+
+	return subCmd
+}
+
+// contextNames returns the names of all configured contexts.
+func contextNames() []string {
+	var names []string
+	for _, section := range userConfig.SectionStrings() {
+		if strings.HasPrefix(section, contextPrefix) {
+			names = append(names, strings.TrimPrefix(section, contextPrefix))
+		}
+	}
+	return names
+}
+
+// applyContext sets server, port and certificates from the selected
+// context, options given on the commandline win.
+func applyContext(cmd *cobra.Command) {
+	if len(contextName) == 0 {
+		return
+	}
+
+	section, err := userConfig.GetSection(contextPrefix + contextName)
+	if err != nil {
+		output.Fail(output.ExitFailure, "Unknown context '%s'", contextName)
+	}
+
+	apply := func(flag string, value *string) {
+		if !cmd.Flags().Changed(flag) && section.HasKey(flag) {
+			*value = section.Key(flag).String()
+		}
+	}
+	apply("server", &servername)
+	apply("port", &port)
+	apply("cafile", &caFile)
+	apply("crtfile", &crtFile)
+	apply("keyfile", &keyFile)
+
+	if section.HasKey("server") || section.HasKey("port") {
+		serverSet = true
+	}
+}
+
+func saveUserConfig() error {
+	if err := os.MkdirAll(filepath.Dir(usercfg), 0700); err != nil {
+		return err
+	}
+	return userConfig.SaveTo(usercfg)
+}
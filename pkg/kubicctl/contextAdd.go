@@ -0,0 +1,53 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func ContextAddCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add or replace a context with the given --server, --port, --cafile, --crtfile and --keyfile",
+		Run:   contextAdd,
+		Args:  cobra.ExactArgs(1),
+	}
+
+	return subCmd
+}
+
+func contextAdd(cmd *cobra.Command, args []string) {
+	name := args[0]
+
+	section := userConfig.Section(contextPrefix + name)
+	section.Key("server").SetValue(servername)
+	section.Key("port").SetValue(port)
+	section.Key("cafile").SetValue(caFile)
+	section.Key("crtfile").SetValue(crtFile)
+	section.Key("keyfile").SetValue(keyFile)
+
+	if err := saveUserConfig(); err != nil {
+		output.Fail(output.ExitFailure, "Cannot write %s: %v", usercfg, err)
+	}
+	output.Result(output.Reply{Success: true,
+		Message: fmt.Sprintf("Context '%s' for %s:%s added", name, servername, port)},
+		func() {
+			fmt.Printf("Context '%s' for %s:%s added\n", name, servername, port)
+		})
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func ContextListCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List all contexts, the current one is marked with '*'",
+		Run:   contextList,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func contextList(cmd *cobra.Command, args []string) {
+	current := userConfig.Section("global").Key("current-context").String()
+
+	type contextEntry struct {
+		Name    string `json:"name" yaml:"name"`
+		Server  string `json:"server" yaml:"server"`
+		Port    string `json:"port" yaml:"port"`
+		Current bool   `json:"current" yaml:"current"`
+	}
+	contexts := []contextEntry{}
+	for _, name := range contextNames() {
+		section := userConfig.Section(contextPrefix + name)
+		contexts = append(contexts, contextEntry{
+			Name:    name,
+			Server:  section.Key("server").MustString(servername),
+			Port:    section.Key("port").MustString(port),
+			Current: name == current,
+		})
+	}
+
+	output.Result(map[string][]contextEntry{"contexts": contexts}, func() {
+		for _, c := range contexts {
+			mark := " "
+			if c.Current {
+				mark = "*"
+			}
+			fmt.Printf("%s %s\t%s:%s\n", mark, c.Name, c.Server, c.Port)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func ContextRemoveCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "remove <name>",
+		Short:             "Remove a context",
+		Run:               contextRemove,
+		ValidArgsFunction: completeContexts,
+		Args:              cobra.ExactArgs(1),
+	}
+
+	return subCmd
+}
+
+func contextRemove(cmd *cobra.Command, args []string) {
+	name := args[0]
+
+	if _, err := userConfig.GetSection(contextPrefix + name); err != nil {
+		output.Fail(output.ExitFailure, "Unknown context '%s'", name)
+	}
+	userConfig.DeleteSection(contextPrefix + name)
+	if userConfig.Section("global").Key("current-context").String() == name {
+		userConfig.Section("global").DeleteKey("current-context")
+	}
+
+	if err := saveUserConfig(); err != nil {
+		output.Fail(output.ExitFailure, "Cannot write %s: %v", usercfg, err)
+	}
+	output.Result(output.Reply{Success: true,
+		Message: fmt.Sprintf("Context '%s' removed", name)}, func() {
+		fmt.Printf("Context '%s' removed\n", name)
+	})
+}
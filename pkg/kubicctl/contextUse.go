@@ -0,0 +1,58 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func ContextUseCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "use [<name>]",
+		Short:             "Make the context the default one, without name the [global] settings are used again",
+		Run:               contextUse,
+		ValidArgsFunction: completeContexts,
+		Args:              cobra.MaximumNArgs(1),
+	}
+
+	return subCmd
+}
+
+func contextUse(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		userConfig.Section("global").DeleteKey("current-context")
+	} else {
+		if _, err := userConfig.GetSection(contextPrefix + args[0]); err != nil {
+			output.Fail(output.ExitFailure, "Unknown context '%s'", args[0])
+		}
+		userConfig.Section("global").Key("current-context").SetValue(args[0])
+	}
+
+	if err := saveUserConfig(); err != nil {
+		output.Fail(output.ExitFailure, "Cannot write %s: %v", usercfg, err)
+	}
+	current := ""
+	if len(args) > 0 {
+		current = args[0]
+	}
+	output.Result(map[string]string{"current_context": current}, func() {
+		if len(current) > 0 {
+			fmt.Printf("Switched to context '%s'\n", current)
+		}
+	})
+}
@@ -16,13 +16,17 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
 	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	organization       = ""
+	organizationalUnit = ""
 )
 
 func CreateCertsCmd() *cobra.Command {
@@ -33,6 +37,9 @@ func CreateCertsCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 	}
 
+	subCmd.PersistentFlags().StringVar(&organization, "organization", organization, "Organization (O) of the certificate, usable as RBAC group")
+	subCmd.PersistentFlags().StringVar(&organizationalUnit, "organizational-unit", organizationalUnit, "Organizational unit (OU) of the certificate, usable as RBAC group")
+
 	return subCmd
 }
 
@@ -42,7 +49,7 @@ func createCerts(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -51,33 +58,32 @@ func createCerts(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
 
-	r, err := c.CreateCert(ctx, &pb.CreateCertRequest{Name: user})
+	r, err := c.CreateCert(ctx, &pb.CreateCertRequest{Name: user,
+		Organization: organization, OrganizationalUnit: organizationalUnit})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
-		os.Exit(1)
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Couldn't create certificate for %s: %s", user, r.Message)
+	}
+	if len(r.Message) > 0 {
+		output.Info("%s\n", r.Message)
 	}
-	if r.Success {
-		if len(r.Message) > 0 {
-			fmt.Printf(r.Message + "\n")
-		}
-
-		key := []byte(r.Key)
-		crt := []byte(r.Crt)
 
-		fmt.Printf("Writing %s.key...\n", user)
-		err := ioutil.WriteFile(user+".key", key, 0600)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing '%s.key': %v\n", user, err)
-			os.Exit(1)
-		}
-		fmt.Printf("Writing %s.crt...\n", user)
-		err = ioutil.WriteFile(user+".crt", crt, 0600)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing '%s.crt': %v\n", user, err)
-			os.Exit(1)
-		}
-	} else {
-		fmt.Fprintf(os.Stderr, "Couldn't create certificate for %s: %s\n", user, r.Message)
-		os.Exit(1)
+	output.Info("Writing %s.key...\n", user)
+	err = ioutil.WriteFile(user+".key", []byte(r.Key), 0600)
+	if err != nil {
+		output.Fail(output.ExitFailure, "Error writing '%s.key': %v", user, err)
 	}
+	output.Info("Writing %s.crt...\n", user)
+	err = ioutil.WriteFile(user+".crt", []byte(r.Crt), 0600)
+	if err != nil {
+		output.Fail(output.ExitFailure, "Error writing '%s.crt': %v", user, err)
+	}
+
+	output.Result(struct {
+		User    string `json:"user" yaml:"user"`
+		KeyFile string `json:"key_file" yaml:"key_file"`
+		CrtFile string `json:"crt_file" yaml:"crt_file"`
+	}{user, user + ".key", user + ".crt"}, func() {})
 }
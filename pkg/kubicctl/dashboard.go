@@ -0,0 +1,513 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+	"golang.org/x/term"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	dashboardRefresh = 10 * time.Second
+)
+
+// operation is an action started from the dashboard, the last
+// message streamed by kubicd is shown as progress.
+type operation struct {
+	// operation ID assigned by kubicd
+	id      string
+	title   string
+	running bool
+	success bool
+	message string
+}
+
+// nodeAction is an action on the selected node, which needs to be
+// confirmed before it is called.
+type nodeAction struct {
+	title string
+	call  func(d *dashboard, node string, op *operation)
+}
+
+// pendingAction is an action waiting for confirmation. The node is
+// stored when the key is pressed, a refresh may change the node list
+// while the question is shown.
+type pendingAction struct {
+	nodeAction
+	node string
+}
+
+type dashboard struct {
+	mu sync.Mutex
+
+	// canceled when the dashboard is closed
+	ctx        context.Context
+	conn       *grpc.ClientConn
+	nodes      []string
+	nodesErr   string
+	status     []output.Reply
+	addons     []output.Reply
+	operations []*operation
+	// running operations of all callers of kubicd
+	running    []*pb.RunningOperation
+	runningErr string
+	updated    time.Time
+
+	selected int
+	// action waiting for confirmation
+	confirm *pendingAction
+	notice  string
+
+	redraw chan struct{}
+}
+
+var nodeActions = map[byte]nodeAction{
+	'r': {title: "Reboot", call: (*dashboard).rebootNode},
+	'd': {title: "Drain", call: (*dashboard).drainNode},
+	'u': {title: "Uncordon", call: (*dashboard).uncordonNode},
+	'x': {title: "Remove", call: (*dashboard).removeNode},
+}
+
+func DashboardCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "dashboard",
+		Short: "Show nodes, status and deployed services in a terminal UI and run actions on nodes",
+		Run:   runDashboard,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	subCmd.PersistentFlags().DurationVar(&dashboardRefresh, "refresh", dashboardRefresh, "Interval to refresh the node list and status")
+
+	return subCmd
+}
+
+func runDashboard(cmd *cobra.Command, args []string) {
+	if output.Format != "text" {
+		output.Fail(output.ExitFailure, "The dashboard supports only text output")
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		output.Fail(output.ExitFailure, "The dashboard needs a terminal")
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &dashboard{ctx: ctx, conn: conn, redraw: make(chan struct{}, 1)}
+
+	screen, err := openScreen()
+	if err != nil {
+		output.Fail(output.ExitFailure, "Cannot initialize terminal: %v", err)
+	}
+	defer screen.close()
+
+	go func() {
+		ticker := time.NewTicker(dashboardRefresh)
+		defer ticker.Stop()
+		for {
+			d.refresh()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	for {
+		screen.draw(d.render(screen.size()))
+		select {
+		case key, ok := <-screen.keys:
+			if !ok || !d.handleKey(key) {
+				return
+			}
+		case <-d.redraw:
+		case <-screen.resized:
+		}
+	}
+}
+
+// changed triggers a redraw of the screen.
+func (d *dashboard) changed() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// refresh fetches the node list, the status and the running
+// operations of kubicd. Status messages starting with "- " are the
+// deployed services with their drift state.
+func (d *dashboard) refresh() {
+	client := pb.NewKubeadmClient(d.conn)
+
+	ctx, cancel := context.WithTimeout(d.ctx, time.Minute)
+	defer cancel()
+
+	var nodes []string
+	nodesErr := ""
+	r, err := client.ListNodes(ctx, &pb.Empty{})
+	if err != nil {
+		nodesErr = status.Convert(err).Message()
+	} else if !r.Success {
+		nodesErr = r.Message
+	} else {
+		nodes = r.Node
+	}
+
+	var states, addons []output.Reply
+	stream, err := client.GetStatus(ctx, &pb.Empty{})
+	if err == nil {
+		for {
+			r, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				states = append(states, output.Reply{Message: status.Convert(err).Message()})
+				break
+			}
+			if strings.HasPrefix(r.Message, "- ") {
+				addons = append(addons, output.Reply{Success: r.Success,
+					Message: strings.TrimPrefix(r.Message, "- ")})
+			} else {
+				states = append(states, output.Reply{Success: r.Success, Message: r.Message})
+			}
+		}
+	} else {
+		states = append(states, output.Reply{Message: status.Convert(err).Message()})
+	}
+
+	var running []*pb.RunningOperation
+	runningErr := ""
+	ops, err := pb.NewAuditClient(d.conn).Operations(ctx, &pb.Empty{})
+	if err != nil {
+		runningErr = status.Convert(err).Message()
+	} else if !ops.Success {
+		runningErr = ops.Message
+	} else {
+		running = ops.Operation
+	}
+
+	d.mu.Lock()
+	d.nodes, d.nodesErr = nodes, nodesErr
+	d.status, d.addons = states, addons
+	d.running, d.runningErr = running, runningErr
+	d.updated = time.Now()
+	if d.selected >= len(d.nodes) {
+		d.selected = len(d.nodes) - 1
+	}
+	if d.selected < 0 {
+		d.selected = 0
+	}
+	d.mu.Unlock()
+	d.changed()
+}
+
+// handleKey processes one key press, false means quit.
+func (d *dashboard) handleKey(key byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.confirm != nil {
+		action := d.confirm
+		d.confirm = nil
+		if key == 'y' {
+			op := &operation{title: action.title + " " + action.node, running: true}
+			d.operations = append(d.operations, op)
+			d.notice = ""
+			go action.call(d, action.node, op)
+		} else {
+			d.notice = "Cancelled"
+		}
+		return true
+	}
+
+	switch key {
+	case 'q', keyCtrlC:
+		return false
+	case 'k', keyUp:
+		if d.selected > 0 {
+			d.selected--
+		}
+	case 'j', keyDown:
+		if d.selected < len(d.nodes)-1 {
+			d.selected++
+		}
+	case 'g':
+		go d.refresh()
+	default:
+		if action, ok := nodeActions[key]; ok && d.selected < len(d.nodes) {
+			d.confirm = &pendingAction{action, d.nodes[d.selected]}
+		}
+	}
+	return true
+}
+
+// setID stores the operation ID kubicd returned in the header.
+func (d *dashboard) setID(op *operation, header metadata.MD) {
+	if ids := header.Get("operation-id"); len(ids) > 0 {
+		d.mu.Lock()
+		op.id = ids[0]
+		d.mu.Unlock()
+	}
+}
+
+// update stores the progress of an operation.
+func (d *dashboard) update(op *operation, running bool, success bool, message string) {
+	d.mu.Lock()
+	op.running, op.success, op.message = running, success, message
+	d.mu.Unlock()
+	d.changed()
+}
+
+// rebootNode reboots the node with RollingReboot, which waits until
+// the node is Ready again and uncordons it.
+func (d *dashboard) rebootNode(node string, op *operation) {
+	client := pb.NewKubeadmClient(d.conn)
+
+	ctx, cancel := context.WithTimeout(d.ctx, time.Hour)
+	defer cancel()
+
+	stream, err := client.RollingReboot(ctx, &pb.RollingRebootRequest{NodeNames: node})
+	if err != nil {
+		d.update(op, false, false, status.Convert(err).Message())
+		return
+	}
+	d.follow(op, stream)
+}
+
+func (d *dashboard) drainNode(node string, op *operation) {
+	client := pb.NewKubeadmClient(d.conn)
+
+	ctx, cancel := context.WithTimeout(d.ctx, time.Hour)
+	defer cancel()
+
+	stream, err := client.DrainNode(ctx, &pb.DrainRequest{NodeNames: node})
+	if err != nil {
+		d.update(op, false, false, status.Convert(err).Message())
+		return
+	}
+	d.follow(op, stream)
+}
+
+func (d *dashboard) uncordonNode(node string, op *operation) {
+	client := pb.NewKubeadmClient(d.conn)
+
+	ctx, cancel := context.WithTimeout(d.ctx, 2*time.Minute)
+	defer cancel()
+
+	var header metadata.MD
+	r, err := client.UncordonNode(ctx, &pb.CordonRequest{NodeNames: node}, grpc.Header(&header))
+	d.setID(op, header)
+	if err != nil {
+		d.update(op, false, false, status.Convert(err).Message())
+	} else if !r.Success {
+		d.update(op, false, false, r.Message)
+	} else {
+		d.update(op, false, true, "Node uncordoned")
+	}
+}
+
+func (d *dashboard) removeNode(node string, op *operation) {
+	client := pb.NewKubeadmClient(d.conn)
+
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Minute)
+	defer cancel()
+
+	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: node})
+	if err != nil {
+		d.update(op, false, false, status.Convert(err).Message())
+		return
+	}
+	d.follow(op, stream)
+	go d.refresh()
+}
+
+// follow shows the replies of stream as progress of the operation.
+func (d *dashboard) follow(op *operation, stream statusStream) {
+	if s, ok := stream.(grpc.ClientStream); ok {
+		if header, err := s.Header(); err == nil {
+			d.setID(op, header)
+		}
+	}
+
+	success := true
+	message := ""
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			d.update(op, false, false, status.Convert(err).Message())
+			return
+		}
+		success, message = r.Success, r.Message
+		d.update(op, true, success, message)
+	}
+	d.update(op, false, success, message)
+}
+
+// render returns the lines of the screen.
+func (d *dashboard) render(width int, height int) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var lines []string
+	header := fmt.Sprintf("Kubic Control Dashboard - %s", kubicdName())
+	if !d.updated.IsZero() {
+		header += fmt.Sprintf(" (updated %s)", d.updated.Format("15:04:05"))
+	}
+	lines = append(lines, bold(header), "")
+
+	lines = append(lines, bold("Nodes"))
+	if d.updated.IsZero() {
+		lines = append(lines, "  Loading...")
+	} else if len(d.nodesErr) > 0 {
+		lines = append(lines, red("  "+d.nodesErr))
+	} else if len(d.nodes) == 0 {
+		lines = append(lines, "  No nodes")
+	}
+	for i, node := range d.nodes {
+		if i == d.selected {
+			lines = append(lines, inverse("> "+node))
+		} else {
+			lines = append(lines, "  "+node)
+		}
+	}
+	lines = append(lines, "")
+
+	lines = append(lines, bold("Status"))
+	for _, s := range d.status {
+		lines = append(lines, colored(s, "  "+s.Message))
+	}
+	lines = append(lines, "")
+
+	if len(d.addons) > 0 {
+		lines = append(lines, bold("Deployed services"))
+		for _, a := range d.addons {
+			if strings.HasSuffix(a.Message, "up to date") {
+				lines = append(lines, "  "+a.Message)
+			} else {
+				lines = append(lines, yellow("  "+a.Message))
+			}
+		}
+		lines = append(lines, "")
+	}
+
+	// operations started from the dashboard are shown with their
+	// live progress below
+	own := map[string]bool{}
+	for _, op := range d.operations {
+		if len(op.id) > 0 {
+			own[op.id] = true
+		}
+	}
+	lines = append(lines, bold("Running operations"))
+	shown := 0
+	if len(d.runningErr) > 0 {
+		lines = append(lines, red("  "+d.runningErr))
+		shown++
+	}
+	for _, op := range d.running {
+		if own[op.Id] {
+			continue
+		}
+		line := fmt.Sprintf("  [%s] %s %s", op.User,
+			strings.TrimPrefix(op.Method, "/api."), strings.Join(op.Targets, ","))
+		if len(op.Message) > 0 {
+			line += ": " + op.Message
+		}
+		lines = append(lines, colored(output.Reply{Success: op.Success, Message: line}, line))
+		shown++
+	}
+	if shown == 0 && !d.updated.IsZero() {
+		lines = append(lines, "  None")
+	}
+	lines = append(lines, "")
+
+	if len(d.operations) > 0 {
+		lines = append(lines, bold("Operations started from this dashboard"))
+		for _, op := range d.operations {
+			state := "done"
+			if op.running {
+				state = "running"
+			} else if !op.success {
+				state = "failed"
+			}
+			line := fmt.Sprintf("  [%s] %s: %s", state, op.title, op.message)
+			lines = append(lines, colored(output.Reply{Success: op.success, Message: line}, line))
+		}
+		lines = append(lines, "")
+	}
+
+	footer := "up/down select  r reboot  d drain  u uncordon  x remove  g refresh  q quit"
+	if d.confirm != nil {
+		footer = fmt.Sprintf("%s node %s? [y/N]", d.confirm.title, d.confirm.node)
+	} else if len(d.notice) > 0 {
+		footer = d.notice + " - " + footer
+	}
+
+	// keep the footer visible, cut the sections instead
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, inverse(footer))
+
+	for i := range lines {
+		lines[i] = truncate(lines[i], width)
+	}
+	return lines
+}
+
+// kubicdName returns where kubicctl is connected to.
+func kubicdName() string {
+	if !serverSet && len(socketPath) > 0 {
+		if found, _ := exists(socketPath); found {
+			return socketPath
+		}
+	}
+	return servername + ":" + port
+}
+
+func colored(r output.Reply, line string) string {
+	if r.Success {
+		return line
+	}
+	return red(line)
+}
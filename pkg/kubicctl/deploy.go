@@ -18,6 +18,12 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// deployResult is the document printed for a deployed service
+type deployResult struct {
+	Service string `json:"service" yaml:"service"`
+	Message string `json:"message" yaml:"message"`
+}
+
 func DeployCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
 		Use:   "deploy",
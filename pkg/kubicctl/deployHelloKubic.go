@@ -17,13 +17,12 @@ package kubicctl
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 var (
@@ -42,6 +41,8 @@ func DeployHelloKubicCmd() *cobra.Command {
 	subCmd.PersistentFlags().StringVarP(&service_type, "type", "t", service_type, "Type for this service: NodePort or LoadBalancer")
 	subCmd.PersistentFlags().StringVarP(&arg_lbip, "ip", "i", arg_lbip, "LoadBalancer IP")
 
+	subCmd.RegisterFlagCompletionFunc("type", completeWords("NodePort", "LoadBalancer"))
+
 	return subCmd
 }
 
@@ -50,7 +51,7 @@ func deployHelloKubic(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -76,24 +77,12 @@ func deployHelloKubic(cmd *cobra.Command, args []string) {
 	r, err := c.DeployKustomize(ctx,
 		&pb.DeployKustomizeRequest{Service: "hello-kubic", Argument: arg})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
-		os.Exit(1)
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
-	if r.Success {
-		if len(output) > 0 && output != "stdout" {
-			message := []byte(r.Message)
-			err := ioutil.WriteFile(output, message, 0600)
-			if err != nil {
-				fmt.Fprintf(os.Stderr,
-					"Error writing '%s': %v\n", output, err)
-				os.Exit(1)
-			}
-		} else {
-			fmt.Printf(r.Message)
-		}
-	} else {
-		fmt.Fprintf(os.Stderr, "Couldn't deploy hello-kubic: %s\n",
-			r.Message)
-		os.Exit(1)
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Couldn't deploy hello-kubic: %s", r.Message)
 	}
+	output.Result(deployResult{Service: "hello-kubic", Message: r.Message}, func() {
+		fmt.Print(r.Message)
+	})
 }
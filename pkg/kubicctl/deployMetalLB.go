@@ -17,12 +17,11 @@ package kubicctl
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func DeployMetalLBCmd() *cobra.Command {
@@ -37,13 +36,12 @@ func DeployMetalLBCmd() *cobra.Command {
 }
 
 func deployMetalLB(cmd *cobra.Command, args []string) {
-
 	iprange := args[0]
 
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -55,24 +53,12 @@ func deployMetalLB(cmd *cobra.Command, args []string) {
 	r, err := c.DeployKustomize(ctx,
 		&pb.DeployKustomizeRequest{Service: "metallb", Argument: iprange})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
-		os.Exit(1)
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
-	if r.Success {
-		if len(output) > 0 && output != "stdout" {
-			message := []byte(r.Message)
-			err := ioutil.WriteFile(output, message, 0600)
-			if err != nil {
-				fmt.Fprintf(os.Stderr,
-					"Error writing '%s': %v\n", output, err)
-				os.Exit(1)
-			}
-		} else {
-			fmt.Printf(r.Message)
-		}
-	} else {
-		fmt.Fprintf(os.Stderr, "Couldn't deploy metallb: %s\n",
-			r.Message)
-		os.Exit(1)
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Couldn't deploy metallb: %s", r.Message)
 	}
+	output.Result(deployResult{Service: "metallb", Message: r.Message}, func() {
+		fmt.Print(r.Message)
+	})
 }
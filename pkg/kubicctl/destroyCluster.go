@@ -16,13 +16,12 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func DestroyClusterCmd() *cobra.Command {
@@ -37,11 +36,10 @@ func DestroyClusterCmd() *cobra.Command {
 }
 
 func destroyCluster(cmd *cobra.Command, args []string) {
-
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -52,60 +50,28 @@ func destroyCluster(cmd *cobra.Command, args []string) {
 
 	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: "*"})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Removing all nodes failed: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Removing node %s failed: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
-		}
-		if r.Success != true {
-			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-		} else {
-			fmt.Printf("%s\n", r.Message)
-		}
-	}
+	// failing to remove some nodes does not stop destroying the master
+	nodesRetval := receiveStream(stream, "Removing all nodes")
 
-	fmt.Printf("All nodes removed, removing master...\n")
+	output.Info("All nodes removed, removing master...\n")
 
 	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
 	stream, err = client.DestroyMaster(ctx, &pb.Empty{})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Destroying master failed: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Destroying master failed: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
-		}
-		if r.Success != true {
-			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-		} else {
-			fmt.Printf("%s\n", r.Message)
-		}
+	retval := receiveStream(stream, "Destroying master")
+	if retval != output.ExitSuccess {
+		os.Exit(retval)
 	}
-
-	fmt.Printf("Kubernetes cluster completly removed!\n")
+	if nodesRetval != output.ExitSuccess {
+		os.Exit(output.ExitPartialFailure)
+	}
+	output.Info("Kubernetes cluster completly removed!\n")
 }
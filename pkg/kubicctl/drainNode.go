@@ -0,0 +1,76 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	drainTimeout  = "10m"
+	gracePeriod   = int32(0)
+	podSelector   = ""
+	keepLocalData = false
+	noForce       = false
+)
+
+func DrainNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "drain <nodes>",
+		Short:             "Evict all pods from nodes and mark them as unschedulable",
+		Run:               drainNode,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&drainTimeout, "timeout", drainTimeout, "How long to try evicting the pods of a node")
+	subCmd.PersistentFlags().Int32Var(&gracePeriod, "grace-period", gracePeriod, "Seconds the pods have to terminate, 0 uses the value of the pod")
+	subCmd.PersistentFlags().StringVar(&podSelector, "pod-selector", podSelector, "Only evict pods matching this label selector")
+	subCmd.PersistentFlags().BoolVar(&keepLocalData, "keep-local-data", keepLocalData, "Don't delete pods using emptyDir volumes, fail instead")
+	subCmd.PersistentFlags().BoolVar(&noForce, "no-force", noForce, "Don't delete pods not managed by a controller, fail instead")
+
+	return subCmd
+}
+
+func drainNode(cmd *cobra.Command, args []string) {
+	nodes := args[0]
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Hour)
+	defer cancel()
+
+	stream, err := client.DrainNode(ctx, &pb.DrainRequest{NodeNames: nodes,
+		Timeout: drainTimeout, GracePeriod: gracePeriod, PodSelector: podSelector,
+		KeepLocalData: keepLocalData, NoForce: noForce})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Draining node "+nodes))
+}
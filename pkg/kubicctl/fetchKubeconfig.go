@@ -18,14 +18,14 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
-var output = ""
+var kubeconfigFile = ""
 
 func FetchKubeconfigCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
@@ -35,17 +35,17 @@ func FetchKubeconfigCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(0),
 	}
 
-	subCmd.PersistentFlags().StringVarP(&output, "output", "o", "stdout", "File kubeconfig should be stored")
+	// overrides the global --output, the kubeconfig is always YAML
+	subCmd.Flags().StringVarP(&kubeconfigFile, "output", "o", "stdout", "File kubeconfig should be stored")
 
 	return subCmd
 }
 
 func fetchKubeconfig(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
-
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -56,22 +56,19 @@ func fetchKubeconfig(cmd *cobra.Command, args []string) {
 
 	r, err := c.FetchKubeconfig(ctx, &pb.Empty{})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
-		os.Exit(1)
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Couldn't get kubeconfig: %s", r.Message)
 	}
-	if r.Success {
-		if len(output) > 0 && output != "stdout" {
-			message := []byte(r.Message)
-			err := ioutil.WriteFile(output, message, 0600)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing '%s': %v\n", output, err)
-				os.Exit(1)
-			}
-		} else {
-			fmt.Printf(r.Message)
+
+	// the kubeconfig is YAML already, so it is always written as it is
+	if len(kubeconfigFile) > 0 && kubeconfigFile != "stdout" {
+		err := ioutil.WriteFile(kubeconfigFile, []byte(r.Message), 0600)
+		if err != nil {
+			output.Fail(output.ExitFailure, "Error writing '%s': %v", kubeconfigFile, err)
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "Couldn't get kubeconfig: %s\n", r.Message)
-		os.Exit(1)
+		fmt.Print(r.Message)
 	}
 }
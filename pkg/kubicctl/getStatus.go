@@ -16,14 +16,12 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
 	"io"
-	"os"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func GetStatusCmd() *cobra.Command {
@@ -41,7 +39,7 @@ func getStatus(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -52,24 +50,27 @@ func getStatus(cmd *cobra.Command, args []string) {
 
 	stream, err := client.GetStatus(ctx, &pb.Empty{})
 	if err != nil {
-		log.Errorf("could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	fmt.Printf("Kubicctl version %s\n", Version)
+	// unsuccessful replies are part of the status and don't make
+	// the command fail
+	status := struct {
+		Version string         `json:"kubicctl_version" yaml:"kubicctl_version"`
+		Status  []output.Reply `json:"status" yaml:"status"`
+	}{Version: Version}
+
+	output.Info("Kubicctl version %s\n", Version)
 	for {
 		r, err := stream.Recv()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "ERROR: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
+			output.Fail(output.ExitCode(err), "Getting status failed: %v", err)
 		}
-		fmt.Printf("%s\n", r.Message)
+		output.Info("%s\n", r.Message)
+		status.Status = append(status.Status, output.Reply{Success: r.Success, Message: r.Message})
 	}
+	output.Result(status, func() {})
 }
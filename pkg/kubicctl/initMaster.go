@@ -16,13 +16,12 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 var (
@@ -32,7 +31,10 @@ var (
 	multiMaster               = ""
 	kubernetesVersion         = ""
 	stage                     = ""
+	imageRepository           = ""
 	haproxy                   = ""
+	vip                       = ""
+	routerID                  = 0
 	firstMaster               = ""
 )
 
@@ -50,18 +52,25 @@ func InitMasterCmd() *cobra.Command {
 	subCmd.PersistentFlags().StringVar(&apiserver_cert_extra_sans, "apiserver-cert-extra-sans", apiserver_cert_extra_sans, "additional IPs to add to the APIserver certificate")
 	subCmd.PersistentFlags().StringVar(&kubernetesVersion, "kubernetes-version", kubernetesVersion, "Kubernetes version of the control plane to deploy")
 	subCmd.PersistentFlags().StringVar(&stage, "stage", stage, "Stage of development: 'official', 'devel'")
-	subCmd.PersistentFlags().StringVar(&haproxy, "haproxy", haproxy, "Name of salt minion running haproxy as loadbalancer")
+	subCmd.PersistentFlags().StringVar(&imageRepository, "image-repository", imageRepository, "Registry to pull the control plane images from")
+	subCmd.PersistentFlags().StringVar(&haproxy, "haproxy", haproxy, "Name of salt minion running haproxy as loadbalancer, a comma separated list for several")
+	subCmd.PersistentFlags().StringVar(&vip, "vip", vip, "Virtual IP shared by the haproxy minions with keepalived, used as control plane endpoint")
+	subCmd.PersistentFlags().IntVar(&routerID, "router-id", routerID, "VRRP router id of the virtual IP (1-255), derived from the virtual IP by default")
 	subCmd.PersistentFlags().StringVar(&firstMaster, "salt", firstMaster, "Name of salt minion of first master")
 
+	subCmd.RegisterFlagCompletionFunc("pod-network", completeWords("flannel", "weave", "none"))
+	subCmd.RegisterFlagCompletionFunc("stage", completeWords("official", "devel"))
+	subCmd.RegisterFlagCompletionFunc("haproxy", completeMinionFlag)
+	subCmd.RegisterFlagCompletionFunc("salt", completeMinionFlag)
+
 	return subCmd
 }
 
 func initMaster(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
-
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -70,30 +79,11 @@ func initMaster(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
 	defer cancel()
 
-	fmt.Print("Initializing kubernetes master can take several minutes, please be patient.\n")
-	stream, err := client.InitMaster(ctx, &pb.InitRequest{PodNetworking: podNetwork, AdvAddr: adv_addr, ApiserverCertExtraSans: apiserver_cert_extra_sans, MultiMaster: multiMaster, KubernetesVersion: kubernetesVersion, Stage: stage, Haproxy: haproxy, FirstMaster: firstMaster})
+	output.Info("Initializing kubernetes master can take several minutes, please be patient.\n")
+	stream, err := client.InitMaster(ctx, &pb.InitRequest{PodNetworking: podNetwork, AdvAddr: adv_addr, ApiserverCertExtraSans: apiserver_cert_extra_sans, MultiMaster: multiMaster, KubernetesVersion: kubernetesVersion, Stage: stage, ImageRepository: imageRepository, Haproxy: haproxy, Vip: vip, RouterId: int32(routerID), FirstMaster: firstMaster})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not initialize: %v\n", err)
-		return
-	}
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Creating Kubernetes master failed: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Creating Kubernetes master failed: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
-		} else {
-			if r.Success != true {
-				fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-			} else {
-				fmt.Printf("%s\n", r.Message)
-			}
-		}
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
+
+	os.Exit(receiveStream(stream, "Creating Kubernetes master"))
 }
@@ -16,9 +16,9 @@ package kubicctl
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func InitializeCertsCmd() *cobra.Command {
@@ -35,28 +35,25 @@ func InitializeCertsCmd() *cobra.Command {
 func initializeCerts(cmd *cobra.Command, args []string) {
 	err := CreateCA(PKI_dir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating CA: %v\n", err)
-		return
+		output.Fail(output.ExitFailure, "Error creating CA: %v", err)
 	}
 	err = CreateUser(PKI_dir, "KubicD")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating user 'KubicD': %v\n", err)
-		return
+		output.Fail(output.ExitFailure, "Error creating user 'KubicD': %v", err)
 	}
 	err = SignUser(PKI_dir, "KubicD")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error signing user 'KubicD': %v\n", err)
-		return
+		output.Fail(output.ExitFailure, "Error signing user 'KubicD': %v", err)
 	}
 	err = CreateUser(PKI_dir, "admin")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating user 'admin': %v\n", err)
-		return
+		output.Fail(output.ExitFailure, "Error creating user 'admin': %v", err)
 	}
 	err = SignUser(PKI_dir, "admin")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error signing user 'admin': %v\n", err)
-		return
+		output.Fail(output.ExitFailure, "Error signing user 'admin': %v", err)
 	}
-	fmt.Printf("All certificates and the CA are created and can be found in '%s'\n", PKI_dir)
+	output.Result(map[string]string{"pki_dir": PKI_dir}, func() {
+		fmt.Printf("All certificates and the CA are created and can be found in '%s'\n", PKI_dir)
+	})
 }
@@ -17,11 +17,12 @@ package kubicctl
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func ListNodesCmd() *cobra.Command {
@@ -39,7 +40,7 @@ func listNodes(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -50,20 +51,15 @@ func listNodes(cmd *cobra.Command, args []string) {
 
 	r, err := c.ListNodes(ctx, &pb.Empty{})
 	if err != nil {
-		log.Errorf("could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
-	if r.Success {
-		fmt.Printf("Reacheable nodes: ")
-		for i := range r.Node {
-			if i == 0 {
-				fmt.Print(r.Node[i])
-			} else {
-				fmt.Print(", " + r.Node[i])
-			}
-		}
-		fmt.Print("\n")
-	} else {
-		log.Errorf("Getting list of nodes failed: %s", r.Message)
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Getting list of nodes failed: %s", r.Message)
 	}
+
+	output.Result(struct {
+		Nodes []string `json:"nodes" yaml:"nodes"`
+	}{r.Node}, func() {
+		fmt.Printf("Reacheable nodes: %s\n", strings.Join(r.Node, ", "))
+	})
 }
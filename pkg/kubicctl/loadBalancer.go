@@ -0,0 +1,70 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	addLoadBalancers    []string
+	removeLoadBalancers []string
+)
+
+func LoadBalancerCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "loadbalancer",
+		Short: "Add or replace the haproxy load balancers of the API servers",
+		Run:   updateLoadBalancer,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	subCmd.PersistentFlags().StringArrayVar(&addLoadBalancers, "add", addLoadBalancers, "Salt name of a haproxy minion to add, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&removeLoadBalancers, "remove", removeLoadBalancers, "Salt name of a haproxy minion to remove, can be used several times")
+	subCmd.PersistentFlags().StringVar(&vip, "vip", vip, "Virtual IP shared by the haproxy minions with keepalived")
+	subCmd.PersistentFlags().IntVar(&routerID, "router-id", routerID, "VRRP router id of the virtual IP (1-255), default is the one used at init")
+	subCmd.RegisterFlagCompletionFunc("add", completeMinionFlag)
+	subCmd.RegisterFlagCompletionFunc("remove", completeMinionFlag)
+
+	return subCmd
+}
+
+func updateLoadBalancer(cmd *cobra.Command, args []string) {
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Hour)
+	defer cancel()
+
+	stream, err := client.UpdateLoadBalancer(ctx, &pb.LoadBalancerRequest{Add: addLoadBalancers,
+		Remove: removeLoadBalancers, Vip: vip, RouterId: int32(routerID)})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Updating load balancers"))
+}
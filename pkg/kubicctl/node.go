@@ -42,6 +42,13 @@ func NodeCmd() *cobra.Command {
 		AddNodeCmd(),
 		RemoveNodeCmd(),
 		RebootNodeCmd(),
+		RollingRebootCmd(),
+		CordonNodeCmd(),
+		DrainNodeCmd(),
+		UncordonNodeCmd(),
+		NodeMetadataCmd(),
+		ConfigureKubeletCmd(),
+		PrepullImagesCmd(),
 		ListNodesCmd(),
 		DeployNodeCmd(),
 	)
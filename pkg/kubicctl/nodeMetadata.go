@@ -0,0 +1,69 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func NodeMetadataCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "metadata <nodes>",
+		Short:             "Change labels, taints and node-role of nodes, without options the recorded ones are applied again",
+		Run:               nodeMetadata,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.ExactArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringArrayVar(&nodeLabels, "label", nodeLabels, "Label key=value to set or key- to remove, can be used several times")
+	subCmd.PersistentFlags().StringArrayVar(&nodeTaints, "taint", nodeTaints, "Taint key=value:Effect to set, key:Effect- or key- to remove, can be used several times")
+	subCmd.PersistentFlags().StringVar(&nodeRole, "node-role", nodeRole, "Sets the label node-role.kubernetes.io/<role>, '-' removes it")
+
+	return subCmd
+}
+
+func nodeMetadata(cmd *cobra.Command, args []string) {
+	nodes := args[0]
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	r, err := c.UpdateNodeMetadata(ctx, &pb.NodeMetadataRequest{NodeNames: nodes,
+		Labels: nodeLabels, Taints: nodeTaints, NodeRole: nodeRole})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Updating node %s failed: %s", nodes, r.Message)
+	}
+	output.Result(output.Reply{Success: r.Success, Message: r.Message}, func() {
+		fmt.Printf("Node %s updated\n", nodes)
+	})
+}
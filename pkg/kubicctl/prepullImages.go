@@ -0,0 +1,79 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	prepullRole     = ""
+	prepullSelector = ""
+	prepullAddons   = false
+)
+
+func PrepullImagesCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "prepull [<nodes>]",
+		Short:             "Pull the control plane and add-on images on nodes",
+		Run:               prepullImages,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&prepullRole, "role", prepullRole, "Only nodes of this role: 'worker' or 'master'")
+	subCmd.PersistentFlags().StringVarP(&prepullSelector, "selector", "l", prepullSelector, "Only nodes matching this label selector")
+	subCmd.PersistentFlags().StringVar(&kubernetesVersion, "kubernetes-version", kubernetesVersion, "Kubernetes version of the images, default is the version of the cluster")
+	subCmd.PersistentFlags().StringVar(&imageRepository, "image-repository", imageRepository, "Registry to pull the control plane images from, default is the one of the cluster")
+	subCmd.PersistentFlags().BoolVar(&prepullAddons, "addons", prepullAddons, "Pull the images of the deployed add-ons, too")
+	subCmd.RegisterFlagCompletionFunc("role", completeWords("worker", "master"))
+
+	return subCmd
+}
+
+func prepullImages(cmd *cobra.Command, args []string) {
+	nodes := ""
+	if len(args) > 0 {
+		nodes = args[0]
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	defer cancel()
+
+	stream, err := client.PrepullImages(ctx, &pb.PrepullRequest{NodeNames: nodes,
+		Role: prepullRole, LabelSelector: prepullSelector,
+		KubernetesVersion: kubernetesVersion, ImageRepository: imageRepository,
+		Addons: prepullAddons})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Pulling images"))
+}
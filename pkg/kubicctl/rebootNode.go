@@ -19,30 +19,30 @@ import (
 	"fmt"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func RebootNodeCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
-		Use:   "reboot <node>",
-		Short: "Reboot node",
-		Run:   rebootNode,
-		Args:  cobra.ExactArgs(1),
+		Use:               "reboot <node>",
+		Short:             "Reboot node",
+		Run:               rebootNode,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.ExactArgs(1),
 	}
 
 	return subCmd
 }
 
 func rebootNode(cmd *cobra.Command, args []string) {
-	// Set up a connection to the server.
-
 	nodes := args[0]
 
+	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -53,12 +53,12 @@ func rebootNode(cmd *cobra.Command, args []string) {
 
 	r, err := c.RebootNode(ctx, &pb.RebootNodeRequest{NodeNames: nodes})
 	if err != nil {
-		log.Errorf("could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
-	if r.Success {
-		fmt.Printf("Node %s rebootd\n", nodes)
-	} else {
-		log.Errorf("Removing node %s failed: %s", nodes, r.Message)
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Rebooting node %s failed: %s", nodes, r.Message)
 	}
+	output.Result(output.Reply{Success: r.Success, Message: r.Message}, func() {
+		fmt.Printf("Node %s drained, reboot started\n", nodes)
+	})
 }
@@ -0,0 +1,134 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+	"golang.org/x/term"
+)
+
+var (
+	credentialsRole     = ""
+	credentialsSelector = ""
+	registryUsers       []string
+	removeCredentials   = false
+	credentialsTimeout  = "5m"
+)
+
+func RegistryCredentialsCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "credentials [<nodes>]",
+		Short:             "Replace the registry credentials of nodes and restart crio one node after the other",
+		Long:              "Replace the registry credentials of crio and the kubelet on the nodes with the given ones.\nThe passwords are prompted for, or read line by line from stdin if it is not a terminal.",
+		Run:               registryCredentials,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&credentialsRole, "role", credentialsRole, "Only nodes of this role: 'worker' or 'master'")
+	subCmd.PersistentFlags().StringVarP(&credentialsSelector, "selector", "l", credentialsSelector, "Only nodes matching this label selector")
+	subCmd.PersistentFlags().StringArrayVar(&registryUsers, "registry", registryUsers, "Registry and user registry=username to log in with, can be used several times")
+	subCmd.PersistentFlags().BoolVar(&removeCredentials, "remove-all", removeCredentials, "Remove all registry credentials")
+	subCmd.PersistentFlags().StringVar(&credentialsTimeout, "timeout", credentialsTimeout, "Time to wait until a node is Ready again")
+	subCmd.RegisterFlagCompletionFunc("role", completeWords("worker", "master"))
+
+	return subCmd
+}
+
+// readPasswords asks for the password of every credential, without
+// terminal one password per line is read from stdin.
+func readPasswords(credentials []*pb.RegistryCredential) error {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		for _, c := range credentials {
+			fmt.Fprintf(os.Stderr, "Password for %s@%s: ", c.Username, c.Registry)
+			password, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return err
+			}
+			c.Password = string(password)
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for _, c := range credentials {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("No password for %s@%s on stdin", c.Username, c.Registry)
+		}
+		c.Password = strings.TrimSuffix(scanner.Text(), "\r")
+	}
+	return nil
+}
+
+func registryCredentials(cmd *cobra.Command, args []string) {
+	nodes := ""
+	if len(args) > 0 {
+		nodes = args[0]
+	}
+
+	if len(registryUsers) == 0 && !removeCredentials {
+		output.Fail(output.ExitFailure, "Use --registry to set credentials or --remove-all to remove them")
+	}
+	if len(registryUsers) > 0 && removeCredentials {
+		output.Fail(output.ExitFailure, "--registry and --remove-all cannot be used together")
+	}
+
+	var credentials []*pb.RegistryCredential
+	for _, entry := range registryUsers {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			output.Fail(output.ExitFailure, "Invalid registry '%s', expected registry=username", entry)
+		}
+		credentials = append(credentials, &pb.RegistryCredential{Registry: kv[0], Username: kv[1]})
+	}
+	if err := readPasswords(credentials); err != nil {
+		output.Fail(output.ExitFailure, "Cannot read password: %v", err)
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewRuntimeClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	defer cancel()
+
+	stream, err := client.SetRegistryCredentials(ctx, &pb.RegistryCredentialsRequest{NodeNames: nodes,
+		Role: credentialsRole, LabelSelector: credentialsSelector,
+		Credentials: credentials, Timeout: credentialsTimeout})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Updating registry credentials"))
+}
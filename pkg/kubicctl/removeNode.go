@@ -16,34 +16,33 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func RemoveNodeCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
-		Use:   "remove <node>",
-		Short: "Remove node from cluster",
-		Run:   removeNode,
-		Args:  cobra.ExactArgs(1),
+		Use:               "remove <node>",
+		Short:             "Remove node from cluster",
+		Run:               removeNode,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.ExactArgs(1),
 	}
 
 	return subCmd
 }
 
 func removeNode(cmd *cobra.Command, args []string) {
-	// Set up a connection to the server.
-
 	nodes := args[0]
 
+	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -54,29 +53,10 @@ func removeNode(cmd *cobra.Command, args []string) {
 
 	stream, err := client.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeNames: nodes})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
-		return
-	}
-
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Removing node %s failed: %v\n", nodes, err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Removing node %s failed: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
-		}
-		if r.Success != true {
-			fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-		} else {
-			fmt.Printf("%s\n", r.Message)
-		}
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	fmt.Printf("Please make sure to reboot the Nodes before re-using them.\n")
+	retval := receiveStream(stream, "Removing node "+nodes)
+	output.Info("Please make sure to reboot the Nodes before re-using them.\n")
+	os.Exit(retval)
 }
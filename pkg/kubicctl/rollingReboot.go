@@ -0,0 +1,79 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	rebootRole     = ""
+	maxUnavailable = int32(1)
+	readyTimeout   = "15m"
+)
+
+func RollingRebootCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "rolling-reboot [<nodes>]",
+		Short:             "Reboot nodes one after the other, waiting until they are Ready again",
+		Run:               rollingReboot,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.MaximumNArgs(1),
+	}
+
+	subCmd.PersistentFlags().StringVar(&rebootRole, "role", rebootRole, "Reboot all nodes of this role: 'worker' or 'master'")
+	subCmd.PersistentFlags().Int32Var(&maxUnavailable, "max-unavailable", maxUnavailable, "Number of workers rebooted at the same time")
+	subCmd.PersistentFlags().StringVar(&readyTimeout, "timeout", readyTimeout, "Time to wait until a node is Ready again")
+	subCmd.RegisterFlagCompletionFunc("role", completeWords("worker", "master"))
+
+	return subCmd
+}
+
+func rollingReboot(cmd *cobra.Command, args []string) {
+	nodes := ""
+	if len(args) > 0 {
+		nodes = args[0]
+	}
+	if len(nodes) == 0 && len(rebootRole) == 0 {
+		output.Fail(output.ExitFailure, "Nodes or --role are required")
+	}
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	// rebooting a big cluster takes some time
+	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	defer cancel()
+
+	stream, err := client.RollingReboot(ctx, &pb.RollingRebootRequest{NodeNames: nodes,
+		Role: rebootRole, MaxUnavailable: maxUnavailable, Timeout: readyTimeout})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+
+	os.Exit(receiveStream(stream, "Rolling reboot"))
+}
@@ -17,12 +17,14 @@ package kubicctl
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"syscall"
 
 	homedir "github.com/mitchellh/go-homedir"
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
 	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -42,6 +44,11 @@ var (
 
 	usercfg = "~/.config/kubicctl/kubicctl.conf"
 
+	// Local socket of kubicd, preferred if it exists, no server was
+	// configured and kubicd maps the caller to a RBAC user
+	socketPath = "/run/kubicd/kubicd.sock"
+	serverSet  = false
+
 	// Client Certificates
 	crtFile = "~/.config/kubicctl/user.crt"
 	keyFile = "~/.config/kubicctl/user.key"
@@ -66,13 +73,23 @@ func Execute() error {
 	if err == nil {
 		cfg, cfg_err := ini.LooseLoad(homecfg)
 		if cfg_err, ok := cfg_err.(*os.PathError); ok {
-			log.Fatal(cfg_err)
+			output.Fail(output.ExitFailure, "%v", cfg_err)
+		}
+		userConfig = cfg
+		usercfg = homecfg
+		if cfg.Section("global").HasKey("current-context") {
+			contextName = cfg.Section("global").Key("current-context").String()
 		}
 		if cfg.Section("global").HasKey("server") {
 			servername = cfg.Section("global").Key("server").String()
+			serverSet = true
 		}
 		if cfg.Section("global").HasKey("port") {
 			port = cfg.Section("global").Key("port").String()
+			serverSet = true
+		}
+		if cfg.Section("global").HasKey("socket") {
+			socketPath = cfg.Section("global").Key("socket").String()
 		}
 	}
 
@@ -92,18 +109,35 @@ func Execute() error {
 
 	rootCmd := &cobra.Command{
 		Use:   "kubicctl",
-		Short: "Kubic Control  Daemon Interface"}
+		Short: "Kubic Control  Daemon Interface",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := output.Validate(); err != nil {
+				output.Fail(output.ExitFailure, "%v", err)
+			}
+			applyContext(cmd)
+			if err := applyConnectionFlags(cmd); err != nil {
+				output.Fail(output.ExitFailure, "%v", err)
+			}
+		},
+	}
 
 	rootCmd.Version = Version
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.PersistentFlags().StringVarP(&output.Format, "output", "o", output.Format, "Output format: text, json or yaml")
+	rootCmd.PersistentFlags().StringVar(&contextName, "context", contextName, "Name of the context (kubicd server and certificates) to use")
 	rootCmd.PersistentFlags().StringVarP(&servername, "server", "s", servername, "Name of server kubicd is running on")
 	rootCmd.PersistentFlags().StringVarP(&port, "port", "p", port, "Port on which kubicd is listening")
+	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", socketPath, "Local socket of kubicd, used instead of server and certificates if it exists and maps the caller to a RBAC user")
 	rootCmd.PersistentFlags().StringVar(&crtFile, "crtfile", crtFile, "Certificate with the public key for the user")
 	rootCmd.PersistentFlags().StringVar(&keyFile, "keyfile", keyFile, "Private key for the user")
 	rootCmd.PersistentFlags().StringVar(&caFile, "cafile", caFile, "Certificate with the public key of the CA for the server certificate")
+	rootCmd.PersistentFlags().StringVar(&approvalID, "approval-id", approvalID, "ID of the approved request, if the call needs the approval of a second user")
 	rootCmd.AddCommand(
 		VersionCmd(),
 		InitMasterCmd(),
 		NodeCmd(),
+		RuntimeCmd(),
+		LoadBalancerCmd(),
 		UpgradeKubernetesCmd(),
 		FetchKubeconfigCmd(),
 		CertificatesCmd(),
@@ -111,49 +145,96 @@ func Execute() error {
 		rbac.RBACCmd(),
 		GetStatusCmd(),
 		DeployCmd(),
+		AuditCmd(),
+		ApproveCmd(),
+		ContextCmd(),
+		DashboardCmd(),
+		CompletionCmd(),
 	)
 
+	rootCmd.RegisterFlagCompletionFunc("output", completeWords("text", "json", "yaml"))
+	rootCmd.RegisterFlagCompletionFunc("context", completeContexts)
+
+	if err := rootCmd.Execute(); err != nil {
+		// log.Fatal(err)
+		return err
+	}
+
+	return nil
+}
+
+// applyConnectionFlags evaluates the options for the connection to
+// kubicd after the context was applied.
+func applyConnectionFlags(cmd *cobra.Command) error {
+	if cmd.Flags().Changed("server") || cmd.Flags().Changed("port") {
+		serverSet = true
+	}
+
+	var err error
 	crtFile, err = homedir.Expand(crtFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	keyFile, err = homedir.Expand(keyFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	caFile, err = homedir.Expand(caFile)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return err
+}
 
-	if err := rootCmd.Execute(); err != nil {
-		// log.Fatal(err)
-		return err
-	}
+// W_OK of access(2), syscall does not define it
+const accessWrite = 0x2
 
-	return nil
+// useSocket returns true if the local socket should be used instead
+// of a TLS connection with the client certificate. The socket is only
+// preferred if kubicd maps the caller to a RBAC user, else callers with
+// a certificate but without [local] entry would be refused.
+func useSocket() bool {
+	if serverSet || len(socketPath) == 0 {
+		return false
+	}
+	if found, _ := exists(socketPath); !found {
+		return false
+	}
+	if syscall.Access(socketPath, accessWrite) != nil {
+		return false
+	}
+	if found, _ := exists(crtFile); !found {
+		// no certificate, nothing else to try
+		return true
+	}
+	// rbac.conf may not be readable, use the certificate then
+	rbacUser, _ := rbac.LocalUser(uint32(os.Getuid()))
+	return len(rbacUser) > 0
 }
 
 func CreateConnection() (*grpc.ClientConn, error) {
+	if useSocket() {
+		conn, err := grpc.Dial("unix://"+socketPath, grpc.WithInsecure(),
+			grpc.WithUnaryInterceptor(approvalInterceptor))
+		if err != nil {
+			return nil, fmt.Errorf("did not connect: %v", err)
+		}
+		return conn, nil
+	}
+
 	// Load the certificates from disk
 	certificate, err := tls.LoadX509KeyPair(crtFile, keyFile)
 	if err != nil {
-		log.Errorf("could not load client key pair: %s", err)
-		return nil, err
+		return nil, fmt.Errorf("could not load client key pair: %v", err)
 	}
 
 	// Create a certificate pool from the certificate authority
 	certPool := x509.NewCertPool()
 	ca, err := ioutil.ReadFile(caFile)
 	if err != nil {
-		log.Errorf("could not read ca certificate: %s", err)
-		return nil, err
+		return nil, fmt.Errorf("could not read ca certificate: %v", err)
 	}
 
 	// Append the client certificates from the CA
 	if ok := certPool.AppendCertsFromPEM(ca); !ok {
-		log.Error("failed to append ca pki")
-		return nil, err
+		return nil, fmt.Errorf("failed to append ca pki")
 	}
 
 	// Create the TLS credentials for transport
@@ -163,10 +244,10 @@ func CreateConnection() (*grpc.ClientConn, error) {
 		RootCAs:      certPool,
 	})
 
-	conn, err := grpc.Dial(servername+":"+port, grpc.WithTransportCredentials(creds))
+	conn, err := grpc.Dial(servername+":"+port, grpc.WithTransportCredentials(creds),
+		grpc.WithUnaryInterceptor(approvalInterceptor))
 	if err != nil {
-		log.Errorf("did not connect: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("did not connect: %v", err)
 	}
 
 	return conn, nil
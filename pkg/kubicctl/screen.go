@@ -0,0 +1,149 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// Keys besides the printable characters returned by the screen
+const (
+	keyCtrlC = 0x03
+	keyUp    = 0x80
+	keyDown  = 0x81
+)
+
+// screen is the terminal in raw mode, drawn with ANSI escape
+// sequences in the alternate screen buffer.
+type screen struct {
+	fd      int
+	state   *term.State
+	keys    chan byte
+	resized chan os.Signal
+}
+
+func openScreen() (*screen, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &screen{
+		fd:      fd,
+		state:   state,
+		keys:    make(chan byte),
+		resized: make(chan os.Signal, 1),
+	}
+	signal.Notify(s.resized, syscall.SIGWINCH)
+
+	// alternate screen, hide cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+
+	go s.readKeys()
+	return s, nil
+}
+
+func (s *screen) close() {
+	signal.Stop(s.resized)
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	term.Restore(s.fd, s.state)
+}
+
+// readKeys translates the input into keys, the escape sequences of
+// the cursor keys are mapped to keyUp and keyDown.
+func (s *screen) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(s.keys)
+			return
+		}
+		for i := 0; i < n; i++ {
+			if buf[i] == 0x1b && i+2 < n && buf[i+1] == '[' {
+				switch buf[i+2] {
+				case 'A':
+					s.keys <- keyUp
+				case 'B':
+					s.keys <- keyDown
+				}
+				i += 2
+				continue
+			}
+			s.keys <- buf[i]
+		}
+	}
+}
+
+func (s *screen) size() (int, int) {
+	width, height, err := term.GetSize(s.fd)
+	if err != nil {
+		return 80, 24
+	}
+	return width, height
+}
+
+func (s *screen) draw(lines []string) {
+	fmt.Print("\x1b[H\x1b[2J" + strings.Join(lines, "\r\n"))
+}
+
+func bold(s string) string {
+	return "\x1b[1m" + s + "\x1b[0m"
+}
+
+func inverse(s string) string {
+	return "\x1b[7m" + s + "\x1b[0m"
+}
+
+func red(s string) string {
+	return "\x1b[31m" + s + "\x1b[0m"
+}
+
+func yellow(s string) string {
+	return "\x1b[33m" + s + "\x1b[0m"
+}
+
+// truncate cuts a line to width visible characters, escape sequences
+// don't count. Messages of kubicd can contain newlines, they are
+// replaced with spaces to keep the layout.
+func truncate(line string, width int) string {
+	line = strings.ReplaceAll(line, "\n", " ")
+
+	visible := 0
+	escape := false
+	for i, r := range line {
+		switch {
+		case r == 0x1b:
+			escape = true
+		case escape:
+			if r == 'm' {
+				escape = false
+			}
+		default:
+			if visible == width {
+				return line[:i] + "\x1b[0m"
+			}
+			visible++
+		}
+	}
+	return line
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"io"
+
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+// statusStream is implemented by the client side of all streams
+// returning StatusReply messages.
+type statusStream interface {
+	Recv() (*pb.StatusReply, error)
+}
+
+// receiveStream prints all replies of kubicd as events. If the stream
+// breaks, the command fails with what as description. The returned
+// exit code tells if all replies were successful, only some of them
+// or if the last one, which ends the call, failed.
+func receiveStream(stream statusStream, what string) int {
+	failures := 0
+	lastFailed := false
+
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			output.Fail(output.ExitCode(err), "%s failed: %v", what, err)
+		}
+		output.Event(r.Success, r.Message)
+		lastFailed = !r.Success
+		if lastFailed {
+			failures++
+		}
+	}
+
+	if lastFailed {
+		return output.ExitFailure
+	}
+	if failures > 0 {
+		return output.ExitPartialFailure
+	}
+	return output.ExitSuccess
+}
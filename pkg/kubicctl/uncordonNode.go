@@ -0,0 +1,64 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func UncordonNodeCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:               "uncordon <nodes>",
+		Short:             "Mark nodes as schedulable again",
+		Run:               uncordonNode,
+		ValidArgsFunction: completeNodes,
+		Args:              cobra.ExactArgs(1),
+	}
+
+	return subCmd
+}
+
+func uncordonNode(cmd *cobra.Command, args []string) {
+	nodes := args[0]
+
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	r, err := c.UncordonNode(ctx, &pb.CordonRequest{NodeNames: nodes})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
+	}
+	if !r.Success {
+		output.Fail(output.ExitFailure, "Uncordoning node %s failed: %s", nodes, r.Message)
+	}
+	output.Result(output.Reply{Success: r.Success, Message: r.Message}, func() {
+		fmt.Printf("Node %s uncordoned\n", nodes)
+	})
+}
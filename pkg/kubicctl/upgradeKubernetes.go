@@ -16,13 +16,20 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	maxParallel        int32 = 1
+	upgradePodSelector       = ""
+	healthTimeout            = "10m"
+	maxFailures        int32 = 0
+	resumeUpgrade            = false
 )
 
 func UpgradeKubernetesCmd() *cobra.Command {
@@ -34,48 +41,41 @@ func UpgradeKubernetesCmd() *cobra.Command {
 	}
 
 	subCmd.PersistentFlags().StringVar(&kubernetesVersion, "kubernetes-version", kubernetesVersion, "Kubernetes version of the control plane to deploy")
+	subCmd.Flags().Int32Var(&maxParallel, "max-parallel", maxParallel, "Number of workers upgraded at the same time, masters are always upgraded one after the other")
+	subCmd.Flags().StringVar(&upgradePodSelector, "pod-selector", upgradePodSelector, "Running pods on an upgraded node matching this label selector must be Ready before continuing")
+	subCmd.Flags().StringVar(&healthTimeout, "health-timeout", healthTimeout, "Time to wait until an upgraded node is healthy")
+	subCmd.Flags().Int32Var(&maxFailures, "max-failures", maxFailures, "Stop the upgrade after this many failed nodes, 0 for no limit")
+	subCmd.Flags().StringVar(&imageRepository, "image-repository", imageRepository, "Switch the cluster to this registry for the control plane images")
+	subCmd.Flags().BoolVar(&resumeUpgrade, "resume", resumeUpgrade, "Continue the last unfinished upgrade with the first node not yet upgraded")
+
+	subCmd.AddCommand(
+		UpgradePlanCmd(),
+		UpgradeStatusCmd(),
+	)
 
 	return subCmd
 }
 
 func upgradeKubernetes(cmd *cobra.Command, args []string) {
 	// Set up a connection to the server.
-
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
 	client := pb.NewKubeadmClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
 	defer cancel()
 
-	fmt.Print("Upgrading kubernetes can take a very long time, please be patient.\n")
-	stream, err := client.UpgradeKubernetes(ctx, &pb.UpgradeRequest{KubernetesVersion: kubernetesVersion})
+	output.Info("Upgrading kubernetes can take a very long time, please be patient.\n")
+	stream, err := client.UpgradeKubernetes(ctx, &pb.UpgradeRequest{KubernetesVersion: kubernetesVersion,
+		MaxParallel: maxParallel, PodSelector: upgradePodSelector, HealthTimeout: healthTimeout, MaxFailures: maxFailures, Resume: resumeUpgrade,
+		ImageRepository: imageRepository})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not upgrade: %v", err)
-		os.Exit(1)
-	}
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Upgrading kubernetes failed: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Upgrading kubernetes failed: %s\n%v\n", r.Message, err)
-			}
-			os.Exit(1)
-		}
-		if r.Success != true {
-			fmt.Fprintf(os.Stderr, "Upgrading kubernetes failed: %s\n", r.Message)
-			os.Exit(1)
-		} else {
-			fmt.Printf("%s\n", r.Message)
-		}
+		output.Fail(output.ExitCode(err), "Could not upgrade: %v", err)
 	}
+
+	os.Exit(receiveStream(stream, "Upgrading kubernetes"))
 }
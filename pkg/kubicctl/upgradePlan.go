@@ -0,0 +1,90 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func UpgradePlanCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "plan",
+		Short: "Show the kubeadm and kubelet versions of all nodes and whether they can be upgraded",
+		Run:   upgradePlan,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func upgradePlan(cmd *cobra.Command, args []string) {
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	r, err := client.UpgradePlan(ctx, &pb.UpgradeRequest{KubernetesVersion: kubernetesVersion})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not create upgrade plan: %v", err)
+	}
+	if len(r.Node) == 0 && !r.Success {
+		output.Fail(output.ExitFailure, "%s", r.Message)
+	}
+
+	type nodeVersions struct {
+		Node    string `json:"node" yaml:"node"`
+		Role    string `json:"role" yaml:"role"`
+		Kubeadm string `json:"kubeadm" yaml:"kubeadm"`
+		Kubelet string `json:"kubelet" yaml:"kubelet"`
+		Problem string `json:"problem,omitempty" yaml:"problem,omitempty"`
+	}
+	nodes := []nodeVersions{}
+	for _, n := range r.Node {
+		nodes = append(nodes, nodeVersions{n.Node, n.Role, n.Kubeadm, n.Kubelet, n.Problem})
+	}
+
+	output.Result(struct {
+		KubernetesVersion string         `json:"kubernetes_version" yaml:"kubernetes_version"`
+		Upgradeable       bool           `json:"upgradeable" yaml:"upgradeable"`
+		Message           string         `json:"message" yaml:"message"`
+		Nodes             []nodeVersions `json:"nodes" yaml:"nodes"`
+	}{r.KubernetesVersion, r.Success, r.Message, nodes}, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tROLE\tKUBEADM\tKUBELET\tPROBLEM")
+		for _, n := range nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", n.Node, n.Role, n.Kubeadm, n.Kubelet, n.Problem)
+		}
+		w.Flush()
+		fmt.Println(r.Message)
+	})
+	if !r.Success {
+		os.Exit(output.ExitFailure)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubicctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+func UpgradeStatusCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the progress of the current or last upgrade",
+		Run:   upgradeStatus,
+		Args:  cobra.ExactArgs(0),
+	}
+
+	return subCmd
+}
+
+func upgradeStatus(cmd *cobra.Command, args []string) {
+	// Set up a connection to the server.
+	conn, err := CreateConnection()
+	if err != nil {
+		output.Fail(output.ExitConnectionError, "%v", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewKubeadmClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+
+	r, err := client.UpgradeStatus(ctx, &pb.Empty{})
+	if err != nil {
+		output.Fail(output.ExitCode(err), "Could not get upgrade status: %v", err)
+	}
+	if !r.Success {
+		output.Fail(output.ExitFailure, "%s", r.Message)
+	}
+
+	type nodeStatus struct {
+		Node    string `json:"node" yaml:"node"`
+		Role    string `json:"role" yaml:"role"`
+		Phase   string `json:"phase" yaml:"phase"`
+		Message string `json:"message,omitempty" yaml:"message,omitempty"`
+	}
+	nodes := []nodeStatus{}
+	for _, n := range r.Node {
+		nodes = append(nodes, nodeStatus{n.Node, n.Role, n.Phase, n.Message})
+	}
+
+	output.Result(struct {
+		KubernetesVersion string       `json:"kubernetes_version,omitempty" yaml:"kubernetes_version,omitempty"`
+		State             string       `json:"state,omitempty" yaml:"state,omitempty"`
+		Started           string       `json:"started,omitempty" yaml:"started,omitempty"`
+		Updated           string       `json:"updated,omitempty" yaml:"updated,omitempty"`
+		Message           string       `json:"message" yaml:"message"`
+		Nodes             []nodeStatus `json:"nodes" yaml:"nodes"`
+	}{r.KubernetesVersion, r.State, r.Started, r.Updated, r.Message, nodes}, func() {
+		fmt.Println(r.Message)
+		if len(r.Started) > 0 {
+			fmt.Printf("Started %s, last update %s\n", r.Started, r.Updated)
+		}
+		if len(nodes) == 0 {
+			return
+		}
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tROLE\tPHASE\tMESSAGE")
+		for _, n := range nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", n.Node, n.Role, n.Phase, n.Message)
+		}
+		w.Flush()
+	})
+}
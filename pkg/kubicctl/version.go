@@ -18,6 +18,7 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func VersionCmd() *cobra.Command {
@@ -25,7 +26,11 @@ func VersionCmd() *cobra.Command {
 		Use:   "version",
 		Short: "Print version information",
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("kubicctl version %s\n", Version)
+			output.Result(struct {
+				Version string `json:"kubicctl_version" yaml:"kubicctl_version"`
+			}{Version}, func() {
+				fmt.Printf("kubicctl version %s\n", Version)
+			})
 		},
 	}
 }
@@ -16,35 +16,33 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 func YomiInstallCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
-		Use:   "install <name>",
-		Short: "Install a new node with yomi",
-		Run:   install,
-		Args:  cobra.ExactArgs(1),
+		Use:               "install <name>",
+		Short:             "Install a new node with yomi",
+		Run:               install,
+		ValidArgsFunction: completeMinions,
+		Args:              cobra.ExactArgs(1),
 	}
 
 	return subCmd
 }
 
 func install(cmd *cobra.Command, args []string) {
-
-	retval := 0
 	node := args[0]
 
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -55,31 +53,8 @@ func install(cmd *cobra.Command, args []string) {
 
 	stream, err := client.Install(ctx, &pb.InstallRequest{Saltnode: node})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Installing '%s' with yomi failed: %v\n",
-					node, err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Installing '%s' with yomi failed: %s\n%v\n",
-					node, r.Message, err)
-			}
-			retval = 1
-		} else {
-			if r.Success != true {
-				fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-			} else {
-				fmt.Printf("%s\n", r.Message)
-			}
-		}
-	}
-	os.Exit(retval)
+	os.Exit(receiveStream(stream, "Installing '"+node+"' with yomi"))
 }
@@ -16,13 +16,12 @@ package kubicctl
 
 import (
 	"context"
-	"fmt"
-	"io"
 	"os"
 	"time"
 
 	"github.com/spf13/cobra"
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/output"
 )
 
 var (
@@ -36,10 +35,11 @@ var (
 
 func YomiPrepareConfigCmd() *cobra.Command {
 	var subCmd = &cobra.Command{
-		Use:   "prepare <type> <name>",
-		Short: "Prepare yomi configuration for node of this type",
-		Run:   prepareConfig,
-		Args:  cobra.ExactArgs(2),
+		Use:               "prepare <type> <name>",
+		Short:             "Prepare yomi configuration for node of this type",
+		Run:               prepareConfig,
+		ValidArgsFunction: completePrepareConfig,
+		Args:              cobra.ExactArgs(2),
 	}
 
 	subCmd.PersistentFlags().StringVar(&arg_type, "type", "", "Type of node: haproxy, master, worker")
@@ -49,19 +49,29 @@ func YomiPrepareConfigCmd() *cobra.Command {
 	subCmd.PersistentFlags().BoolVar(&arg_efi, "efi", false, "Machine has EFI firmware")
 	subCmd.PersistentFlags().BoolVar(&arg_baremetal, "baremetal", false, "Machine is bare metal")
 
+	subCmd.RegisterFlagCompletionFunc("type", completeWords("haproxy", "master", "worker"))
+
 	return subCmd
 }
 
-func prepareConfig(cmd *cobra.Command, args []string) {
+func completePrepareConfig(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch len(args) {
+	case 0:
+		return []string{"haproxy"}, cobra.ShellCompDirectiveNoFileComp
+	case 1:
+		return completeMinion(cmd, toComplete)
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
 
-	retval := 0
+func prepareConfig(cmd *cobra.Command, args []string) {
 	nodeType := args[0]
 	node := args[1]
 
 	// Set up a connection to the server.
 	conn, err := CreateConnection()
 	if err != nil {
-		return
+		output.Fail(output.ExitConnectionError, "%v", err)
 	}
 	defer conn.Close()
 
@@ -74,29 +84,8 @@ func prepareConfig(cmd *cobra.Command, args []string) {
 	stream, err := client.PrepareConfig(ctx, &pb.PrepareConfigRequest{Saltnode: node, Type: nodeType,
 		Disk: arg_disk, Repo: arg_repo, RepoUpdate: arg_repo_update})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not initialize: %v", err)
-		return
+		output.Fail(output.ExitCode(err), "Could not initialize: %v", err)
 	}
 
-	for {
-		r, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			if r == nil {
-				fmt.Fprintf(os.Stderr, "Create yomi configuration failed: %v\n", err)
-			} else {
-				fmt.Fprintf(os.Stderr, "Create yomi configuration failed: %s\n%v\n", r.Message, err)
-			}
-			retval = 1
-		} else {
-			if r.Success != true {
-				fmt.Fprintf(os.Stderr, "%s\n", r.Message)
-			} else {
-				fmt.Printf("%s\n", r.Message)
-			}
-		}
-	}
-	os.Exit(retval)
+	os.Exit(receiveStream(stream, "Create yomi configuration"))
 }
@@ -0,0 +1,75 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubicd_rpc_requests_total",
+		Help: "Number of API calls.",
+	}, []string{"method", "caller"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubicd_rpc_errors_total",
+		Help: "Number of API calls which failed, returned an error or were denied.",
+	}, []string{"method", "caller", "outcome"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kubicd_rpc_duration_seconds",
+		Help:    "Duration of API calls in seconds.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600},
+	}, []string{"method", "caller"})
+
+	commandInvocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubicd_command_invocations_total",
+		Help: "Number of external commands executed.",
+	}, []string{"binary"})
+	commandFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubicd_command_failures_total",
+		Help: "Number of external commands which failed.",
+	}, []string{"binary"})
+)
+
+func init() {
+	registry.MustRegister(rpcRequests, rpcErrors, rpcDuration,
+		commandInvocations, commandFailures)
+}
+
+// ObserveRPC records an API call. outcome is the outcome of the audit
+// record: success, failed, error or denied.
+func ObserveRPC(method string, caller string, outcome string, duration time.Duration) {
+	method = strings.TrimPrefix(method, "/api.")
+
+	rpcRequests.WithLabelValues(method, caller).Inc()
+	rpcDuration.WithLabelValues(method, caller).Observe(duration.Seconds())
+	if outcome != "success" {
+		rpcErrors.WithLabelValues(method, caller, outcome).Inc()
+	}
+}
+
+// ObserveCommand records the execution of an external command.
+func ObserveCommand(command string, success bool) {
+	binary := filepath.Base(command)
+
+	commandInvocations.WithLabelValues(binary).Inc()
+	if !success {
+		commandFailures.WithLabelValues(binary).Inc()
+	}
+}
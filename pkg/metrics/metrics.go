@@ -0,0 +1,142 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// registry contains the metrics of kubicd and of the Go runtime.
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(collectors.NewGoCollector())
+	registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Sample is one value of a gauge with its label values.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// GaugeFunc is a gauge whose values are computed by a function when
+// the metrics are scraped. Since computing them can be expensive
+// (e.g. calling salt), the result is cached for interval.
+type GaugeFunc struct {
+	desc     *prometheus.Desc
+	interval time.Duration
+	fn       func() []Sample
+
+	mu      sync.Mutex
+	updated time.Time
+	samples []Sample
+}
+
+// NewGaugeFunc creates and registers a new gauge computed by fn.
+func NewGaugeFunc(name string, help string, interval time.Duration, fn func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{desc: prometheus.NewDesc(name, help, labels, nil),
+		interval: interval, fn: fn}
+	registry.MustRegister(g)
+	return g
+}
+
+// Describe implements prometheus.Collector.
+func (g *GaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector.
+func (g *GaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.updated.IsZero() || time.Since(g.updated) >= g.interval {
+		g.samples = g.fn()
+		g.updated = time.Now()
+	}
+
+	for _, s := range g.samples {
+		m, err := prometheus.NewConstMetric(g.desc, prometheus.GaugeValue, s.Value, s.Labels...)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(g.desc, err)
+		}
+		ch <- m
+	}
+}
+
+// Handler writes all registered metrics. A metric which cannot be
+// collected is logged and left out, the others are still served.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:      log.StandardLogger(),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// isLoopback returns true if host only accepts local connections.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve starts a HTTP server on address serving the metrics on
+// /metrics. Without host in address, only localhost is used. The
+// labels contain the names of the callers, on other addresses the
+// metrics are only served with TLS to clients with a certificate
+// accepted by tlsConfig.
+func Serve(address string, tlsConfig *tls.Config) (*http.Server, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) == 0 {
+		host = "localhost"
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux}
+
+	scheme := "http"
+	if !isLoopback(host) {
+		scheme = "https"
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	go func() {
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	log.Infof("Serving metrics on %s://%s/metrics", scheme, lis.Addr())
+
+	return server, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveRPC(t *testing.T) {
+	ObserveRPC("/api.Kubeadm/GetStatus", "admin", "success", 2*time.Second)
+	ObserveRPC("/api.Kubeadm/GetStatus", "admin", "denied", time.Second)
+
+	if got := testutil.ToFloat64(rpcRequests.WithLabelValues("Kubeadm/GetStatus", "admin")); got != 2 {
+		t.Errorf("requests are %v, expected 2", got)
+	}
+	if got := testutil.ToFloat64(rpcErrors.WithLabelValues("Kubeadm/GetStatus", "admin", "denied")); got != 1 {
+		t.Errorf("denied requests are %v, expected 1", got)
+	}
+	if got := testutil.CollectAndCount(rpcDuration); got != 1 {
+		t.Errorf("got %d histograms, expected 1", got)
+	}
+}
+
+func TestObserveCommand(t *testing.T) {
+	ObserveCommand("/usr/bin/salt", true)
+	ObserveCommand("salt", false)
+
+	if got := testutil.ToFloat64(commandInvocations.WithLabelValues("salt")); got != 2 {
+		t.Errorf("invocations are %v, expected 2", got)
+	}
+	if got := testutil.ToFloat64(commandFailures.WithLabelValues("salt")); got != 1 {
+		t.Errorf("failures are %v, expected 1", got)
+	}
+}
+
+func TestGaugeFuncCaching(t *testing.T) {
+	calls := 0
+	g := NewGaugeFunc("test_nodes", "Number of nodes.", time.Hour,
+		func() []Sample {
+			calls++
+			return []Sample{{Labels: []string{"master"}, Value: 1},
+				{Labels: []string{"worker"}, Value: 3}}
+		}, "role")
+
+	expected := `# HELP test_nodes Number of nodes.
+# TYPE test_nodes gauge
+test_nodes{role="master"} 1
+test_nodes{role="worker"} 3
+`
+	for i := 0; i < 2; i++ {
+		if err := testutil.CollectAndCompare(g, strings.NewReader(expected)); err != nil {
+			t.Error(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("function called %d times, expected 1", calls)
+	}
+}
+
+func TestGaugeFuncInvalidSample(t *testing.T) {
+	g := NewGaugeFunc("test_invalid", "Sample with missing label.", 0,
+		func() []Sample {
+			return []Sample{{Value: 1}}
+		}, "role")
+
+	if err := testutil.CollectAndCompare(g, strings.NewReader("")); err == nil {
+		t.Error("sample with missing label value was accepted")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObserveCommand("kubectl", true)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	body := rec.Body.String()
+	for _, metric := range []string{`kubicd_command_invocations_total{binary="kubectl"}`, "go_goroutines"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("%s missing in output:\n%s", metric, body)
+		}
+	}
+}
+
+func TestServeDefaultsToLocalhost(t *testing.T) {
+	// find a free port
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	lis.Close()
+
+	server, err := Serve(":"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	resp, err := http.Get("http://localhost:" + port + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("unexpected response %d:\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"localhost", true},
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"10.0.0.1", false},
+		{"kubicd.example.com", false},
+	}
+	for _, test := range tests {
+		if got := isLoopback(test.host); got != test.expected {
+			t.Errorf("isLoopback(%q) is %v, expected %v", test.host, got, test.expected)
+		}
+	}
+}
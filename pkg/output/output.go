@@ -0,0 +1,139 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+)
+
+// Exit codes of kubicctl
+const (
+	// the command was successful
+	ExitSuccess = 0
+	// the command failed
+	ExitFailure = 1
+	// the command finished, but some steps failed, e.g. one of
+	// several nodes could not be removed
+	ExitPartialFailure = 2
+	// authentication failed or RBAC denied the call
+	ExitAuthError = 3
+	// kubicd could not be reached or the certificates not be loaded
+	ExitConnectionError = 4
+)
+
+// Format is the output format: text, json or yaml
+var Format = "text"
+
+// Validate checks that Format is known.
+func Validate() error {
+	switch Format {
+	case "text", "json", "yaml":
+		return nil
+	}
+	return fmt.Errorf("unknown output format '%s', use text, json or yaml", Format)
+}
+
+// Reply is the event printed for a streamed reply of kubicd.
+type Reply struct {
+	Success bool   `json:"success" yaml:"success"`
+	Message string `json:"message" yaml:"message"`
+}
+
+// Event prints a streamed reply. In text mode only the message is
+// printed, to stderr if the reply reports a failure; in JSON mode it
+// is printed as one line, in YAML mode as one document.
+func Event(success bool, message string) {
+	switch Format {
+	case "text":
+		if success {
+			fmt.Printf("%s\n", message)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s\n", message)
+		}
+	default:
+		write(Reply{Success: success, Message: message})
+	}
+}
+
+// Info prints an informational text, which is not part of the result,
+// in text mode only.
+func Info(format string, a ...interface{}) {
+	if Format == "text" {
+		fmt.Printf(format, a...)
+	}
+}
+
+// Result prints the final result of a command: v as document in JSON
+// or YAML mode, else text is called.
+func Result(v interface{}, text func()) {
+	if Format == "text" {
+		text()
+	} else {
+		write(v)
+	}
+}
+
+type errorDocument struct {
+	Error    string `json:"error" yaml:"error"`
+	ExitCode int    `json:"exit_code" yaml:"exit_code"`
+}
+
+// Fail prints the error and exits with code.
+func Fail(code int, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	if Format == "text" {
+		fmt.Fprintf(os.Stderr, "%s\n", message)
+	} else {
+		write(errorDocument{Error: message, ExitCode: code})
+	}
+	os.Exit(code)
+}
+
+// ExitCode returns the exit code for an error of a gRPC call.
+func ExitCode(err error) int {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return ExitAuthError
+	case codes.Unavailable:
+		return ExitConnectionError
+	default:
+		return ExitFailure
+	}
+}
+
+func write(v interface{}) {
+	if Format == "yaml" {
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot marshal output: %v\n", err)
+			os.Exit(ExitFailure)
+		}
+		fmt.Printf("---\n%s", data)
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot marshal output: %v\n", err)
+		os.Exit(ExitFailure)
+	}
+	fmt.Printf("%s\n", data)
+}
@@ -16,10 +16,10 @@ package rbac
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
 	"gopkg.in/ini.v1"
 )
 
@@ -41,19 +41,21 @@ func addAccount(cmd *cobra.Command, args []string) {
 
 	cfg, err := ini.LooseLoad("/usr/etc/kubicd/rbac.conf", "/etc/kubicd/rbac.conf")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot load rbac.conf: %v\n", err)
-		os.Exit(1)
+		output.Fail(output.ExitFailure, "Cannot load rbac.conf: %v", err)
 	}
 
 	if !cfg.Section("").HasKey(role) {
-		fmt.Printf("Adding new role: '%s'\n", role)
+		output.Info("Adding new role: '%s'\n", role)
 	} else {
 		entry = cfg.Section("").Key(role).String()
 	}
 	userList := strings.Split(entry, ",")
 	for i := range userList {
 		if user == strings.TrimSpace(userList[i]) {
-			fmt.Printf("User already part of '%s'\n", role)
+			output.Result(output.Reply{Success: true,
+				Message: fmt.Sprintf("User already part of '%s'", role)}, func() {
+				fmt.Printf("User already part of '%s'\n", role)
+			})
 			return
 		}
 	}
@@ -64,14 +66,13 @@ func addAccount(cmd *cobra.Command, args []string) {
 	}
 	wcfg, werr := ini.LooseLoad("/etc/kubicd/rbac.conf")
 	if werr != nil {
-		fmt.Fprintf(os.Stderr, "Cannot open /etc/kubicd/rbac.conf: %v\n",
-			werr)
-		os.Exit(1)
+		output.Fail(output.ExitFailure, "Cannot open /etc/kubicd/rbac.conf: %v", werr)
 	}
 	wcfg.Section("").Key(role).SetValue(entry)
 	werr = wcfg.SaveTo("/etc/kubicd/rbac.conf")
 	if werr != nil {
-		fmt.Fprintf(os.Stderr, "Writing rbac.conf failed: %v\n", werr)
-		os.Exit(1)
+		output.Fail(output.ExitFailure, "Writing rbac.conf failed: %v", werr)
 	}
+	output.Result(output.Reply{Success: true,
+		Message: fmt.Sprintf("User '%s' added to '%s'", user, role)}, func() {})
 }
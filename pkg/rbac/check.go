@@ -0,0 +1,120 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"path"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Check decides if user, member of groups, is allowed to call function.
+// The returned string explains which rule made the decision. If access
+// is only granted for some target nodes, the scopes are returned, too.
+// No scopes means no restriction.
+//
+// Keys in rbac.conf are function names like "Kubeadm/AddNode" or
+// patterns like "Kubeadm/*" or "*/List*". As with path.Match, "*"
+// does not match "/", only a key consisting of a single "*" matches
+// every function. Entries are user names (the
+// CN of the certificate), "group:<name>" matching the O or OU of the
+// certificate, or "*" for every authenticated user. Entries starting
+// with "!" deny access and always win over entries granting access.
+// Entries granting access can be restricted with "@<scope>", see
+// parseScope.
+func Check(user string, groups []string, function string) (bool, string, []Scope) {
+	cfg, err := ini.LooseLoad("/usr/etc/kubicd/rbac.conf", "/etc/kubicd/rbac.conf")
+	if err != nil {
+		return false, "cannot load rbac.conf: " + err.Error(), nil
+	}
+
+	return checkConfig(cfg, user, groups, function)
+}
+
+func checkConfig(cfg *ini.File, user string, groups []string, function string) (bool, string, []Scope) {
+	function = strings.TrimPrefix(function, "/api.")
+	function = strings.TrimPrefix(function, "/")
+
+	granted := ""
+	unrestricted := false
+	var scopes []Scope
+	for _, rule := range cfg.Section("").KeyStrings() {
+		if matched, _ := path.Match(rule, function); !matched && rule != "*" {
+			continue
+		}
+		entryList := strings.Split(cfg.Section("").Key(rule).String(), ",")
+		for i := range entryList {
+			entry := strings.TrimSpace(entryList[i])
+			subject := strings.TrimPrefix(entry, "!")
+			scope := ""
+			if at := strings.Index(subject, "@"); at >= 0 {
+				scope = subject[at+1:]
+				subject = subject[:at]
+			}
+			if !matchSubject(subject, user, groups) {
+				continue
+			}
+			// a scope on a deny entry is ignored, deny always
+			// means the whole function
+			if strings.HasPrefix(entry, "!") {
+				return false, "denied by rule '" + rule + "' (" + entry + ")", nil
+			}
+			if len(scope) == 0 {
+				if !unrestricted {
+					granted = "allowed by rule '" + rule + "' (" + entry + ")"
+				}
+				unrestricted = true
+				continue
+			}
+			s, err := parseScope(scope)
+			if err != nil {
+				return false, "invalid entry '" + entry + "' in rule '" + rule + "': " + err.Error(), nil
+			}
+			scopes = append(scopes, s)
+			if !unrestricted {
+				if len(granted) == 0 {
+					granted = "allowed by rule '" + rule + "' (" + entry + ")"
+				} else {
+					granted = granted + ", '" + rule + "' (" + entry + ")"
+				}
+			}
+		}
+	}
+
+	if unrestricted {
+		return true, granted, nil
+	}
+	if len(granted) > 0 {
+		return true, granted, scopes
+	}
+	return false, "no rule grants '" + function + "' to '" + user + "'", nil
+}
+
+func matchSubject(subject string, user string, groups []string) bool {
+	if subject == "*" {
+		return true
+	}
+	if strings.HasPrefix(subject, "group:") {
+		group := strings.TrimPrefix(subject, "group:")
+		for i := range groups {
+			if group == groups[i] {
+				return true
+			}
+		}
+		return false
+	}
+	return len(subject) > 0 && subject == user
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
+)
+
+var (
+	groups []string
+)
+
+func CheckAccountCmd() *cobra.Command {
+	var subCmd = &cobra.Command{
+		Use:   "check <user> <method>",
+		Short: "Explain if an user is allowed to call a method",
+		Run:   checkAccount,
+		Args:  cobra.ExactArgs(2),
+	}
+
+	subCmd.PersistentFlags().StringSliceVar(&groups, "group", groups, "Group (O or OU of the certificate) of the user, can be used several times")
+
+	return subCmd
+}
+
+func checkAccount(cmd *cobra.Command, args []string) {
+	user := args[0]
+	method := args[1]
+
+	allowed, reason, scopes := Check(user, groups, method)
+	restrictions := []string{}
+	for i := range scopes {
+		restrictions = append(restrictions, scopes[i].String())
+	}
+	output.Result(struct {
+		User    string   `json:"user" yaml:"user"`
+		Method  string   `json:"method" yaml:"method"`
+		Allowed bool     `json:"allowed" yaml:"allowed"`
+		Reason  string   `json:"reason" yaml:"reason"`
+		Scopes  []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	}{user, method, allowed, reason, restrictions}, func() {
+		if !allowed {
+			fmt.Printf("'%s' is not allowed to call '%s': %s\n", user, method, reason)
+			return
+		}
+		fmt.Printf("'%s' is allowed to call '%s': %s\n", user, method, reason)
+		for i := range scopes {
+			if i == 0 {
+				fmt.Printf("Restricted to nodes matching: %s", scopes[i])
+			} else {
+				fmt.Printf(" or %s", scopes[i])
+			}
+		}
+		if len(scopes) > 0 {
+			fmt.Print("\n")
+		}
+	})
+	if !allowed {
+		os.Exit(output.ExitFailure)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		user     string
+		groups   []string
+		function string
+		allowed  bool
+		scopes   []Scope
+	}{
+		{
+			name:     "user",
+			config:   "Kubeadm/AddNode=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+			allowed:  true,
+		},
+		{
+			name:     "other user",
+			config:   "Kubeadm/AddNode=alice",
+			user:     "bob",
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "no rule",
+			config:   "Kubeadm/AddNode=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/RemoveNode",
+		},
+		{
+			name:     "group",
+			config:   "Kubeadm/AddNode=group:admin",
+			user:     "alice",
+			groups:   []string{"users", "admin"},
+			function: "/api.Kubeadm/AddNode",
+			allowed:  true,
+		},
+		{
+			name:     "other group",
+			config:   "Kubeadm/AddNode=group:admin",
+			user:     "admin",
+			groups:   []string{"users"},
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "every user",
+			config:   "Kubeadm/GetStatus=*",
+			user:     "alice",
+			function: "/api.Kubeadm/GetStatus",
+			allowed:  true,
+		},
+		{
+			name:     "deny beats allow in the same rule",
+			config:   "Kubeadm/AddNode=group:admin,!alice",
+			user:     "alice",
+			groups:   []string{"admin"},
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "deny beats allow of an earlier rule",
+			config:   "Kubeadm/*=alice\nKubeadm/RemoveNode=!alice",
+			user:     "alice",
+			function: "/api.Kubeadm/RemoveNode",
+		},
+		{
+			name:     "deny beats allow of a later rule",
+			config:   "Kubeadm/*=!group:guests\nKubeadm/GetStatus=*",
+			user:     "alice",
+			groups:   []string{"guests"},
+			function: "/api.Kubeadm/GetStatus",
+		},
+		{
+			name:     "deny of every user",
+			config:   "Kubeadm/AddNode=alice,!*",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "deny with scope denies everything",
+			config:   "Kubeadm/AddNode=alice,!alice@role=master",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "scoped grant",
+			config:   "Kubeadm/AddNode=alice@role=worker+node=worker-*",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+			allowed:  true,
+			scopes:   []Scope{{Node: "worker-*", Role: "worker"}},
+		},
+		{
+			name:     "scoped grants of several rules",
+			config:   "Kubeadm/*=alice@role=worker\nKubeadm/AddNode=group:admin@grain=zone:a*",
+			user:     "alice",
+			groups:   []string{"admin"},
+			function: "/api.Kubeadm/AddNode",
+			allowed:  true,
+			scopes:   []Scope{{Role: "worker"}, {GrainKey: "zone", GrainValue: "a*"}},
+		},
+		{
+			name:     "unscoped grant wins over scoped grant",
+			config:   "Kubeadm/*=alice@role=worker\nKubeadm/AddNode=group:admin",
+			user:     "alice",
+			groups:   []string{"admin"},
+			function: "/api.Kubeadm/AddNode",
+			allowed:  true,
+		},
+		{
+			name:     "invalid scope",
+			config:   "Kubeadm/AddNode=alice@zone=a",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "pattern in the method",
+			config:   "*/List*=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/ListNodes",
+			allowed:  true,
+		},
+		{
+			name:     "pattern in the service",
+			config:   "*/List*=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/GetStatus",
+		},
+		{
+			name:     "pattern does not cross the slash",
+			config:   "Kube*=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+		},
+		{
+			name:     "bare star matches every function",
+			config:   "*=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/AddNode",
+			allowed:  true,
+		},
+		{
+			name:     "character class",
+			config:   "Kubeadm/[AR]*Node=alice",
+			user:     "alice",
+			function: "/api.Kubeadm/RemoveNode",
+			allowed:  true,
+		},
+		{
+			name:     "function without prefix",
+			config:   "Kubeadm/AddNode=alice",
+			user:     "alice",
+			function: "Kubeadm/AddNode",
+			allowed:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ini.Load([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed, message, scopes := checkConfig(cfg, tt.user, tt.groups, tt.function)
+			if allowed != tt.allowed {
+				t.Errorf("allowed is %v (%s), expected %v", allowed, message, tt.allowed)
+			}
+			if !reflect.DeepEqual(scopes, tt.scopes) {
+				t.Errorf("scopes are %v, expected %v", scopes, tt.scopes)
+			}
+		})
+	}
+}
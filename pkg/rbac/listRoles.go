@@ -16,9 +16,9 @@ package rbac
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/thkukuk/kubic-control/pkg/output"
 	"gopkg.in/ini.v1"
 )
 
@@ -36,13 +36,17 @@ func ListRolesCmd() *cobra.Command {
 func listRoles(cmd *cobra.Command, args []string) {
 	cfg, err := ini.LooseLoad("/usr/etc/kubicd/rbac.conf", "/etc/kubicd/rbac.conf")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot load rbac.conf: %v\n", err)
-		os.Exit(1)
+		output.Fail(output.ExitFailure, "Cannot load rbac.conf: %v", err)
 	}
 
 	roleList := cfg.Section("").KeyStrings()
+	roles := make(map[string]string)
 	for i := range roleList {
-		entry := cfg.Section("").Key(roleList[i]).String()
-		fmt.Printf("%s: %s\n", roleList[i], entry)
+		roles[roleList[i]] = cfg.Section("").Key(roleList[i]).String()
 	}
+	output.Result(map[string]map[string]string{"roles": roles}, func() {
+		for i := range roleList {
+			fmt.Printf("%s: %s\n", roleList[i], roles[roleList[i]])
+		}
+	})
 }
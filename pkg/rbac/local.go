@@ -0,0 +1,68 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"os/user"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// LocalUser maps the UID of a caller on the local Unix socket to a
+// RBAC user. The mapping is configured in the [local] section of
+// rbac.conf, keys are "user.<name>", "uid.<uid>", "group.<name>" or
+// "gid.<gid>", the value is the RBAC user:
+//
+//	[local]
+//	user.root = admin
+//	group.wheel = operator
+//
+// The first matching key wins. The returned string explains the
+// decision.
+func LocalUser(uid uint32) (string, string) {
+	cfg, err := ini.LooseLoad("/usr/etc/kubicd/rbac.conf", "/etc/kubicd/rbac.conf")
+	if err != nil {
+		return "", "cannot load rbac.conf: " + err.Error()
+	}
+
+	return localUser(cfg, uid)
+}
+
+func localUser(cfg *ini.File, uid uint32) (string, string) {
+	uidStr := strconv.FormatUint(uint64(uid), 10)
+	subjects := map[string]bool{"uid." + uidStr: true}
+
+	u, err := user.LookupId(uidStr)
+	if err == nil {
+		subjects["user."+u.Username] = true
+		gids, _ := u.GroupIds()
+		for _, gid := range gids {
+			subjects["gid."+gid] = true
+			if g, err := user.LookupGroupId(gid); err == nil {
+				subjects["group."+g.Name] = true
+			}
+		}
+	}
+
+	for _, key := range cfg.Section("local").KeyStrings() {
+		if subjects[key] {
+			rbacUser := strings.TrimSpace(cfg.Section("local").Key(key).String())
+			return rbacUser, "mapped by '" + key + "'"
+		}
+	}
+	return "", "no entry in [local] of rbac.conf for uid " + uidStr
+}
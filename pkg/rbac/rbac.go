@@ -28,6 +28,7 @@ func RBACCmd() *cobra.Command {
 		AddAccountCmd(),
 		//                RemoveAccountCmd(),
 		ListRolesCmd(),
+		CheckAccountCmd(),
 	)
 
 	return subCmd
@@ -0,0 +1,173 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/thkukuk/kubic-control/pkg/tools"
+)
+
+// Scope restricts an entry granting access to some target nodes.
+// All fields which are set have to match.
+type Scope struct {
+	// glob of the salt minion name
+	Node string
+	// worker, master or haproxy
+	Role string
+	// grain name and glob of the value
+	GrainKey   string
+	GrainValue string
+}
+
+// caller is stored in the context of an API call.
+type caller struct {
+	user   string
+	groups []string
+	scopes []Scope
+}
+
+type callerKey struct{}
+
+// parseScope parses the part of an entry behind the "@". It is a
+// list of "node=<glob>", "role=<role>" and "grain=<name>:<glob>"
+// separated by "+", e.g. "role=worker+node=worker-*".
+func parseScope(scope string) (Scope, error) {
+	var s Scope
+
+	for _, item := range strings.Split(scope, "+") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return s, errors.New("scope '" + item + "' is not of the form <type>=<value>")
+		}
+		switch kv[0] {
+		case "node":
+			s.Node = kv[1]
+		case "role":
+			s.Role = kv[1]
+		case "grain":
+			grain := strings.SplitN(kv[1], ":", 2)
+			if len(grain) != 2 {
+				return s, errors.New("grain scope '" + kv[1] + "' is not of the form <name>:<value>")
+			}
+			s.GrainKey = grain[0]
+			s.GrainValue = grain[1]
+		default:
+			return s, errors.New("unknown scope type '" + kv[0] + "'")
+		}
+	}
+	return s, nil
+}
+
+func (s Scope) String() string {
+	var items []string
+
+	if len(s.Node) > 0 {
+		items = append(items, "node="+s.Node)
+	}
+	if len(s.Role) > 0 {
+		items = append(items, "role="+s.Role)
+	}
+	if len(s.GrainKey) > 0 {
+		items = append(items, "grain="+s.GrainKey+":"+s.GrainValue)
+	}
+	return strings.Join(items, "+")
+}
+
+// NewContext returns a copy of ctx carrying the identity and the
+// scopes of the caller.
+func NewContext(ctx context.Context, user string, groups []string, scopes []Scope) context.Context {
+	return context.WithValue(ctx, callerKey{}, &caller{user, groups, scopes})
+}
+
+// CallerFromContext returns user and groups of the caller stored in ctx.
+func CallerFromContext(ctx context.Context) (string, []string, bool) {
+	c, ok := ctx.Value(callerKey{}).(*caller)
+	if !ok {
+		return "", nil, false
+	}
+	return c.user, c.groups, true
+}
+
+// CheckTargets verifies, that the caller is allowed to work on all
+// nodes. role is the role the nodes will have after the call, if it
+// is empty, the current role is read from the kubicd grain.
+func CheckTargets(ctx context.Context, nodes []string, role string) (bool, string) {
+	c, ok := ctx.Value(callerKey{}).(*caller)
+	if !ok || len(c.scopes) == 0 {
+		return true, ""
+	}
+	scopes := c.scopes
+
+	for _, node := range nodes {
+		nodeRole := role
+		allowed := false
+		for _, scope := range scopes {
+			if len(scope.Role) > 0 && len(nodeRole) == 0 {
+				nodeRole = getRole(node)
+			}
+			if scope.match(node, nodeRole) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, node + ": outside of the scope you are allowed to manage"
+		}
+	}
+	return true, ""
+}
+
+func (s Scope) match(node string, role string) bool {
+	if len(s.Node) > 0 {
+		if matched, _ := path.Match(s.Node, node); !matched {
+			return false
+		}
+	}
+	if len(s.Role) > 0 && !strings.EqualFold(s.Role, role) {
+		return false
+	}
+	if len(s.GrainKey) > 0 {
+		success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", node, "grains.get", s.GrainKey)
+		if success != true {
+			return false
+		}
+		value := strings.Replace(message, "\n", "", -1)
+		i := strings.Index(value, ":") + 1
+		value = strings.TrimSpace(value[i:])
+		if matched, _ := path.Match(s.GrainValue, value); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// getRole returns the role of a node based on the kubicd grain, or an
+// empty string if the node is not part of the cluster.
+func getRole(node string) string {
+	success, message := tools.ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=txt", node, "grains.get", "kubicd")
+	if success != true {
+		return ""
+	}
+	for _, role := range []string{"master", "worker", "haproxy"} {
+		if strings.Contains(message, "kubic-"+role+"-node") {
+			return role
+		}
+	}
+	return ""
+}
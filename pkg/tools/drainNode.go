@@ -14,17 +14,131 @@
 
 package tools
 
-func DrainNode(hostname string, timeout string) (bool, string) {
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thkukuk/kubic-control/pkg/metrics"
+)
+
+// DrainOptions are the options for kubectl drain.
+type DrainOptions struct {
+	// how long to try, default 10m
+	Timeout string
+	// seconds the pods have to terminate, 0 means the value of the pod
+	GracePeriod int32
+	// only evict pods matching this label selector
+	PodSelector string
+	// don't delete pods using emptyDir volumes, the drain fails
+	// if there are such pods
+	KeepLocalData bool
+	// don't delete pods not managed by a controller, the drain
+	// fails if there are such pods
+	NoForce bool
+}
 
-	var arg_timeout string
+// kubectl retries evictions blocked by a PodDisruptionBudget until the
+// timeout is reached and prints an error for every try.
+var pdbBlocked = regexp.MustCompile(`error when evicting pods?/?"([^"]+)"(?: -n "([^"]+)")?.*disruption budget`)
 
-	if len(timeout) > 0 {
-		arg_timeout = timeout
+func DrainNode(hostname string, timeout string) (bool, string) {
+	return DrainNodeWithOptions(hostname, DrainOptions{Timeout: timeout}, nil)
+}
+
+// DrainNodeWithOptions drains the node. progress is called for every
+// evicted pod and for every pod, whose eviction is blocked by a
+// PodDisruptionBudget. If the drain fails, the message contains the
+// blocked pods.
+func DrainNodeWithOptions(hostname string, options DrainOptions, progress func(string)) (bool, string) {
+	args := []string{"--kubeconfig=/etc/kubernetes/admin.conf", "drain", hostname,
+		"--ignore-daemonsets"}
+	if len(options.Timeout) > 0 {
+		args = append(args, "--timeout", options.Timeout)
 	} else {
-		arg_timeout = "10m"
+		args = append(args, "--timeout", "10m")
+	}
+	if options.GracePeriod > 0 {
+		args = append(args, "--grace-period", strconv.Itoa(int(options.GracePeriod)))
+	}
+	if len(options.PodSelector) > 0 {
+		args = append(args, "--pod-selector", options.PodSelector)
+	}
+	if !options.KeepLocalData {
+		args = append(args, "--delete-local-data")
+	}
+	if !options.NoForce {
+		args = append(args, "--force")
 	}
 
-	return ExecuteCmd("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
-		"drain", hostname, "--timeout", arg_timeout, "--delete-local-data",
-		"--force", "--ignore-daemonsets")
+	cmd := exec.Command("kubectl", args...)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	log.Infof("Executing %s: %v", cmd.Path, cmd.Args)
+
+	if err := cmd.Start(); err != nil {
+		metrics.ObserveCommand("kubectl", false)
+		return false, "Error invoking kubectl: " + err.Error()
+	}
+	result := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		writer.Close()
+		result <- err
+	}()
+
+	var output []string
+	var blocked []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		output = append(output, line)
+		if m := pdbBlocked.FindStringSubmatch(line); m != nil {
+			pod := m[1]
+			if len(m[2]) > 0 {
+				pod = m[2] + "/" + m[1]
+			}
+			// kubectl retries every few seconds, report it once
+			if !contains(blocked, pod) {
+				blocked = append(blocked, pod)
+				if progress != nil {
+					progress("eviction of pod " + pod + " blocked by PodDisruptionBudget")
+				}
+			}
+		} else if strings.HasSuffix(line, " evicted") && progress != nil {
+			progress(line)
+		}
+	}
+	// read the rest if the scanner stopped early
+	io.Copy(io.Discard, reader)
+
+	err := <-result
+	metrics.ObserveCommand("kubectl", err == nil)
+	if err != nil {
+		log.Error("Error invoking kubectl: " + err.Error() + "\n" + strings.Join(output, "\n"))
+		message := "Error invoking kubectl: " + err.Error()
+		if len(blocked) > 0 {
+			message = message + ", eviction blocked by PodDisruptionBudget: " + strings.Join(blocked, ", ")
+		} else if len(output) > 0 {
+			message = message + "\n(" + output[len(output)-1] + ")"
+		}
+		return false, message
+	}
+	log.Info(strings.Join(output, "\n"))
+	return true, strings.Join(output, "\n")
+}
+
+func contains(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
 }
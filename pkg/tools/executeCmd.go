@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/thkukuk/kubic-control/pkg/metrics"
 )
 
 func ExecuteCmd(command string, arg ...string) (bool, string) {
@@ -33,7 +34,9 @@ func ExecuteCmd(command string, arg ...string) (bool, string) {
 
 	log.Infof("Executing %s: %v", cmd.Path, cmd.Args)
 
-	if err := cmd.Run(); err != nil {
+	err := cmd.Run()
+	metrics.ObserveCommand(command, err == nil)
+	if err != nil {
 		if command == "salt" {
 			stderr = out // salt is evil, errors are written to stdout
 		}
@@ -0,0 +1,37 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+)
+
+// GetListOfMinions returns all minions with accepted keys on the salt
+// master.
+func GetListOfMinions() (bool, string, []string) {
+	success, message := ExecuteCmd("salt-key", "--list=accepted", "--out=json")
+	if success != true {
+		return success, message, nil
+	}
+
+	var keys struct {
+		Minions []string `json:"minions"`
+	}
+	if err := json.Unmarshal([]byte(message), &keys); err != nil {
+		return false, "Cannot parse output of salt-key: " + err.Error(), nil
+	}
+
+	return true, "", keys.Minions
+}
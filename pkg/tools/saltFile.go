@@ -0,0 +1,112 @@
+// Copyright 2020 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ReadFileSalt returns the content of a file on the salt minion.
+func ReadFileSalt(node string, path string) (string, error) {
+	success, message := ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=json", "--static",
+		node, "cmd.run", "cat "+path)
+	if success != true {
+		return "", errors.New(message)
+	}
+	var result map[string]string
+	if err := json.Unmarshal([]byte(message), &result); err != nil {
+		return "", errors.New("Cannot parse output of salt: " + err.Error())
+	}
+	content, ok := result[node]
+	if !ok {
+		return "", errors.New(node + " did not respond")
+	}
+	return content, nil
+}
+
+// WriteFileSalt writes the data to a file on the salt minions. The
+// data is transferred base64 encoded, so that no shell quoting is
+// necessary.
+func WriteFileSalt(target string, path string, data []byte, mode string) (bool, string) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	return ExecuteCmd("salt", "--module-executors='[direct_call]'", target, "cmd.run",
+		"umask 077 && echo "+encoded+" | base64 -d > "+path+".tmp && chmod "+mode+" "+path+".tmp && mv "+path+".tmp "+path)
+}
+
+// Directory in the file_roots of the salt master, files with secrets
+// are only stored there while a minion fetches them.
+const secretFileRoot = "/srv/salt/kubicd-secrets"
+
+// CopySecretFileSalt copies data containing secrets to a file on the
+// salt minions. In contrast to WriteFileSalt the content is not part
+// of the salt job, which would keep it in the job cache of the master
+// and show it in the process list. Instead it is written to a 0600
+// file below secretFileRoot, fetched by the minions with cp.get_file
+// into a private directory and removed from the master afterwards.
+func CopySecretFileSalt(target string, path string, data []byte, mode string) (bool, string) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return false, "Cannot create file name: " + err.Error()
+	}
+	name := hex.EncodeToString(random)
+
+	if err := os.MkdirAll(secretFileRoot, 0700); err != nil {
+		return false, "Cannot create " + secretFileRoot + ": " + err.Error()
+	}
+	source := filepath.Join(secretFileRoot, name)
+	f, err := os.OpenFile(source, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, "Cannot create " + source + ": " + err.Error()
+	}
+	defer os.Remove(source)
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, "Cannot write " + source + ": " + err.Error()
+	}
+
+	// the minion creates the file with its umask, fetch it into a
+	// directory only root can access
+	tmpdir := path + ".kubicd-tmp"
+	success, message := ExecuteCmd("salt", "--module-executors='[direct_call]'", target, "cmd.run",
+		"rm -rf "+tmpdir+" && mkdir -m 0700 "+tmpdir)
+	if success != true {
+		return false, message
+	}
+	success, message = ExecuteCmd("salt", "--module-executors='[direct_call]'", "--out=json", "--static",
+		target, "cp.get_file", "salt://"+filepath.Base(secretFileRoot)+"/"+name, tmpdir+"/"+name)
+	if success == true {
+		var result map[string]string
+		if err := json.Unmarshal([]byte(message), &result); err != nil {
+			success, message = false, "Cannot parse output of salt: "+err.Error()
+		} else if len(result[target]) == 0 {
+			success, message = false, target+" could not fetch the file from the salt master"
+		}
+	}
+	if success != true {
+		ExecuteCmd("salt", "--module-executors='[direct_call]'", target, "cmd.run", "rm -rf "+tmpdir)
+		return false, message
+	}
+	return ExecuteCmd("salt", "--module-executors='[direct_call]'", target, "cmd.run",
+		"chmod "+mode+" "+tmpdir+"/"+name+" && mv "+tmpdir+"/"+name+" "+path+" && rmdir "+tmpdir)
+}
@@ -16,6 +16,8 @@ package yomi
 
 import (
 	pb "github.com/thkukuk/kubic-control/api"
+	"github.com/thkukuk/kubic-control/pkg/audit"
+	"github.com/thkukuk/kubic-control/pkg/rbac"
 	"github.com/thkukuk/kubic-control/pkg/tools"
 )
 
@@ -26,6 +28,17 @@ func Install(in *pb.InstallRequest, stream pb.Yomi_InstallServer) error {
 		return err
 	}
 
+	audit.AddTargets(stream.Context(), []string{in.Saltnode})
+
+	// the new node has no role yet, so only node and grain scopes can match
+	if allowed, message := rbac.CheckTargets(stream.Context(), []string{in.Saltnode}, ""); !allowed {
+		if err := stream.Send(&pb.StatusReply{Success: false,
+			Message: message}); err != nil {
+			return err
+		}
+		return nil
+	}
+
 	pillarName := Salt2PillarName(in.Saltnode)
 	pillarFile := "/srv/pillar/kubicd/" + pillarName + ".sls"
 